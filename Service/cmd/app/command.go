@@ -0,0 +1,69 @@
+package main
+
+import (
+	"AvitoPVZService/Service/config"
+	"AvitoPVZService/Service/migration"
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `usage: app [flags] [migrate up|down|status]
+
+without a command the service starts; see --help for the flags`
+
+// runCommand runs a one-off command instead of the service and returns the exit code.
+func runCommand(config *config.Config, args []string) int {
+	if len(args) != 2 || args[0] != "migrate" {
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	pool, err := connectPostgres(ctx, config)
+	if err != nil {
+		slog.Error("postgres", "err", err)
+		return 1
+	}
+	defer pool.Pool.Close()
+	runner, err := migration.NewRunner(pool.Pool)
+	if err != nil {
+		slog.Error("load migrations", "err", err)
+		return 1
+	}
+
+	switch args[1] {
+	case "up":
+		var applied int
+		if applied, err = runner.Up(ctx); err == nil {
+			slog.Info("migrations applied", "count", applied, "version", migration.Latest())
+		}
+	case "down":
+		err = runner.Down(ctx)
+	case "status":
+		var statuses []migration.Status
+		if statuses, err = runner.Status(ctx); err == nil {
+			for _, s := range statuses {
+				applied := "pending"
+				if s.AppliedAt != nil {
+					applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+				}
+				fmt.Printf("%-20s %s\n", applied, s.Name)
+			}
+		}
+	default:
+		fmt.Fprintln(os.Stderr, usage)
+		return 2
+	}
+	if err != nil {
+		slog.Error("migrate "+args[1], "err", err)
+		return 1
+	}
+
+	return 0
+}
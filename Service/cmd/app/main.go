@@ -3,64 +3,363 @@ package main
 import (
 	"AvitoPVZService/Service/config"
 	"AvitoPVZService/Service/internal/handlers"
+	"AvitoPVZService/Service/internal/health"
+	"AvitoPVZService/Service/internal/lifecycle"
+	"AvitoPVZService/Service/internal/logging"
+	"AvitoPVZService/Service/internal/mailer"
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/oidc"
+	"AvitoPVZService/Service/internal/ratelimit"
 	"AvitoPVZService/Service/internal/repositories/db"
 	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/scheduler"
+	"AvitoPVZService/Service/internal/slo"
+	"AvitoPVZService/Service/internal/tokens"
+	"AvitoPVZService/Service/internal/tracing"
+	"AvitoPVZService/Service/migration"
 	postgres "AvitoPVZService/Service/pkg"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/spf13/pflag"
 	"google.golang.org/grpc"
-	"log"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"log/slog"
 	"net"
 	"net/http"
-	"path/filepath"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Start server")
+	conf, opts, err := config.Load(os.Args[1:])
+	if errors.Is(err, pflag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if opts.PrintConfig {
+		fmt.Print(conf.Redacted())
+		return
+	}
+	if _, err := logging.Setup(os.Stdout, conf.LogLevel, conf.LogFormat); err != nil {
+		fatal("set up logging", "err", err)
+	}
+	slog.Info("starting server", "env", conf.Env)
+	tokens.JWTSecret = conf.SigningKey()
+	if conf.JWTSecret == "" {
+		slog.Warn("JWT_SECRET is not set, tokens are signed with the development key")
+	}
+
+	if len(opts.Args) > 0 {
+		os.Exit(runCommand(&conf, opts.Args))
+	}
 
-	absPath, err := filepath.Abs("config")
-	conf, err := config.LoadConfig(absPath)
+	limiter, err := startRateLimiter(&conf)
 	if err != nil {
-		log.Fatalf("%v", err)
+		fatal("parse rate limits", "err", err)
 	}
 
-	go startMetrics()
-	repo := startRepo(&conf)
-	go startGRPC(&conf, repo)
-	startHTTP(&conf, repo)
+	app := lifecycle.New(conf.ShutdownTimeout)
+	startTracing(&conf, app)
+	startMetrics(&conf, app)
+	repo := startRepo(&conf, app)
+	replicas := startReplicas(&conf, repo, app)
+	checker := startHealth(repo)
+	startJobs(&conf, repo, replicas, app)
+	startGRPC(&conf, repo, limiter, checker, app)
+	startHTTP(&conf, repo, limiter, checker, app)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	if err := app.Run(ctx); err != nil {
+		fatal("server stopped", "err", err)
+	}
+	slog.Info("server stopped")
+}
+
+// fatal logs a failure the process cannot run with and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// startTracing registers its flush first, so it runs last and keeps the spans of the shutdown.
+func startTracing(config *config.Config, app *lifecycle.Manager) {
+	shutdown, err := tracing.Setup(context.Background(), tracing.Config{
+		ServiceName:  "avito-pvz-service",
+		Exporter:     config.TracingExporter,
+		OTLPEndpoint: config.TracingOTLPEndpoint,
+		OTLPInsecure: config.TracingOTLPInsecure,
+		File:         config.TracingFile,
+		SampleRatio:  config.TracingSampleRatio,
+	})
+	if err != nil {
+		fatal("set up tracing", "err", err)
+	}
+	app.OnShutdown("tracing", shutdown)
+	slog.Info("tracing", "exporter", config.TracingExporter)
 }
 
-func startHTTP(config *config.Config, repo interfaces.Repository) {
-	fmt.Println("HTTP server on :8080")
+func startRateLimiter(config *config.Config) (*ratelimit.Limiter, error) {
+	rules, err := ratelimit.ParseRules(config.RateLimits)
+	if err != nil || len(rules) == 0 {
+		return nil, err
+	}
+
+	return ratelimit.New(rules), nil
+}
+
+func startHTTP(config *config.Config, repo interfaces.Repository, limiter *ratelimit.Limiter, checker *health.Checker, app *lifecycle.Manager) {
+	slog.Info("http server", "addr", config.Port)
 	handler := handlers.NewHttpHandlers(repo)
-	log.Fatal(http.ListenAndServe(config.Port, handler))
+	handler.EnforceAssignments = config.EnforceAssignments
+	handler.AccountLockout = tokens.LockoutPolicy{
+		MaxFailures: config.LoginMaxFailures,
+		Window:      config.LoginFailureWindow,
+		BaseDelay:   config.LoginBaseDelay,
+		Lockout:     config.LoginLockout,
+	}
+	handler.MFARequiredRoles = config.MFARequiredRoles
+	handler.TOTPIssuer = config.TOTPIssuer
+	handler.Mailer = startMailer(config)
+	app.OnShutdown("mails", handler.WaitMails)
+	handler.PublicURL = config.PublicURL
+	handler.RequireEmailVerification = config.RequireEmailVerification
+	handler.EmailVerificationTTL = config.EmailVerificationTTL
+	handler.PasswordResetTTL = config.PasswordResetTTL
+	handler.OIDC = startOIDC(config)
+	handler.DisableDummyLogin = config.IsProd()
+	handler.DummyLoginAllowlist, _ = config.DummyLoginNetworks()
+	handler.RateLimiter = limiter
+	handler.IdempotencyTTL = config.IdempotencyTTL
+	handler.SLO = slo.New(config.SLOWindow, slo.Targets{
+		Availability: config.SLOAvailability,
+		Latency:      config.SLOLatency,
+		LatencyRatio: config.SLOLatencyTarget,
+	})
+	handler.IPLockout = tokens.LockoutPolicy{
+		MaxFailures: config.LoginIPMaxFailures,
+		Window:      config.LoginFailureWindow,
+		Lockout:     config.LoginLockout,
+	}
+
+	// probes bypass authentication and rate limits
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", health.LiveHandler())
+	mux.Handle("/readyz", checker.ReadyHandler())
+	mux.Handle("/", handler)
+	app.ServeHTTP("http", &http.Server{Addr: config.Port, Handler: mux})
 }
 
-func startRepo(config *config.Config) *db.PostgresRepository {
-	pool := postgres.New(config.ConnectingString)
-	if pool.Pool == nil {
-		fmt.Println("Nil pointer")
+func startMailer(config *config.Config) mailer.Mailer {
+	switch config.Mailer {
+	case "smtp":
+		return mailer.NewSMTP(mailer.SMTPConfig{
+			Host:     config.SMTPHost,
+			Port:     config.SMTPPort,
+			Username: config.SMTPUsername,
+			Password: config.SMTPPassword,
+			From:     config.MailFrom,
+		})
+	case "file":
+		return &mailer.FileMailer{Dir: config.MailDir, From: config.MailFrom}
+	default:
+		return &mailer.FileMailer{From: config.MailFrom}
+	}
+}
+
+func startOIDC(config *config.Config) *oidc.Provider {
+	if config.OIDCIssuer == "" {
+		return nil
 	}
-	repo := db.New(pool.Pool)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	provider, err := oidc.NewProvider(ctx, oidc.Config{
+		Issuer:       config.OIDCIssuer,
+		ClientID:     config.OIDCClientID,
+		ClientSecret: config.OIDCClientSecret,
+		RedirectURL:  config.OIDCRedirectURL,
+		GroupsClaim:  config.OIDCGroupsClaim,
+		Roles: []oidc.GroupRole{
+			{Role: tokens.RoleModerator, Groups: config.OIDCModeratorGroups},
+			{Role: tokens.RoleEmployee, Groups: config.OIDCEmployeeGroups},
+		},
+	})
+	if err != nil {
+		fatal("oidc discovery", "issuer", config.OIDCIssuer, "err", err)
+	}
+	slog.Info("oidc login enabled", "issuer", config.OIDCIssuer)
+
+	return provider
+}
+
+// connectPostgres waits for the database to come up within DB_CONNECT_ATTEMPTS.
+func connectPostgres(ctx context.Context, config *config.Config) (*postgres.Postgres, error) {
+	return postgres.New(ctx, postgres.Config{
+		DSN:               config.DSN(),
+		MaxConnLifetime:   config.DBMaxConnLifetime,
+		HealthCheckPeriod: config.DBHealthCheckPeriod,
+		StatementTimeout:  config.DBStatementTimeout,
+		ConnectTimeout:    config.DBConnectTimeout,
+		ConnectAttempts:   config.DBConnectAttempts,
+		Backoff:           dbBackoff(config),
+	})
+}
+
+func dbBackoff(config *config.Config) postgres.Backoff {
+	return postgres.Backoff{Base: config.DBRetryBaseDelay, Max: config.DBRetryMaxDelay}
+}
+
+func startRepo(config *config.Config, app *lifecycle.Manager) *db.PostgresRepository {
+	pool, err := connectPostgres(context.Background(), config)
+	if err != nil {
+		fatal("postgres", "err", err)
+	}
+	app.OnShutdown("postgres", func(ctx context.Context) error {
+		pool.Pool.Close()
+		return nil
+	})
+	metrics.RegisterPool(pool.Pool)
+	repo := db.NewWithRetry(pool.Pool, db.Retry{Retries: config.DBRetries, Backoff: dbBackoff(config)})
+
+	if config.RunMigrations {
+		// replicas wait on the migration lock, so this has no deadline
+		runner, err := migration.NewRunner(pool.Pool)
+		if err != nil {
+			fatal("load migrations", "err", err)
+		}
+		if _, err := runner.Up(context.Background()); err != nil {
+			fatal("apply migrations", "err", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := repo.CheckSchema(ctx); err != nil {
+		fatal("postgres schema", "err", err)
+	}
+
+	metrics.RegisterOpenReceptions(repo.OpenReceptions)
+	tokens.UserDeactivated = repo.IsUserDeactivated
+	tokens.APIKeyLookup = repo.UseAPIKey
+	tokens.RejectDummyTokens = config.IsProd()
 
 	return repo
 }
 
-func startMetrics() {
+// startReplicas connects lazily, so a replica that is down only stays out of rotation.
+func startReplicas(config *config.Config, repo *db.PostgresRepository, app *lifecycle.Manager) *db.ReplicaSet {
+	if len(config.DBReplicaDSNs) == 0 {
+		return nil
+	}
+
+	replicas := make([]db.Replica, 0, len(config.DBReplicaDSNs))
+	for _, dsn := range config.ReplicaDSNs() {
+		pool, err := postgres.New(context.Background(), postgres.Config{
+			DSN:               dsn,
+			MaxConnLifetime:   config.DBMaxConnLifetime,
+			HealthCheckPeriod: config.DBHealthCheckPeriod,
+			StatementTimeout:  config.DBStatementTimeout,
+			ConnectTimeout:    config.DBConnectTimeout,
+			Lazy:              true,
+		})
+		if err != nil {
+			fatal("postgres replica", "err", err)
+		}
+		conn := pool.Pool.Config().ConnConfig
+		name := net.JoinHostPort(conn.Host, strconv.Itoa(int(conn.Port)))
+		app.OnShutdown("postgres replica "+name, func(ctx context.Context) error {
+			pool.Pool.Close()
+			return nil
+		})
+		replicas = append(replicas, db.Replica{Name: name, Pool: pool.Pool})
+	}
+
+	set := db.NewReplicaSet(config.DBReplicaMaxLag, replicas...)
+	ctx, cancel := context.WithTimeout(context.Background(), config.DBReplicaCheckInterval)
+	defer cancel()
+	if err := set.Check(ctx); err != nil {
+		slog.Warn("read replicas", "err", err)
+	}
+	repo.UseReplicas(set)
+	slog.Info("read replicas", "count", len(replicas), "max_lag", config.DBReplicaMaxLag)
+
+	return set
+}
+
+func startHealth(repo *db.PostgresRepository) *health.Checker {
+	checker := health.New(health.DefaultTimeout)
+	checker.Add("postgres", repo.Ping)
+	checker.Add("migrations", repo.CheckSchema)
+
+	return checker
+}
+
+func startJobs(config *config.Config, repo interfaces.Repository, replicas *db.ReplicaSet, app *lifecycle.Manager) *scheduler.Scheduler {
+	jobs := scheduler.New()
+	jobs.Every("close_stale_receptions", config.StaleCheckInterval,
+		scheduler.CloseStaleReceptions(repo, config.ReceptionIdleTimeout))
+	jobs.Every("purge_idempotency_keys", time.Hour, scheduler.PurgeIdempotencyKeys(repo))
+	if replicas != nil {
+		jobs.Every("check_replicas", config.DBReplicaCheckInterval, replicas.Check)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs.Start(ctx)
+	app.OnShutdown("jobs", func(ctx context.Context) error {
+		cancel()
+		done := make(chan struct{})
+		go func() {
+			jobs.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	slog.Info("background jobs started", "reception_idle_timeout", config.ReceptionIdleTimeout)
+
+	return jobs
+}
+
+func startMetrics(config *config.Config, app *lifecycle.Manager) {
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", promhttp.Handler())
-	log.Println("Metrics on :9000")
-	log.Fatal(http.ListenAndServe(":9000", mux))
+	slog.Info("metrics server", "addr", config.MetricsAddr)
+	app.ServeHTTP("metrics", &http.Server{Addr: config.MetricsAddr, Handler: mux})
 }
 
-func startGRPC(config *config.Config, repo interfaces.Repository) {
+func startGRPC(config *config.Config, repo interfaces.Repository, limiter *ratelimit.Limiter, checker *health.Checker, app *lifecycle.Manager) {
 	lis, err := net.Listen(config.NetworkType, config.GrpcPort)
 	if err != nil {
-		log.Fatalf("failed to listen: %v", err)
+		fatal("grpc listen", "addr", config.GrpcPort, "err", err)
+	}
+	interceptors := []grpc.UnaryServerInterceptor{
+		tracing.UnaryServerInterceptor(),
+		logging.UnaryServerInterceptor(),
+		handlers.MetricsInterceptor(),
+	}
+	if limiter != nil {
+		interceptors = append(interceptors, handlers.RateLimitInterceptor(limiter))
 	}
-	grpcServer := grpc.NewServer()
+	interceptors = append(interceptors,
+		tokens.UnaryServerInterceptor(handlers.GrpcMethodPermissions),
+		handlers.IdempotencyInterceptor(repo, config.IdempotencyTTL),
+	)
+	grpcServer := grpc.NewServer(grpc.ChainUnaryInterceptor(interceptors...))
 	grpcH := handlers.NewGrpcHandlers(repo)
 	handlers.RegisterPVZServiceServer(grpcServer, grpcH)
-	log.Println("gRPC server listening on :3000")
-	grpcServer.Serve(lis)
+	grpc_health_v1.RegisterHealthServer(grpcServer, health.NewGRPCServer(checker, "pvz.v1.PVZService"))
+	slog.Info("grpc server", "addr", config.GrpcPort)
+	app.ServeGRPC("grpc", grpcServer, func() error { return grpcServer.Serve(lis) })
 }
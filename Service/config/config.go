@@ -1,35 +1,431 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Deployment environments. dummyLogin is disabled in prod and its tokens are rejected there.
+const (
+	EnvDev     = "dev"
+	EnvStaging = "staging"
+	EnvProd    = "prod"
+)
+
+// DefaultFile is read when no --config flag or CONFIG_FILE is given; unlike an explicit
+// file it may be missing, e.g. in a container configured by environment only.
+const DefaultFile = "config/conf.env"
+
+// Every setting is named by its mapstructure key. It can be set, in increasing order of
+// precedence, by a default, the config file, the environment variable of the same name and
+// the command line flag --key-in-kebab-case. Fields tagged secret are redacted when printed.
 type Config struct {
-	Port             string `mapstructure:"PORT"`
-	ConnectingString string `mapstructure:"CONNECTING_STRING"`
-	GrpcPort         string `mapstructure:"GRPC_PORT"`
-	NetworkType      string `mapstructure:"NETWORK_TYPE"`
+	Env string `mapstructure:"ENV"`
+	// DummyLoginAllowlist lists CIDRs allowed to call /dummyLogin besides loopback.
+	DummyLoginAllowlist []string `mapstructure:"DUMMY_LOGIN_ALLOWLIST"`
+
+	Port        string `mapstructure:"PORT"`
+	GrpcPort    string `mapstructure:"GRPC_PORT"`
+	NetworkType string `mapstructure:"NETWORK_TYPE"`
+	// MetricsAddr serves /metrics; it must differ from PORT and GRPC_PORT.
+	MetricsAddr string `mapstructure:"METRICS_ADDR"`
+
+	// ConnectingString is the Postgres DSN; when empty it is built from the DB_* parts.
+	ConnectingString string `mapstructure:"CONNECTING_STRING" secret:"true"`
+	DBHost           string `mapstructure:"DB_HOST"`
+	DBPort           int    `mapstructure:"DB_PORT"`
+	DBUser           string `mapstructure:"DB_USER"`
+	DBPassword       string `mapstructure:"DB_PASSWORD" secret:"true"`
+	DBName           string `mapstructure:"DB_NAME"`
+	DBSSLMode        string `mapstructure:"DB_SSLMODE"`
+	// DBMaxConns and DBMinConns size the pool; 0 keeps the pgx defaults.
+	DBMaxConns int `mapstructure:"DB_MAX_CONNS"`
+	DBMinConns int `mapstructure:"DB_MIN_CONNS"`
+	// DBMaxConnLifetime recycles connections, so the pool follows a failover to the new primary;
+	// DBHealthCheckPeriod is how often idle connections are checked. 0 keeps the pgx defaults.
+	DBMaxConnLifetime   time.Duration `mapstructure:"DB_MAX_CONN_LIFETIME"`
+	DBHealthCheckPeriod time.Duration `mapstructure:"DB_HEALTH_CHECK_PERIOD"`
+	// DBStatementTimeout makes Postgres cancel longer statements; 0 disables it.
+	DBStatementTimeout time.Duration `mapstructure:"DB_STATEMENT_TIMEOUT"`
+	// DBConnectAttempts and DBConnectTimeout bound waiting for the database at startup.
+	DBConnectAttempts int           `mapstructure:"DB_CONNECT_ATTEMPTS"`
+	DBConnectTimeout  time.Duration `mapstructure:"DB_CONNECT_TIMEOUT"`
+	// DBRetries is how many times a statement failing with a transient error is resent;
+	// retries and connection attempts back off exponentially from DB_RETRY_BASE_DELAY
+	// up to DB_RETRY_MAX_DELAY, with jitter.
+	DBRetries        int           `mapstructure:"DB_RETRIES"`
+	DBRetryBaseDelay time.Duration `mapstructure:"DB_RETRY_BASE_DELAY"`
+	DBRetryMaxDelay  time.Duration `mapstructure:"DB_RETRY_MAX_DELAY"`
+	RunMigrations    bool          `mapstructure:"RUN_MIGRATIONS"`
+	// DBReplicaDSNs are read replicas for listings and reports. A replica lagging more than
+	// DB_REPLICA_MAX_LAG at the last check, every DB_REPLICA_CHECK_INTERVAL, is skipped.
+	DBReplicaDSNs          []string      `mapstructure:"DB_REPLICA_DSNS" secret:"true"`
+	DBReplicaMaxLag        time.Duration `mapstructure:"DB_REPLICA_MAX_LAG"`
+	DBReplicaCheckInterval time.Duration `mapstructure:"DB_REPLICA_CHECK_INTERVAL"`
+
+	// JWTSecret signs access tokens; required in prod, a fixed development key is used otherwise.
+	JWTSecret string `mapstructure:"JWT_SECRET" secret:"true"`
+
+	// SLOWindow is the sliding window of GET /slo, checked against the targets below:
+	// the share of non-5xx answers and the share of answers faster than SLOLatency.
+	SLOWindow        time.Duration `mapstructure:"SLO_WINDOW"`
+	SLOAvailability  float64       `mapstructure:"SLO_AVAILABILITY"`
+	SLOLatency       time.Duration `mapstructure:"SLO_LATENCY"`
+	SLOLatencyTarget float64       `mapstructure:"SLO_LATENCY_TARGET"`
+	// LogLevel is "debug", "info", "warn" or "error"; LogFormat is "json" or "text".
+	LogLevel  string `mapstructure:"LOG_LEVEL"`
+	LogFormat string `mapstructure:"LOG_FORMAT"`
+	// TracingExporter is "otlp" (to TRACING_OTLP_ENDPOINT), "stdout" (to TRACING_FILE if set) or "none".
+	TracingExporter     string  `mapstructure:"TRACING_EXPORTER"`
+	TracingOTLPEndpoint string  `mapstructure:"TRACING_OTLP_ENDPOINT"`
+	TracingOTLPInsecure bool    `mapstructure:"TRACING_OTLP_INSECURE"`
+	TracingFile         string  `mapstructure:"TRACING_FILE"`
+	TracingSampleRatio  float64 `mapstructure:"TRACING_SAMPLE_RATIO"`
+	// ShutdownTimeout bounds draining of in-flight requests and stopping of workers on SIGTERM.
+	ShutdownTimeout time.Duration `mapstructure:"SHUTDOWN_TIMEOUT"`
+
+	ReceptionIdleTimeout time.Duration `mapstructure:"RECEPTION_IDLE_TIMEOUT"`
+	StaleCheckInterval   time.Duration `mapstructure:"STALE_CHECK_INTERVAL"`
+	EnforceAssignments   bool          `mapstructure:"ENFORCE_ASSIGNMENTS"`
+
+	LoginMaxFailures   int           `mapstructure:"LOGIN_MAX_FAILURES"`
+	LoginIPMaxFailures int           `mapstructure:"LOGIN_IP_MAX_FAILURES"`
+	LoginFailureWindow time.Duration `mapstructure:"LOGIN_FAILURE_WINDOW"`
+	LoginBaseDelay     time.Duration `mapstructure:"LOGIN_BASE_DELAY"`
+	LoginLockout       time.Duration `mapstructure:"LOGIN_LOCKOUT"`
+
+	// RateLimits are rules "route[@role]=N/unit[:burst]", see ratelimit.ParseRules.
+	RateLimits []string `mapstructure:"RATE_LIMITS"`
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are kept.
+	IdempotencyTTL time.Duration `mapstructure:"IDEMPOTENCY_TTL"`
+
+	MFARequiredRoles []string `mapstructure:"MFA_REQUIRED_ROLES"`
+	TOTPIssuer       string   `mapstructure:"TOTP_ISSUER"`
+
+	// Mailer is "smtp", "file" (writes to MAIL_DIR) or "log".
+	Mailer                   string        `mapstructure:"MAILER"`
+	MailFrom                 string        `mapstructure:"MAIL_FROM"`
+	MailDir                  string        `mapstructure:"MAIL_DIR"`
+	SMTPHost                 string        `mapstructure:"SMTP_HOST"`
+	SMTPPort                 string        `mapstructure:"SMTP_PORT"`
+	SMTPUsername             string        `mapstructure:"SMTP_USERNAME"`
+	SMTPPassword             string        `mapstructure:"SMTP_PASSWORD" secret:"true"`
+	PublicURL                string        `mapstructure:"PUBLIC_URL"`
+	RequireEmailVerification bool          `mapstructure:"REQUIRE_EMAIL_VERIFICATION"`
+	EmailVerificationTTL     time.Duration `mapstructure:"EMAIL_VERIFICATION_TTL"`
+	PasswordResetTTL         time.Duration `mapstructure:"PASSWORD_RESET_TTL"`
+
+	// OIDCIssuer enables SSO login; users get the role of the first matching group list.
+	OIDCIssuer          string   `mapstructure:"OIDC_ISSUER"`
+	OIDCClientID        string   `mapstructure:"OIDC_CLIENT_ID"`
+	OIDCClientSecret    string   `mapstructure:"OIDC_CLIENT_SECRET" secret:"true"`
+	OIDCRedirectURL     string   `mapstructure:"OIDC_REDIRECT_URL"`
+	OIDCGroupsClaim     string   `mapstructure:"OIDC_GROUPS_CLAIM"`
+	OIDCModeratorGroups []string `mapstructure:"OIDC_MODERATOR_GROUPS"`
+	OIDCEmployeeGroups  []string `mapstructure:"OIDC_EMPLOYEE_GROUPS"`
+}
+
+var defaults = map[string]interface{}{
+	"ENV":          EnvProd,
+	"PORT":         ":9000",
+	"GRPC_PORT":    ":3000",
+	"NETWORK_TYPE": "tcp",
+	"METRICS_ADDR": ":9090",
+
+	"DB_HOST":    "localhost",
+	"DB_PORT":    5432,
+	"DB_USER":    "postgres",
+	"DB_NAME":    "avito_pvz",
+	"DB_SSLMODE": "disable",
+
+	"DB_MAX_CONN_LIFETIME":      30 * time.Minute,
+	"DB_HEALTH_CHECK_PERIOD":    10 * time.Second,
+	"DB_STATEMENT_TIMEOUT":      30 * time.Second,
+	"DB_CONNECT_ATTEMPTS":       10,
+	"DB_CONNECT_TIMEOUT":        5 * time.Second,
+	"DB_RETRIES":                3,
+	"DB_RETRY_BASE_DELAY":       100 * time.Millisecond,
+	"DB_RETRY_MAX_DELAY":        5 * time.Second,
+	"DB_REPLICA_MAX_LAG":        5 * time.Second,
+	"DB_REPLICA_CHECK_INTERVAL": 5 * time.Second,
 
-	DBHost     string `env:"DB_HOST" env-default:"localhost"`
-	DBPort     string `env:"DB_PORT" env-default:"5432"`
-	DBUser     string `env:"DB_USER" env-default:"postgres"`
-	DBPassword string `env:"DB_PASSWORD" env-default:"postgres"`
-	DBName     string `env:"DB_NAME" env-default:"avito_pvz"`
-	RunMigs    bool   `env:"RUN_MIGRATIONS" env-default:"false"`
+	"SHUTDOWN_TIMEOUT":       30 * time.Second,
+	"SLO_WINDOW":             30 * time.Minute,
+	"SLO_AVAILABILITY":       0.999,
+	"SLO_LATENCY":            100 * time.Millisecond,
+	"SLO_LATENCY_TARGET":     0.99,
+	"LOG_LEVEL":              "info",
+	"LOG_FORMAT":             "json",
+	"TRACING_EXPORTER":       "none",
+	"TRACING_OTLP_ENDPOINT":  "localhost:4317",
+	"TRACING_SAMPLE_RATIO":   1.0,
+	"RECEPTION_IDLE_TIMEOUT": 12 * time.Hour,
+	"STALE_CHECK_INTERVAL":   time.Minute,
+	"ENFORCE_ASSIGNMENTS":    true,
+	"LOGIN_MAX_FAILURES":     5,
+	"LOGIN_IP_MAX_FAILURES":  50,
+	"LOGIN_FAILURE_WINDOW":   15 * time.Minute,
+	"LOGIN_BASE_DELAY":       time.Second,
+	"LOGIN_LOCKOUT":          15 * time.Minute,
+	"RATE_LIMITS": []string{
+		"*=50/s:100",
+		"/login=10/m", "/login/2fa=10/m", "/register=10/m", "/dummyLogin=10/m",
+		"/password/reset/request=5/m", "/email/verify/resend=5/m",
+	},
+	"IDEMPOTENCY_TTL":            24 * time.Hour,
+	"MFA_REQUIRED_ROLES":         []string{"moderator", "admin"},
+	"TOTP_ISSUER":                "AvitoPVZService",
+	"MAILER":                     "log",
+	"MAIL_FROM":                  "noreply@localhost",
+	"SMTP_PORT":                  "587",
+	"PUBLIC_URL":                 "http://localhost:9000",
+	"REQUIRE_EMAIL_VERIFICATION": true,
+	"EMAIL_VERIFICATION_TTL":     48 * time.Hour,
+	"PASSWORD_RESET_TTL":         time.Hour,
+	"OIDC_GROUPS_CLAIM":          "groups",
 }
 
-func LoadConfig(path string) (config Config, err error) {
-	viper.AddConfigPath(path)
-	viper.SetConfigName("conf")
-	viper.SetConfigType("env")
+// Options are the command line switches that are not settings.
+type Options struct {
+	// PrintConfig asks to print the redacted configuration and exit.
+	PrintConfig bool
+	// Args are the positional arguments left after the flags, e.g. a subcommand.
+	Args []string
+}
+
+// Load reads the configuration from the defaults, the config file, the environment and the
+// command line args (without the program name), then validates it. On -h it returns
+// pflag.ErrHelp after printing the usage.
+func Load(args []string) (Config, Options, error) {
+	var (
+		config Config
+		opts   Options
+	)
+
+	v := viper.New()
+	for key, value := range defaults {
+		v.SetDefault(key, value)
+	}
+
+	flags := pflag.NewFlagSet("pvz", pflag.ContinueOnError)
+	file := flags.String("config", "", "config file in .env format (default "+DefaultFile+", env CONFIG_FILE)")
+	flags.BoolVar(&opts.PrintConfig, "print-config", false, "print the configuration with secrets redacted and exit")
+	settings := settingKeys()
+	for _, s := range settings {
+		if err := v.BindEnv(s.key); err != nil {
+			return config, opts, err
+		}
+		addFlag(flags, s)
+	}
+	if err := flags.Parse(args); err != nil {
+		return config, opts, err
+	}
+	opts.Args = flags.Args()
+
+	if err := readFile(v, *file); err != nil {
+		return config, opts, err
+	}
+	// flags go in as overrides, the only layer above the environment
+	flags.Visit(func(f *pflag.Flag) {
+		for _, s := range settings {
+			if s.flag != f.Name {
+				continue
+			}
+			if s.kind == reflect.Slice {
+				values, _ := flags.GetStringSlice(f.Name)
+				v.Set(s.key, values)
+			} else {
+				v.Set(s.key, f.Value.String())
+			}
+		}
+	})
+
+	if err := v.Unmarshal(&config); err != nil {
+		return config, opts, fmt.Errorf("config: %w", err)
+	}
+
+	return config, opts, config.validate()
+}
+
+func readFile(v *viper.Viper, file string) error {
+	explicit := true
+	if file == "" {
+		file = os.Getenv("CONFIG_FILE")
+	}
+	if file == "" {
+		file, explicit = DefaultFile, false
+	}
+	if _, err := os.Stat(file); err != nil {
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("config file: %w", err)
+	}
 
-	err = viper.ReadInConfig()
-	if err != nil {
-		_ = fmt.Errorf("do not parse config file:%v", err)
+	v.SetConfigFile(file)
+	v.SetConfigType("env")
+	if err := v.ReadInConfig(); err != nil {
+		return fmt.Errorf("config file %s: %w", file, err)
 	}
 
-	err = viper.Unmarshal(&config)
+	return nil
+}
+
+type setting struct {
+	key    string
+	flag   string
+	kind   reflect.Kind
+	field  int
+	secret bool
+}
+
+func settingKeys() []setting {
+	t := reflect.TypeOf(Config{})
+	settings := make([]setting, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := f.Tag.Get("mapstructure")
+		settings = append(settings, setting{
+			key:    key,
+			flag:   strings.ReplaceAll(strings.ToLower(key), "_", "-"),
+			kind:   f.Type.Kind(),
+			field:  i,
+			secret: f.Tag.Get("secret") == "true",
+		})
+	}
+	return settings
+}
+
+// addFlag declares the flag of a setting. Flag defaults are left empty: the defaults above
+// apply through viper, and only flags given on the command line are taken into account.
+func addFlag(flags *pflag.FlagSet, s setting) {
+	usage := "env " + s.key
+	switch {
+	case s.kind == reflect.Bool:
+		flags.Bool(s.flag, false, usage)
+	case s.kind == reflect.Slice:
+		flags.StringSlice(s.flag, nil, usage)
+	case s.kind == reflect.Int || s.kind == reflect.Float64:
+		flags.String(s.flag, "", usage+" (number)")
+	case s.kind == reflect.Int64:
+		flags.String(s.flag, "", usage+" (duration, e.g. 30s)")
+	default:
+		flags.String(s.flag, "", usage)
+	}
+}
+
+// DSN is the Postgres connection string: CONNECTING_STRING as is, or a URL built from the
+// DB_* parts. DB_MAX_CONNS and DB_MIN_CONNS are added as pgxpool parameters if set.
+func (c Config) DSN() string {
+	dsn := c.ConnectingString
+	if dsn == "" {
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.DBUser, c.DBPassword),
+			Host:     net.JoinHostPort(c.DBHost, strconv.Itoa(c.DBPort)),
+			Path:     "/" + c.DBName,
+			RawQuery: url.Values{"sslmode": {c.DBSSLMode}}.Encode(),
+		}
+		dsn = u.String()
+	}
+
+	return c.withPoolParams(dsn)
+}
+
+// ReplicaDSNs are DB_REPLICA_DSNS with the pool sizing of DSN, so a replica takes the same
+// share of connections as the primary.
+func (c Config) ReplicaDSNs() []string {
+	dsns := make([]string, 0, len(c.DBReplicaDSNs))
+	for _, dsn := range c.DBReplicaDSNs {
+		dsns = append(dsns, c.withPoolParams(dsn))
+	}
+
+	return dsns
+}
+
+func (c Config) withPoolParams(dsn string) string {
+	params := map[string]int{"pool_max_conns": c.DBMaxConns, "pool_min_conns": c.DBMinConns}
+	for _, name := range []string{"pool_max_conns", "pool_min_conns"} {
+		if params[name] <= 0 {
+			continue
+		}
+		switch {
+		case strings.Contains(dsn, "://") && strings.Contains(dsn, "?"):
+			dsn += "&" + name + "=" + strconv.Itoa(params[name])
+		case strings.Contains(dsn, "://"):
+			dsn += "?" + name + "=" + strconv.Itoa(params[name])
+		default:
+			dsn += " " + name + "=" + strconv.Itoa(params[name])
+		}
+	}
+
+	return dsn
+}
+
+var dsnPassword = regexp.MustCompile(`password=\S+`)
+
+// Redacted lists the settings as KEY=value lines, sorted, with secrets hidden. The password
+// in a DSN is hidden too, the rest of it is kept to check the host and database.
+func (c Config) Redacted() string {
+	value := reflect.ValueOf(c)
+	lines := make([]string, 0, value.NumField())
+	for _, s := range settingKeys() {
+		field := value.Field(s.field)
+		var text string
+		switch v := field.Interface().(type) {
+		case []string:
+			text = strings.Join(v, ",")
+		default:
+			text = fmt.Sprint(v)
+		}
+		switch {
+		case s.key == "CONNECTING_STRING", s.key == "DB_REPLICA_DSNS":
+			dsns := strings.Split(text, ",")
+			for i := range dsns {
+				dsns[i] = redactDSN(dsns[i])
+			}
+			text = strings.Join(dsns, ",")
+		case s.secret && text != "":
+			text = "[REDACTED]"
+		}
+		lines = append(lines, s.key+"="+text)
+	}
+	sort.Strings(lines)
+
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "password=xxxxx")
+}
+
+func (c Config) IsProd() bool {
+	return c.Env == EnvProd
+}
+
+func (c Config) DummyLoginNetworks() ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(c.DummyLoginAllowlist))
+	for _, cidr := range c.DummyLoginAllowlist {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("DUMMY_LOGIN_ALLOWLIST: %w", err)
+		}
+		networks = append(networks, network)
+	}
 
-	return
+	return networks, nil
 }
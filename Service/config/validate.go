@@ -0,0 +1,153 @@
+package config
+
+import (
+	"AvitoPVZService/Service/internal/ratelimit"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"time"
+)
+
+// devJWTSecret is the key tokens are signed with outside prod when JWT_SECRET is not set.
+const devJWTSecret = "your_jwt_secret"
+
+const minJWTSecretLen = 32
+
+// validate reports every invalid setting at once, each naming its key.
+func (c Config) validate() error {
+	var errs []error
+	fail := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	oneOf := func(key, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		fail("%s must be one of %v, got %q", key, allowed, value)
+	}
+	oneOf("ENV", c.Env, EnvDev, EnvStaging, EnvProd)
+	oneOf("LOG_LEVEL", c.LogLevel, "debug", "info", "warn", "error")
+	oneOf("LOG_FORMAT", c.LogFormat, "json", "text")
+	oneOf("TRACING_EXPORTER", c.TracingExporter, "none", "otlp", "stdout")
+	oneOf("MAILER", c.Mailer, "smtp", "file", "log")
+	oneOf("NETWORK_TYPE", c.NetworkType, "tcp", "tcp4", "tcp6")
+
+	addrs := map[string]string{"PORT": c.Port, "GRPC_PORT": c.GrpcPort, "METRICS_ADDR": c.MetricsAddr}
+	for _, key := range []string{"PORT", "GRPC_PORT", "METRICS_ADDR"} {
+		if _, _, err := net.SplitHostPort(addrs[key]); err != nil {
+			fail("%s must be host:port or :port, got %q", key, addrs[key])
+		}
+	}
+	if c.MetricsAddr == c.Port || c.MetricsAddr == c.GrpcPort || c.Port == c.GrpcPort {
+		fail("PORT %q, GRPC_PORT %q and METRICS_ADDR %q must differ", c.Port, c.GrpcPort, c.MetricsAddr)
+	}
+
+	if c.ConnectingString == "" && c.DBHost == "" {
+		fail("set CONNECTING_STRING or DB_HOST")
+	}
+	if c.DBPort <= 0 || c.DBPort > 65535 {
+		fail("DB_PORT must be a port number, got %d", c.DBPort)
+	}
+	if c.DBMaxConns < 0 || c.DBMinConns < 0 || (c.DBMaxConns > 0 && c.DBMinConns > c.DBMaxConns) {
+		fail("DB_MIN_CONNS %d and DB_MAX_CONNS %d must be non-negative, min not above max", c.DBMinConns, c.DBMaxConns)
+	}
+	if c.DBMaxConnLifetime < 0 || c.DBHealthCheckPeriod < 0 || c.DBStatementTimeout < 0 {
+		fail("DB_MAX_CONN_LIFETIME, DB_HEALTH_CHECK_PERIOD and DB_STATEMENT_TIMEOUT must not be negative")
+	}
+	if c.DBConnectAttempts < 1 {
+		fail("DB_CONNECT_ATTEMPTS must be at least 1, got %d", c.DBConnectAttempts)
+	}
+	if c.DBRetries < 0 {
+		fail("DB_RETRIES must not be negative, got %d", c.DBRetries)
+	}
+	if c.DBRetryMaxDelay < c.DBRetryBaseDelay {
+		fail("DB_RETRY_MAX_DELAY %s must not be below DB_RETRY_BASE_DELAY %s", c.DBRetryMaxDelay, c.DBRetryBaseDelay)
+	}
+
+	if c.IsProd() {
+		if len(c.JWTSecret) < minJWTSecretLen || c.JWTSecret == devJWTSecret {
+			fail("JWT_SECRET must be set to at least %d characters in prod", minJWTSecretLen)
+		}
+	}
+
+	if _, err := c.DummyLoginNetworks(); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := ratelimit.ParseRules(c.RateLimits); err != nil {
+		fail("RATE_LIMITS: %v", err)
+	}
+
+	positive := map[string]time.Duration{
+		"SHUTDOWN_TIMEOUT":          c.ShutdownTimeout,
+		"DB_CONNECT_TIMEOUT":        c.DBConnectTimeout,
+		"DB_RETRY_BASE_DELAY":       c.DBRetryBaseDelay,
+		"DB_REPLICA_MAX_LAG":        c.DBReplicaMaxLag,
+		"DB_REPLICA_CHECK_INTERVAL": c.DBReplicaCheckInterval,
+		"SLO_WINDOW":                c.SLOWindow,
+		"SLO_LATENCY":               c.SLOLatency,
+		"RECEPTION_IDLE_TIMEOUT":    c.ReceptionIdleTimeout,
+		"STALE_CHECK_INTERVAL":      c.StaleCheckInterval,
+		"LOGIN_FAILURE_WINDOW":      c.LoginFailureWindow,
+		"IDEMPOTENCY_TTL":           c.IdempotencyTTL,
+		"EMAIL_VERIFICATION_TTL":    c.EmailVerificationTTL,
+		"PASSWORD_RESET_TTL":        c.PasswordResetTTL,
+	}
+	for _, key := range sortedKeys(positive) {
+		if positive[key] <= 0 {
+			fail("%s must be positive, got %s", key, positive[key])
+		}
+	}
+	if c.LoginBaseDelay < 0 || c.LoginLockout < 0 || c.LoginMaxFailures < 0 || c.LoginIPMaxFailures < 0 {
+		fail("LOGIN_* settings must not be negative")
+	}
+	if c.SLOAvailability <= 0 || c.SLOAvailability > 1 || c.SLOLatencyTarget <= 0 || c.SLOLatencyTarget > 1 {
+		fail("SLO_AVAILABILITY and SLO_LATENCY_TARGET must be in (0, 1]")
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 1 {
+		fail("TRACING_SAMPLE_RATIO must be in [0, 1]")
+	}
+
+	switch c.Mailer {
+	case "smtp":
+		if c.SMTPHost == "" {
+			fail("SMTP_HOST is required with MAILER=smtp")
+		}
+	case "file":
+		if c.MailDir == "" {
+			fail("MAIL_DIR is required with MAILER=file")
+		}
+	}
+	if u, err := url.Parse(c.PublicURL); err != nil || u.Scheme == "" || u.Host == "" {
+		fail("PUBLIC_URL must be an absolute URL, got %q", c.PublicURL)
+	}
+	if c.OIDCIssuer != "" && (c.OIDCClientID == "" || c.OIDCRedirectURL == "") {
+		fail("OIDC_CLIENT_ID and OIDC_REDIRECT_URL are required with OIDC_ISSUER")
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// SigningKey is the JWT key to use: JWT_SECRET, or the development key outside prod.
+func (c Config) SigningKey() []byte {
+	if c.JWTSecret == "" {
+		return []byte(devJWTSecret)
+	}
+	return []byte(c.JWTSecret)
+}
+
+func sortedKeys(m map[string]time.Duration) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -1,21 +1,116 @@
 package domain
 
-import "time"
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
 
 type User struct {
-	ID               string    `json:"id"`
-	Email            string    `json:"email"`
-	PasswordHash     string    `json:"-"`
-	Role             string    `json:"role"`
-	RegistrationDate time.Time `json:"registrationDate"`
+	ID               string     `json:"id"`
+	Email            string     `json:"email"`
+	PasswordHash     string     `json:"-"`
+	Role             string     `json:"role"`
+	RegistrationDate time.Time  `json:"registrationDate"`
+	DeactivatedAt    *time.Time `json:"deactivatedAt,omitempty"`
+	TOTPEnabled      bool       `json:"totpEnabled"`
+	EmailVerified    bool       `json:"emailVerified"`
 }
 
+// Purposes of one-time tokens sent by email.
+const (
+	EmailTokenVerify = "verify_email"
+	EmailTokenReset  = "reset_password"
+)
+
+type TOTP struct {
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type Invite struct {
+	TokenHash string    `json:"-"`
+	Email     string    `json:"email,omitempty"`
+	Role      string    `json:"role"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// APIKey authenticates a machine client. Only the hash of the key is stored; the key itself
+// is shown once on creation.
+type APIKey struct {
+	ID          string     `json:"id"`
+	Name        string     `json:"name"`
+	KeyHash     string     `json:"-"`
+	Permissions []string   `json:"permissions"`
+	PVZIDs      []string   `json:"pvzIds"`
+	CreatedBy   string     `json:"createdBy"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+	LastUsedAt  *time.Time `json:"lastUsedAt,omitempty"`
+	RevokedAt   *time.Time `json:"revokedAt,omitempty"`
+}
+
+// IdempotencyRecord is the stored outcome of the first request made with an Idempotency-Key.
+// Completed is false while that request is still running.
+type IdempotencyRecord struct {
+	RequestHash string
+	Completed   bool
+	StatusCode  int
+	ContentType string
+	Body        []byte
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	Description string   `json:"description"`
+}
+
+type Assignment struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"userId"`
+	PVZID     string     `json:"pvzId"`
+	ValidFrom time.Time  `json:"validFrom"`
+	ValidTo   *time.Time `json:"validTo,omitempty"`
+	CreatedBy string     `json:"createdBy,omitempty"`
+}
+
+// PVZ.Version grows with every change of its receptions and is served as the ETag.
+// LastReception is filled only when a single PVZ is requested.
 type PVZ struct {
-	ID               string    `json:"id"`
-	City             string    `json:"city"`
-	RegistrationDate time.Time `json:"registrationDate"`
+	ID               string          `json:"id"`
+	City             string          `json:"city"`
+	RegistrationDate time.Time       `json:"registrationDate"`
+	Version          int64           `json:"version"`
+	LastReception    json.RawMessage `json:"lastReception,omitempty"`
 }
 
+// LastReceptionOpenedAt returns when the last reception of the PVZ was opened.
+func (p *PVZ) LastReceptionOpenedAt() (time.Time, bool) {
+	var rec struct {
+		OpenAt time.Time `json:"open_at"`
+	}
+	if len(p.LastReception) == 0 || json.Unmarshal(p.LastReception, &rec) != nil || rec.OpenAt.IsZero() {
+		return time.Time{}, false
+	}
+
+	return rec.OpenAt, true
+}
+
+// OpenReception is the state of a currently open reception, for the KPI gauges.
+type OpenReception struct {
+	PVZID    string
+	City     string
+	OpenedAt time.Time
+	Products int
+}
+
+// ErrVersionMismatch is returned by conditional PVZ updates when the PVZ has changed
+// since the version the client has seen.
+var ErrVersionMismatch = errors.New("pvz version mismatch")
+
 type Reception struct {
 	ID       string    `json:"id"`
 	PVZID    string    `json:"pvzId"`
@@ -27,5 +122,83 @@ type Product struct {
 	ID          string    `json:"id"`
 	ReceptionID string    `json:"receptionId"`
 	Type        string    `json:"type"`
+	Barcode     string    `json:"barcode,omitempty"`
 	DateTime    time.Time `json:"dateTime"`
 }
+
+const (
+	ReceptionEventAutoClosed  = "auto_closed"
+	ReceptionEventForceClosed = "force_closed"
+	ReceptionEventReopened    = "reopened"
+)
+
+type ReceptionEvent struct {
+	ID          string    `json:"id"`
+	PVZID       string    `json:"pvzId"`
+	ReceptionID string    `json:"receptionId"`
+	Type        string    `json:"type"`
+	Reason      string    `json:"reason,omitempty"`
+	Actor       string    `json:"actor,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+type ManifestItem struct {
+	Barcode string `json:"barcode"`
+	Type    string `json:"type"`
+}
+
+type Manifest struct {
+	ID          string         `json:"id"`
+	PVZID       string         `json:"pvzId"`
+	ReceptionID string         `json:"receptionId,omitempty"`
+	UploadedAt  time.Time      `json:"uploadedAt"`
+	Items       []ManifestItem `json:"items"`
+}
+
+type DiscrepancyReport struct {
+	ManifestID  string         `json:"manifestId"`
+	ReceptionID string         `json:"receptionId"`
+	Missing     []ManifestItem `json:"missing"`
+	Extra       []ManifestItem `json:"extra"`
+	Duplicate   []ManifestItem `json:"duplicate"`
+}
+
+// NewDiscrepancyReport matches scanned products against the expected manifest by barcode.
+// Products scanned more times than expected are duplicates, products absent from the
+// manifest are extra, and expected items that were never scanned are missing.
+func NewDiscrepancyReport(manifest *Manifest, receptionID string, scanned []Product) *DiscrepancyReport {
+	report := &DiscrepancyReport{
+		ManifestID:  manifest.ID,
+		ReceptionID: receptionID,
+		Missing:     []ManifestItem{},
+		Extra:       []ManifestItem{},
+		Duplicate:   []ManifestItem{},
+	}
+
+	expected := make(map[string]int, len(manifest.Items))
+	for _, item := range manifest.Items {
+		expected[item.Barcode]++
+	}
+
+	seen := make(map[string]int, len(scanned))
+	for _, p := range scanned {
+		item := ManifestItem{Barcode: p.Barcode, Type: p.Type}
+		seen[p.Barcode]++
+		switch {
+		case p.Barcode == "" || expected[p.Barcode] == 0 && seen[p.Barcode] == 1:
+			report.Extra = append(report.Extra, item)
+		case seen[p.Barcode] > expected[p.Barcode]:
+			report.Duplicate = append(report.Duplicate, item)
+		}
+	}
+
+	for _, item := range manifest.Items {
+		if seen[item.Barcode] > 0 {
+			seen[item.Barcode]--
+			continue
+		}
+		report.Missing = append(report.Missing, item)
+	}
+
+	return report
+}
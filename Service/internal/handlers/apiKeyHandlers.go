@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/tokens"
+	"encoding/json"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type createAPIKeyReq struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+	PVZIDs      []string `json:"pvzIds"`
+	ExpiresIn   string   `json:"expiresIn"`
+}
+
+type createAPIKeyResp struct {
+	Key    string        `json:"key"`
+	APIKey domain.APIKey `json:"apiKey"`
+}
+
+// CreateAPIKey issues a key for a machine client. The key is returned only in this response.
+func (h *HttpHandlers) CreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	var req createAPIKeyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Name == "" || len(req.Permissions) == 0 {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	for _, perm := range req.Permissions {
+		if !tokens.IsKnownPermission(perm) {
+			http.Error(w, `{"message":"unknown permission"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	c := tokens.ClaimsFromContext(r.Context())
+	if c == nil || !c.Covers(req.Permissions) {
+		http.Error(w, `{"message":"cannot grant permissions beyond your own"}`, http.StatusForbidden)
+		return
+	}
+	if !h.authorizeKeyScope(w, r, c, req.PVZIDs) {
+		return
+	}
+
+	now := time.Now()
+	var expiresAt *time.Time
+	if req.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, `{"message":"bad expiresIn"}`, http.StatusBadRequest)
+			return
+		}
+		t := now.Add(expiresIn)
+		expiresAt = &t
+	}
+	if req.PVZIDs == nil {
+		req.PVZIDs = []string{}
+	}
+
+	key, hash, err := tokens.NewAPIKey()
+	if err != nil {
+		http.Error(w, `{"message":"cannot generate key"}`, http.StatusInternalServerError)
+		return
+	}
+	k := domain.APIKey{
+		ID:          uuid.NewString(),
+		Name:        req.Name,
+		KeyHash:     hash,
+		Permissions: req.Permissions,
+		PVZIDs:      req.PVZIDs,
+		CreatedBy:   userID(r),
+		CreatedAt:   now,
+		ExpiresAt:   expiresAt,
+	}
+	err = h.data(r.Context()).CreateAPIKey(&k)
+	if err != nil {
+		http.Error(w, `{"message":"cannot create api key"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createAPIKeyResp{Key: key, APIKey: k})
+}
+
+// authorizeKeyScope stops the creator from issuing a key for PVZs beyond their own. An empty
+// scope means any PVZ, so it needs pvz.any; otherwise every PVZ must be assigned to the creator
+// right now. Keys outlive the EnforceAssignments switch, so the check does not depend on it.
+// A key creating keys passes on at most its own scope. Otherwise it writes 403 and returns false.
+func (h *HttpHandlers) authorizeKeyScope(w http.ResponseWriter, r *http.Request, c *tokens.Claims, pvzIDs []string) bool {
+	if c.APIKeyID != "" {
+		if len(c.PVZIDs) == 0 {
+			return true
+		}
+		for _, id := range pvzIDs {
+			if !c.AllowsPVZ(id) {
+				http.Error(w, `{"message":"pvz is outside of api key scope"}`, http.StatusForbidden)
+				return false
+			}
+		}
+		if len(pvzIDs) == 0 {
+			http.Error(w, `{"message":"pvzIds are required"}`, http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if c.Can(tokens.PermPVZAny) {
+		return true
+	}
+	if len(pvzIDs) == 0 {
+		http.Error(w, `{"message":"pvzIds are required"}`, http.StatusForbidden)
+		return false
+	}
+
+	now := time.Now()
+	for _, id := range pvzIDs {
+		err, assigned := h.data(r.Context()).IsAssigned(c.UserID, id, now)
+		if err != nil {
+			http.Error(w, `{"message":"cannot check assignment"}`, http.StatusInternalServerError)
+			return false
+		}
+		if !assigned {
+			http.Error(w, `{"message":"pvz is not assigned to user"}`, http.StatusForbidden)
+			return false
+		}
+	}
+
+	return true
+}
+
+func (h *HttpHandlers) ListAPIKeys(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	err, keys := h.data(r.Context()).ListAPIKeys(limit, offset)
+	if err != nil {
+		http.Error(w, `{"message":"cannot list api keys"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(keys)
+}
+
+func (h *HttpHandlers) RevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api_keys/")
+
+	err := h.data(r.Context()).RevokeAPIKey(id, time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"api key not found"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,181 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/mailer"
+	"AvitoPVZService/Service/internal/tokens"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	defaultEmailVerificationTTL = 48 * time.Hour
+	defaultPasswordResetTTL     = time.Hour
+	mailTimeout                 = 10 * time.Second
+)
+
+// validEmail accepts a bare address only, so the value is safe to put in mail headers.
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Address == email && !strings.ContainsAny(email, "\r\n")
+}
+
+// sendEmailToken issues a one-time token for the user with the email and mails the link.
+// Missing users are skipped silently so the endpoints do not reveal registered emails; the
+// work runs off the request path, so the response takes as long for them as for registered
+// ones. The mail goes out even if the client hangs up.
+func (h *HttpHandlers) sendEmailToken(ctx context.Context, email, purpose string) {
+	if h.Mailer == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), mailTimeout)
+	h.mails.Add(1)
+	go func() {
+		defer h.mails.Done()
+		defer cancel()
+		h.mailEmailToken(ctx, email, purpose)
+	}()
+}
+
+// WaitMails waits for the mails being sent, for a graceful shutdown.
+func (h *HttpHandlers) WaitMails(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		h.mails.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (h *HttpHandlers) mailEmailToken(ctx context.Context, email, purpose string) {
+	token, hash, err := tokens.NewOpaqueToken()
+	if err != nil {
+		slog.ErrorContext(ctx, "email token", "err", err)
+		return
+	}
+	err, created := h.data(ctx).CreateEmailToken(email, purpose, hash, time.Now().Add(h.emailTokenTTL(purpose)))
+	if err != nil {
+		slog.ErrorContext(ctx, "email token", "err", err)
+		return
+	}
+	if !created {
+		return
+	}
+
+	msg := mailer.Message{To: email}
+	switch purpose {
+	case domain.EmailTokenVerify:
+		msg.Subject = "Подтверждение email"
+		msg.Body = fmt.Sprintf("Подтвердите email: %s\n\nКод: %s\n", h.emailLink("/email/verify", token), token)
+	case domain.EmailTokenReset:
+		msg.Subject = "Сброс пароля"
+		msg.Body = fmt.Sprintf("Задайте новый пароль: %s\n\nКод: %s\n\nЕсли вы не запрашивали сброс, проигнорируйте письмо.\n",
+			h.emailLink("/password/reset", token), token)
+	}
+
+	if err := h.Mailer.Send(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "send mail", "purpose", purpose, "err", err)
+	}
+}
+
+func (h *HttpHandlers) emailTokenTTL(purpose string) time.Duration {
+	if purpose == domain.EmailTokenReset {
+		if h.PasswordResetTTL > 0 {
+			return h.PasswordResetTTL
+		}
+		return defaultPasswordResetTTL
+	}
+	if h.EmailVerificationTTL > 0 {
+		return h.EmailVerificationTTL
+	}
+	return defaultEmailVerificationTTL
+}
+
+func (h *HttpHandlers) emailLink(path, token string) string {
+	return strings.TrimSuffix(h.PublicURL, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+// ----------
+
+type emailTokenReq struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+type emailReq struct {
+	Email string `json:"email"`
+}
+
+func (h *HttpHandlers) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	var req emailTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	err, ok := h.data(r.Context()).VerifyEmail(tokens.HashOpaqueToken(req.Token), time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"cannot verify email"}`, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"message":"invalid or expired token"}`, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ResendVerification and RequestPasswordReset always answer 202 whether or not the email exists.
+func (h *HttpHandlers) ResendVerification(w http.ResponseWriter, r *http.Request) {
+	var req emailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validEmail(req.Email) {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.sendEmailToken(r.Context(), req.Email, domain.EmailTokenVerify)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *HttpHandlers) RequestPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req emailReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validEmail(req.Email) {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.sendEmailToken(r.Context(), req.Email, domain.EmailTokenReset)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *HttpHandlers) ConfirmPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req emailTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Token == "" || req.Password == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	err, ok := h.data(r.Context()).ResetPassword(tokens.HashOpaqueToken(req.Token), req.Password, time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"cannot reset password"}`, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"message":"invalid or expired token"}`, http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// PVZ state is versioned: every change of receptions, products, timeout or manifest bumps
+// pvz.version, which is served as a strong ETag. Mutations accept If-Match with that ETag
+// and fail with 412 when the PVZ has changed since; reads answer If-None-Match with 304.
+
+func etag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// parseETag accepts both strong and weak tags; versions are compared by value anyway.
+func parseETag(tag string) (int64, bool) {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.ParseInt(tag[1:len(tag)-1], 10, 64)
+	if err != nil || version < 1 {
+		return 0, false
+	}
+
+	return version, true
+}
+
+// ifMatch returns the version required by If-Match, or zero when the header is absent or "*".
+// A malformed header or a list of tags is rejected with 400, since a mutation can only be
+// conditioned on one version.
+func ifMatch(w http.ResponseWriter, r *http.Request) (int64, bool) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return 0, true
+	}
+	version, ok := parseETag(header)
+	if !ok {
+		http.Error(w, `{"message":"bad If-Match"}`, http.StatusBadRequest)
+		return 0, false
+	}
+
+	return version, true
+}
+
+// notModified sets the ETag of a read and writes 304 when If-None-Match already names it.
+func notModified(w http.ResponseWriter, r *http.Request, version int64) bool {
+	w.Header().Set("ETag", etag(version))
+
+	header := r.Header.Get("If-None-Match")
+	if header == "" {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		if strings.TrimSpace(tag) == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+		if v, ok := parseETag(tag); ok && v == version {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+
+	return false
+}
+
+// mutationFailed writes 412 for a stale If-Match and 500 with msg for anything else.
+func mutationFailed(w http.ResponseWriter, err error, msg string) {
+	if errors.Is(err, domain.ErrVersionMismatch) {
+		http.Error(w, `{"message":"pvz has been modified"}`, http.StatusPreconditionFailed)
+		return
+	}
+	http.Error(w, `{"message":"`+msg+`"}`, http.StatusInternalServerError)
+}
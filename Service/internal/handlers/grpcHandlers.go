@@ -2,12 +2,21 @@ package handlers
 
 import (
 	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/tokens"
 	"context"
 	"fmt"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
+// GrpcMethodPermissions is the permission required by each method, checked by
+// tokens.UnaryServerInterceptor. Health checks are public.
+var GrpcMethodPermissions = map[string]string{
+	"/pvz.v1.PVZService/GetPVZList":            tokens.PermPVZRead,
+	grpc_health_v1.Health_Check_FullMethodName: "",
+}
+
 type GrpcHandlers struct {
 	Data interfaces.Repository
 }
@@ -32,10 +41,19 @@ func (g *GrpcHandlers) GetPVZList(ctx context.Context, _ *GetPVZListRequest) (*G
 	limit := 4
 	offset := 0
 
-	err, resp := g.Data.GrpcListPVz(endPeriod, startPeriod, limit, offset)
+	err, resp := g.Data.WithContext(ctx).GrpcListPVz(endPeriod, startPeriod, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("GetPVZList query error: %w", err)
 	}
+	if c := tokens.ClaimsFromContext(ctx); c != nil && len(c.PVZIDs) > 0 {
+		allowed := make([]*ProtoPVZ, 0, len(resp))
+		for _, pvz := range resp {
+			if c.AllowsPVZ(pvz.Id) {
+				allowed = append(allowed, pvz)
+			}
+		}
+		resp = allowed
+	}
 
 	return &GetPVZListResponse{PVZs: resp}, nil
 }
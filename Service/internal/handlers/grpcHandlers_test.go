@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
 	"context"
 	"encoding/json"
 	"google.golang.org/protobuf/types/known/timestamppb"
@@ -11,17 +12,103 @@ import (
 
 type fakeRepo struct{}
 
-func (f *fakeRepo) Register(email, password, role string) error        { return nil }
-func (f *fakeRepo) Login(email string) (error, *domain.User)           { return nil, nil }
-func (f *fakeRepo) CreatePVZ(city, id string, regTime time.Time) error { return nil }
-func (f *fakeRepo) CreateReception(PVZID, id string, dateTime time.Time) (error, *json.RawMessage) {
+func (f *fakeRepo) WithContext(ctx context.Context) interfaces.Repository { return f }
+func (f *fakeRepo) Register(email, password, role string) error           { return nil }
+func (f *fakeRepo) Login(email string) (error, *domain.User)              { return nil, nil }
+func (f *fakeRepo) RolePermissions(role string) (error, []string)         { return nil, nil }
+func (f *fakeRepo) ListRoles() (error, []domain.Role)                     { return nil, nil }
+func (f *fakeRepo) SaveRole(role *domain.Role) error                      { return nil }
+func (f *fakeRepo) AssignEmployee(a *domain.Assignment) error             { return nil }
+func (f *fakeRepo) RevokeAssignment(id string, at time.Time) error        { return nil }
+func (f *fakeRepo) ListAssignments(userID, PVZID string, limit, offset int) (error, []domain.Assignment) {
 	return nil, nil
 }
-func (f *fakeRepo) AddProduct(id string, dateTime time.Time, prodType, PVZID string) (error, *json.RawMessage) {
+func (f *fakeRepo) IsAssigned(userID, PVZID string, at time.Time) (error, bool) { return nil, true }
+func (f *fakeRepo) LoginBlockedUntil(keys []string, now time.Time) (error, time.Time) {
+	return nil, time.Time{}
+}
+func (f *fakeRepo) RecordLoginFailure(key string, now time.Time, window time.Duration) (error, int) {
+	return nil, 0
+}
+func (f *fakeRepo) LockLogin(key string, until time.Time) error { return nil }
+func (f *fakeRepo) ResetLoginFailures(key string) error         { return nil }
+func (f *fakeRepo) UnlockUser(id string) error                  { return nil }
+func (f *fakeRepo) StartIdempotentRequest(subject, key, requestHash string, now, expiresAt time.Time) (error, *domain.IdempotencyRecord) {
+	return nil, nil
+}
+func (f *fakeRepo) CompleteIdempotentRequest(subject, key string, record *domain.IdempotencyRecord) error {
+	return nil
+}
+func (f *fakeRepo) ReleaseIdempotentRequest(subject, key string) error             { return nil }
+func (f *fakeRepo) DeleteExpiredIdempotencyKeys(now time.Time) (error, int64)      { return nil, 0 }
+func (f *fakeRepo) CreateAPIKey(k *domain.APIKey) error                            { return nil }
+func (f *fakeRepo) ListAPIKeys(limit, offset int) (error, []domain.APIKey)         { return nil, nil }
+func (f *fakeRepo) RevokeAPIKey(id string, at time.Time) error                     { return nil }
+func (f *fakeRepo) UseAPIKey(keyHash string, at time.Time) (error, *domain.APIKey) { return nil, nil }
+func (f *fakeRepo) ProvisionExternalUser(issuer, subject, email, role string, at time.Time) (error, *domain.User) {
+	return nil, &domain.User{ID: subject, Email: email, Role: role}
+}
+func (f *fakeRepo) CreateEmailToken(email, purpose, tokenHash string, expiresAt time.Time) (error, bool) {
+	return nil, true
+}
+func (f *fakeRepo) VerifyEmail(tokenHash string, at time.Time) (error, bool) { return nil, true }
+func (f *fakeRepo) ResetPassword(tokenHash, password string, at time.Time) (error, bool) {
+	return nil, true
+}
+func (f *fakeRepo) GetTOTP(userID string) (error, *domain.TOTP)             { return nil, &domain.TOTP{} }
+func (f *fakeRepo) SetTOTPSecret(userID, secret string) error               { return nil }
+func (f *fakeRepo) EnableTOTP(userID string, recoveryHashes []string) error { return nil }
+func (f *fakeRepo) UseTOTPStep(userID string, step int64) (error, bool)     { return nil, true }
+func (f *fakeRepo) UseRecoveryCode(userID, codeHash string, at time.Time) (error, bool) {
+	return nil, true
+}
+func (f *fakeRepo) ResetTOTP(userID string) error { return nil }
+func (f *fakeRepo) RegisterWithInvite(email, password, inviteHash string, at time.Time) (error, string) {
+	return nil, ""
+}
+func (f *fakeRepo) CreateInvite(inv *domain.Invite) error { return nil }
+func (f *fakeRepo) ListUsers(search, role string, limit, offset int) (error, []domain.User) {
+	return nil, nil
+}
+func (f *fakeRepo) SetUserActive(id string, active bool, at time.Time) error { return nil }
+func (f *fakeRepo) ChangeUserRole(id, role string) error                     { return nil }
+func (f *fakeRepo) IsUserDeactivated(id string) (error, bool)                { return nil, false }
+func (f *fakeRepo) UserPermissions(id string) (error, []string)              { return nil, nil }
+func (f *fakeRepo) CreatePVZ(city, id string, regTime time.Time) error       { return nil }
+func (f *fakeRepo) GetPVZ(PVZID string) (error, *domain.PVZ)                 { return nil, nil }
+func (f *fakeRepo) PVZVersion(PVZID string) (error, int64)                   { return nil, 0 }
+func (f *fakeRepo) CreateReception(PVZID, id string, dateTime time.Time, ifVersion int64) (error, *json.RawMessage, int64) {
+	return nil, nil, 0
+}
+func (f *fakeRepo) AddProduct(id string, dateTime time.Time, prodType, barcode, PVZID string, ifVersion int64) (error, *json.RawMessage, int64) {
+	return nil, nil, 0
+}
+func (f *fakeRepo) DeleteLastProduct(PVZID string, ifVersion int64) (error, int64) { return nil, 0 }
+func (f *fakeRepo) CloseLastReception(PVZID string, closedAt time.Time, ifVersion int64) (error, string, int64) {
+	return nil, "", 0
+}
+func (f *fakeRepo) ForceCloseReception(PVZID string, closedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	return nil, nil, 0
+}
+func (f *fakeRepo) ReopenLastReception(PVZID string, reopenedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	return nil, nil, 0
+}
+func (f *fakeRepo) ReceptionEvents(PVZID string, limit, offset int) (error, []domain.ReceptionEvent) {
+	return nil, nil
+}
+func (f *fakeRepo) CloseStaleReceptions(now time.Time, idleTimeout time.Duration) (error, []domain.ReceptionEvent) {
+	return nil, nil
+}
+func (f *fakeRepo) SetReceptionTimeout(PVZID string, timeout time.Duration, ifVersion int64) (error, int64) {
+	return nil, 0
+}
+func (f *fakeRepo) UploadManifest(PVZID, id string, items []domain.ManifestItem, uploadedAt time.Time, ifVersion int64) (error, int64) {
+	return nil, 0
+}
+func (f *fakeRepo) ManifestReport(PVZID string) (error, *domain.DiscrepancyReport) { return nil, nil }
+func (f *fakeRepo) ReconcileManifest(PVZID, receptionID string) (error, *domain.DiscrepancyReport) {
 	return nil, nil
 }
-func (f *fakeRepo) DeleteLastProduct(PVZID string) error                      { return nil }
-func (f *fakeRepo) CloseLastReception(PVZID string, closedAt time.Time) error { return nil }
 func (f *fakeRepo) ListPVZ(endStr, startStr string, limit, offset int) (error, *[]domain.PVZ) {
 	return nil, nil
 }
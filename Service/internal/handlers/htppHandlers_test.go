@@ -2,11 +2,23 @@ package handlers
 
 import (
 	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/ratelimit"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/slo"
+	"AvitoPVZService/Service/internal/tokens"
+	"AvitoPVZService/Service/internal/tracing"
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,27 +30,263 @@ func (f *fakeRepoHTTP) Login(email string) (error, *domain.User) {
 	panic("implement me")
 }
 
+func (f *fakeRepoHTTP) ProvisionExternalUser(issuer, subject, email, role string, at time.Time) (error, *domain.User) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) CreateEmailToken(email, purpose, tokenHash string, expiresAt time.Time) (error, bool) {
+	return nil, email == "known@b.c"
+}
+
+func (f *fakeRepoHTTP) VerifyEmail(tokenHash string, at time.Time) (error, bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ResetPassword(tokenHash, password string, at time.Time) (error, bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) GetTOTP(userID string) (error, *domain.TOTP) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) SetTOTPSecret(userID, secret string) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) EnableTOTP(userID string, recoveryHashes []string) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) UseTOTPStep(userID string, step int64) (error, bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) UseRecoveryCode(userID, codeHash string, at time.Time) (error, bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ResetTOTP(userID string) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) CreateAPIKey(k *domain.APIKey) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) ListAPIKeys(limit, offset int) (error, []domain.APIKey) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) RevokeAPIKey(id string, at time.Time) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) UseAPIKey(keyHash string, at time.Time) (error, *domain.APIKey) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) StartIdempotentRequest(subject, key, requestHash string, now, expiresAt time.Time) (error, *domain.IdempotencyRecord) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) CompleteIdempotentRequest(subject, key string, record *domain.IdempotencyRecord) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ReleaseIdempotentRequest(subject, key string) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) DeleteExpiredIdempotencyKeys(now time.Time) (error, int64) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) RolePermissions(role string) (error, []string) {
+	if perms, ok := tokens.DefaultRolePermissions[role]; ok {
+		return nil, perms
+	}
+	return fmt.Errorf("unknown role"), nil
+}
+
+func (f *fakeRepoHTTP) ListRoles() (error, []domain.Role) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) SaveRole(role *domain.Role) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) AssignEmployee(a *domain.Assignment) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) RevokeAssignment(id string, at time.Time) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ListAssignments(userID, PVZID string, limit, offset int) (error, []domain.Assignment) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) IsAssigned(userID, PVZID string, at time.Time) (error, bool) {
+	return nil, userID == "emp1" && PVZID == "pvz1"
+}
+
+func (f *fakeRepoHTTP) LoginBlockedUntil(keys []string, now time.Time) (error, time.Time) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) RecordLoginFailure(key string, now time.Time, window time.Duration) (error, int) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) LockLogin(key string, until time.Time) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ResetLoginFailures(key string) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) UnlockUser(id string) error {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) RegisterWithInvite(email, password, inviteHash string, at time.Time) (error, string) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) CreateInvite(inv *domain.Invite) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) ListUsers(search, role string, limit, offset int) (error, []domain.User) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) SetUserActive(id string, active bool, at time.Time) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) ChangeUserRole(id, role string) error {
+	return nil
+}
+
+func (f *fakeRepoHTTP) IsUserDeactivated(id string) (error, bool) {
+	//TODO implement me
+	panic("implement me")
+}
+
+// UserPermissions knows an admin "admin1" and an auditor "aud1".
+func (f *fakeRepoHTTP) UserPermissions(id string) (error, []string) {
+	switch id {
+	case "admin1":
+		return nil, tokens.DefaultRolePermissions[tokens.RoleAdmin]
+	case "aud1":
+		return nil, tokens.DefaultRolePermissions[tokens.RoleAuditor]
+	}
+	return fmt.Errorf("user not found"), nil
+}
+
 func (f *fakeRepoHTTP) CreatePVZ(city, id string, regTime time.Time) error {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (f *fakeRepoHTTP) CreateReception(PVZID string, id string, dateTime time.Time) (error, *json.RawMessage) {
+func (f *fakeRepoHTTP) GetPVZ(PVZID string) (error, *domain.PVZ) {
+	return nil, &domain.PVZ{ID: PVZID, City: "Москва", Version: 1}
+}
+
+func (f *fakeRepoHTTP) PVZVersion(PVZID string) (error, int64) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) CreateReception(PVZID string, id string, dateTime time.Time, ifVersion int64) (error, *json.RawMessage, int64) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) AddProduct(id string, dateTime time.Time, prodType, barcode, PVZID string, ifVersion int64) (error, *json.RawMessage, int64) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) DeleteLastProduct(PVZID string, ifVersion int64) (error, int64) {
+	if ifVersion != 0 && ifVersion != 1 {
+		return domain.ErrVersionMismatch, 0
+	}
+	return nil, 2
+}
+
+func (f *fakeRepoHTTP) CloseLastReception(PVZID string, closedAt time.Time, ifVersion int64) (error, string, int64) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) ForceCloseReception(PVZID string, closedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (f *fakeRepoHTTP) AddProduct(id string, dateTime time.Time, prodType, PVZID string) (error, *json.RawMessage) {
+func (f *fakeRepoHTTP) ReopenLastReception(PVZID string, reopenedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	return nil, &domain.ReceptionEvent{PVZID: PVZID, Type: domain.ReceptionEventReopened, Reason: reason, Actor: actor}, 2
+}
+
+func (f *fakeRepoHTTP) ReceptionEvents(PVZID string, limit, offset int) (error, []domain.ReceptionEvent) {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (f *fakeRepoHTTP) DeleteLastProduct(PVZID string) error {
+func (f *fakeRepoHTTP) CloseStaleReceptions(now time.Time, idleTimeout time.Duration) (error, []domain.ReceptionEvent) {
+	//TODO implement me
+	panic("implement me")
+}
+
+func (f *fakeRepoHTTP) SetReceptionTimeout(PVZID string, timeout time.Duration, ifVersion int64) (error, int64) {
+	return nil, 2
+}
+
+func (f *fakeRepoHTTP) UploadManifest(PVZID, id string, items []domain.ManifestItem, uploadedAt time.Time, ifVersion int64) (error, int64) {
+	if len(items) == 0 {
+		return fmt.Errorf("empty manifest"), 0
+	}
+	return nil, 2
+}
+
+func (f *fakeRepoHTTP) ManifestReport(PVZID string) (error, *domain.DiscrepancyReport) {
 	//TODO implement me
 	panic("implement me")
 }
 
-func (f *fakeRepoHTTP) CloseLastReception(PVZID string, closedAt time.Time) error {
+func (f *fakeRepoHTTP) ReconcileManifest(PVZID, receptionID string) (error, *domain.DiscrepancyReport) {
 	//TODO implement me
 	panic("implement me")
 }
@@ -53,6 +301,10 @@ func (f *fakeRepoHTTP) GrpcListPVz(endPeriod, startPeriod string, limit, offset
 	panic("implement me")
 }
 
+func (f *fakeRepoHTTP) WithContext(ctx context.Context) interfaces.Repository {
+	return f
+}
+
 func (f *fakeRepoHTTP) Register(email, password, role string) error {
 	if email == "" || role != "employee" && role != "moderator" {
 		return fmt.Errorf("bad data")
@@ -62,11 +314,14 @@ func (f *fakeRepoHTTP) Register(email, password, role string) error {
 
 func TestDummyLogin_BadRequest(t *testing.T) {
 	handler := NewHttpHandlers(&fakeRepoHTTP{})
-	rec := httptest.NewRecorder()
-	req := httptest.NewRequest(http.MethodPost, "/dummyLogin", bytes.NewBufferString(`{"role":"bad"}`))
-	handler.DummyLogin(rec, req)
-	if rec.Code != http.StatusBadRequest {
-		t.Errorf("expected 400, got %d", rec.Code)
+	for _, role := range []string{"bad", tokens.RoleAdmin} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/dummyLogin", bytes.NewBufferString(`{"role":"`+role+`"}`))
+		req.RemoteAddr = "127.0.0.1:40000"
+		handler.DummyLogin(rec, req)
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", role, rec.Code)
+		}
 	}
 }
 
@@ -74,6 +329,7 @@ func TestDummyLogin_Success(t *testing.T) {
 	handler := NewHttpHandlers(&fakeRepoHTTP{})
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodPost, "/dummyLogin", bytes.NewBufferString(`{"role":"employee"}`))
+	req.RemoteAddr = "127.0.0.1:40000"
 	handler.DummyLogin(rec, req)
 	if rec.Code != http.StatusOK {
 		t.Fatalf("expected 200, got %d", rec.Code)
@@ -86,3 +342,471 @@ func TestDummyLogin_Success(t *testing.T) {
 		t.Error("empty token")
 	}
 }
+
+func TestDummyLogin_RemoteClientForbidden(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	handler.DummyLoginAllowlist = []*net.IPNet{network}
+
+	for addr, want := range map[string]int{"192.0.2.1:1234": http.StatusForbidden, "10.1.2.3:1234": http.StatusOK} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/dummyLogin", bytes.NewBufferString(`{"role":"employee"}`))
+		req.RemoteAddr = addr
+		req.Header.Set("X-Forwarded-For", "127.0.0.1")
+		handler.DummyLogin(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", addr, want, rec.Code)
+		}
+	}
+}
+
+func TestDummyLogin_DisabledInProduction(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.DisableDummyLogin = true
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/dummyLogin", bytes.NewBufferString(`{"role":"moderator"}`))
+	req.RemoteAddr = "127.0.0.1:40000"
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404, got %d", rec.Code)
+	}
+}
+
+func TestUploadManifest_BadItem(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/manifest", bytes.NewBufferString(`{"items":[{"barcode":"","type":"обувь"}]}`))
+	handler.UploadManifest(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestUploadManifest_Success(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/manifest", bytes.NewBufferString(`{"items":[{"barcode":"4600001","type":"обувь"}]}`))
+	handler.UploadManifest(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var manifest domain.Manifest
+	if err := json.NewDecoder(rec.Body).Decode(&manifest); err != nil {
+		t.Fatal("response is not a manifest")
+	}
+	if manifest.PVZID != "pvz1" || len(manifest.Items) != 1 {
+		t.Errorf("unexpected manifest: %+v", manifest)
+	}
+}
+
+func TestSetReceptionTimeout_BadDuration(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/reception_timeout", bytes.NewBufferString(`{"timeout":"-1h"}`))
+	handler.SetReceptionTimeout(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestReopenLastReception_RequiresReason(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", "moderator")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/reopen_last_reception", bytes.NewBufferString(`{"reason":"  "}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestReopenLastReception_RecordsActor(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", "moderator")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/reopen_last_reception", bytes.NewBufferString(`{"reason":"wrong product type"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var event domain.ReceptionEvent
+	if err := json.NewDecoder(rec.Body).Decode(&event); err != nil {
+		t.Fatal("response is not an event")
+	}
+	if event.Actor != "mod1" || event.Reason != "wrong product type" {
+		t.Errorf("unexpected event: %+v", event)
+	}
+}
+
+func TestDeleteLastProduct_UnassignedEmployeeForbidden(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.EnforceAssignments = true
+	token, _ := tokens.CreateToken("emp1", "employee")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz2/delete_last_product", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestDeleteLastProduct_AssignedEmployee(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.EnforceAssignments = true
+	token, _ := tokens.CreateToken("emp1", "employee")
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/delete_last_product", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d", rec.Code)
+	}
+}
+
+func TestDeleteLastProduct_IfMatch(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("emp1", "employee")
+	cases := []struct {
+		ifMatch string
+		code    int
+		etag    string
+	}{
+		{"", http.StatusOK, `"2"`},
+		{`"1"`, http.StatusOK, `"2"`},
+		{`W/"1"`, http.StatusOK, `"2"`},
+		{`"7"`, http.StatusPreconditionFailed, ""},
+		{`"1", "2"`, http.StatusBadRequest, ""},
+		{"1", http.StatusBadRequest, ""},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/delete_last_product", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		if c.ifMatch != "" {
+			req.Header.Set("If-Match", c.ifMatch)
+		}
+		handler.ServeHTTP(rec, req)
+		if rec.Code != c.code || rec.Header().Get("ETag") != c.etag {
+			t.Errorf("If-Match %q: expected %d %q, got %d %q", c.ifMatch, c.code, c.etag, rec.Code, rec.Header().Get("ETag"))
+		}
+	}
+}
+
+func TestGetPVZ_IfNoneMatch(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("emp1", "employee")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("ETag") != `"1"` {
+		t.Fatalf("expected 200 with ETag, got %d %q", rec.Code, rec.Header().Get("ETag"))
+	}
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("If-None-Match", `"0", "1"`)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("expected 304 without body, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestCreatePVZ_AuditorForbidden(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("aud1", tokens.RoleAuditor)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/pvz", bytes.NewBufferString(`{"city":"Москва"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestSaveRole_UnknownPermission(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("adm1", tokens.RoleAdmin)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/roles/regional", bytes.NewBufferString(`{"permissions":["pvz.read","pvz.delete"]}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestRegister_ModeratorWithoutInviteForbidden(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString(`{"email":"a@b.c","password":"p","role":"moderator"}`))
+	handler.Register(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestRegister_EmployeeByDefault(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString(`{"email":"a@b.c","password":"p"}`))
+	handler.Register(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var resp map[string]string
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp["role"] != "employee" {
+		t.Errorf("expected employee role, got %q", resp["role"])
+	}
+}
+
+func TestCreateInvite_CannotGrantAdmin(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/invites", bytes.NewBufferString(`{"role":"admin"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestCreateInvite_Success(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/invites", bytes.NewBufferString(`{"email":"new@b.c","role":"moderator"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var resp map[string]interface{}
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if resp["token"] == "" || resp["role"] != "moderator" {
+		t.Errorf("unexpected invite: %v", resp)
+	}
+}
+
+func TestRegister_InvalidEmail(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/register", bytes.NewBufferString(`{"email":"not an email","password":"p"}`))
+	handler.Register(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("expected 400, got %d", rec.Code)
+	}
+}
+
+func TestManageUser_CannotActOnMorePrivilegedUser(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	tests := []struct {
+		path, body string
+		want       int
+	}{
+		{"/users/admin1/deactivate", "", http.StatusForbidden},
+		{"/users/admin1/role", `{"role":"employee"}`, http.StatusForbidden},
+		{"/users/aud1/deactivate", "", http.StatusOK},
+		{"/users/aud1/role", `{"role":"auditor"}`, http.StatusOK},
+		{"/users/admin1/2fa/reset", "", http.StatusForbidden},
+		{"/users/aud1/2fa/reset", "", http.StatusOK},
+		{"/users/mod1/2fa/reset", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(rec, req)
+		if rec.Code != tt.want {
+			t.Errorf("%s: expected %d, got %d", tt.path, tt.want, rec.Code)
+		}
+	}
+}
+
+func TestCreateAPIKey_CannotExceedOwnPermissions(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api_keys", bytes.NewBufferString(`{"name":"cron","permissions":["role.manage"]}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestCreateAPIKey_Success(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/api_keys", bytes.NewBufferString(`{"name":"analytics","permissions":["pvz.read"],"expiresIn":"720h"}`))
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	var resp createAPIKeyResp
+	json.NewDecoder(rec.Body).Decode(&resp)
+	if !strings.HasPrefix(resp.Key, "pvz_") || resp.APIKey.ExpiresAt == nil || resp.APIKey.CreatedBy != "mod1" {
+		t.Errorf("unexpected api key: %+v", resp)
+	}
+}
+
+func TestCreateAPIKey_ScopeLimitedToAssignments(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateTokenWithPermissions("emp1", tokens.RoleEmployee, []string{tokens.PermPVZRead, tokens.PermAPIKeyManage})
+	for body, want := range map[string]int{
+		`{"name":"cron","permissions":["pvz.read"]}`:                          http.StatusForbidden,
+		`{"name":"cron","permissions":["pvz.read"],"pvzIds":["pvz1","pvz2"]}`: http.StatusForbidden,
+		`{"name":"cron","permissions":["pvz.read"],"pvzIds":["pvz1"]}`:        http.StatusCreated,
+	} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/api_keys", bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", body, want, rec.Code)
+		}
+	}
+}
+
+func TestDeleteLastProduct_APIKeyOutsideScope(t *testing.T) {
+	tokens.APIKeyLookup = func(keyHash string, at time.Time) (error, *domain.APIKey) {
+		return nil, &domain.APIKey{ID: "k1", Permissions: []string{tokens.PermProductDelete}, PVZIDs: []string{"pvz1"}}
+	}
+	defer func() { tokens.APIKeyLookup = nil }()
+
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.EnforceAssignments = true
+	for pvz, want := range map[string]int{"pvz1": http.StatusOK, "pvz2": http.StatusForbidden} {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/pvz/"+pvz+"/delete_last_product", nil)
+		req.Header.Set("X-API-Key", "pvz_key")
+		handler.ServeHTTP(rec, req)
+		if rec.Code != want {
+			t.Errorf("%s: expected %d, got %d", pvz, want, rec.Code)
+		}
+	}
+}
+
+func TestRateLimit_PerUser(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.RateLimiter = ratelimit.New([]ratelimit.Rule{{Route: "/pvz/*", Limit: ratelimit.Limit{Rate: 0.1, Burst: 1}}})
+	first, _ := tokens.CreateToken("mod1", tokens.RoleModerator)
+	second, _ := tokens.CreateToken("mod2", tokens.RoleModerator)
+
+	call := func(token string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/reception_timeout", bytes.NewBufferString(`{"timeout":"1h"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := call(first); rec.Code == http.StatusTooManyRequests {
+		t.Fatal("first request must pass")
+	}
+	rec := call(first)
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected Retry-After 10, got %q", rec.Header().Get("Retry-After"))
+	}
+	if rec := call(second); rec.Code == http.StatusTooManyRequests {
+		t.Error("other users must not share the limit")
+	}
+}
+
+func TestServeHTTP_RequestID(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil)
+	req.Header.Set("X-Request-ID", "ticket-42")
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "ticket-42" {
+		t.Errorf("expected the caller's request id to be echoed, got %q", got)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil))
+	if rec.Header().Get("X-Request-ID") == "" {
+		t.Error("expected a generated request id")
+	}
+}
+
+func TestRouteLabel(t *testing.T) {
+	cases := map[string]string{
+		"/pvz":                                 "/pvz",
+		"/pvz/6f1c2a7e/delete_last_product":    "/pvz/{id}/delete_last_product",
+		"/users/42/2fa/reset":                  "/users/{id}/2fa/reset",
+		"/api_keys/k1":                         "/api_keys/{id}",
+		"/wp-admin/install.php":                "other",
+		"/pvz/6f1c2a7e/../../etc/passwd/x/y/z": "other",
+	}
+	for path, want := range cases {
+		if got := routeLabel(path); got != want {
+			t.Errorf("routeLabel(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestSLOReport_CountsRequests(t *testing.T) {
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	handler.SLO = slo.New(time.Minute, slo.Targets{Availability: 0.99, Latency: time.Second, LatencyRatio: 0.99})
+	token, _ := tokens.CreateToken("emp1", "employee")
+
+	req := httptest.NewRequest(http.MethodPost, "/pvz/pvz1/delete_last_product", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	auditor, _ := tokens.CreateToken("aud1", tokens.RoleAuditor)
+	rec := httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/slo", nil)
+	req.Header.Set("Authorization", "Bearer "+auditor)
+	handler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rec.Code)
+	}
+	var report slo.Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if got := report.Routes["POST /pvz/{id}/delete_last_product"]; got.Requests != 1 || !got.AvailabilityMet {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestServeHTTP_SpanCarriesPVZAndUser(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	handler := NewHttpHandlers(&fakeRepoHTTP{})
+	token, _ := tokens.CreateToken("emp1", "employee")
+	req := httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 || spans[0].Name() != "GET /pvz/{id}" {
+		t.Fatalf("expected the server span, got %d spans", len(spans))
+	}
+	attrs := map[attribute.Key]string{}
+	for _, kv := range spans[0].Attributes() {
+		attrs[kv.Key] = kv.Value.Emit()
+	}
+	if attrs[tracing.AttrPVZID] != "pvz1" || attrs[tracing.AttrUserID] != "emp1" || attrs[tracing.AttrUserRole] != "employee" {
+		t.Errorf("unexpected attributes %v", attrs)
+	}
+}
@@ -2,26 +2,93 @@ package handlers
 
 import (
 	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/mailer"
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/oidc"
+	"AvitoPVZService/Service/internal/ratelimit"
 	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/slo"
 	"AvitoPVZService/Service/internal/tokens"
+	"AvitoPVZService/Service/internal/tracing"
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/google/uuid"
+	"log/slog"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type HttpHandlers struct {
 	Data interfaces.Repository
+
+	// EnforceAssignments restricts users without the pvz.any permission to the PVZs they are assigned to.
+	EnforceAssignments bool
+	// AccountLockout and IPLockout throttle failed logins per email and per client IP.
+	AccountLockout tokens.LockoutPolicy
+	IPLockout      tokens.LockoutPolicy
+	// MFARequiredRoles must enroll TOTP before they get an access token.
+	MFARequiredRoles []string
+	TOTPIssuer       string
+	// Mailer sends verification and password reset links pointing to PublicURL.
+	// Without it no emails are sent.
+	Mailer                   mailer.Mailer
+	PublicURL                string
+	RequireEmailVerification bool
+	EmailVerificationTTL     time.Duration
+	PasswordResetTTL         time.Duration
+	// OIDC enables login through the company SSO; nil disables the /oidc endpoints.
+	OIDC *oidc.Provider
+	// DisableDummyLogin turns /dummyLogin off. When enabled it only answers loopback
+	// clients and networks from DummyLoginAllowlist.
+	DisableDummyLogin   bool
+	DummyLoginAllowlist []*net.IPNet
+	// RateLimiter throttles requests per user, API key or client IP; nil disables it.
+	RateLimiter *ratelimit.Limiter
+	// IdempotencyTTL is how long responses to requests with an Idempotency-Key are replayed.
+	IdempotencyTTL time.Duration
+	// SLO tracks request outcomes for GET /slo; nil disables the report.
+	SLO *slo.Tracker
+
+	// cities caches the city of each PVZ for the KPI metrics; a PVZ never moves.
+	cities sync.Map
+	// mails counts the emails being sent off the request path.
+	mails sync.WaitGroup
 }
 
 func NewHttpHandlers(repo interfaces.Repository) *HttpHandlers {
 	return &HttpHandlers{Data: repo}
 }
 
+// data is the repository bound to the request context.
+func (h *HttpHandlers) data(ctx context.Context) interfaces.Repository {
+	return h.Data.WithContext(ctx)
+}
+
 func (h *HttpHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	observeHTTP(w, r, h.SLO, h.serve)
+}
+
+func (h *HttpHandlers) serve(w http.ResponseWriter, r *http.Request) {
+	if h.RateLimiter != nil {
+		var limited bool
+		if r, limited = h.rateLimit(w, r); limited {
+			return
+		}
+	}
+	if r.Header.Get(idempotencyKeyHeader) != "" && r.Method != http.MethodGet {
+		h.idempotent(w, r, h.route)
+		return
+	}
+
+	h.route(w, r)
+}
+
+func (h *HttpHandlers) route(w http.ResponseWriter, r *http.Request) {
 	path := r.URL.Path
 	switch {
 	case path == "/dummyLogin" && r.Method == http.MethodPost:
@@ -33,26 +100,128 @@ func (h *HttpHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	case path == "/login" && r.Method == http.MethodPost:
 		h.Login(w, r)
 
+	case path == "/email/verify" && r.Method == http.MethodPost:
+		h.VerifyEmail(w, r)
+
+	case path == "/email/verify/resend" && r.Method == http.MethodPost:
+		h.ResendVerification(w, r)
+
+	case path == "/password/reset/request" && r.Method == http.MethodPost:
+		h.RequestPasswordReset(w, r)
+
+	case path == "/password/reset/confirm" && r.Method == http.MethodPost:
+		h.ConfirmPasswordReset(w, r)
+
+	case path == "/oidc/login" && r.Method == http.MethodGet && h.OIDC != nil:
+		h.OIDCLogin(w, r)
+
+	case path == "/oidc/callback" && r.Method == http.MethodGet && h.OIDC != nil:
+		h.OIDCCallback(w, r)
+
+	case path == "/oidc/token" && r.Method == http.MethodPost && h.OIDC != nil:
+		h.OIDCToken(w, r)
+
+	case path == "/login/2fa" && r.Method == http.MethodPost:
+		h.LoginSecondFactor(w, r)
+
+	case path == "/2fa/enroll" && r.Method == http.MethodPost:
+		tokens.PurposeMiddleware(h.EnrollTOTP, tokens.PurposeAccess, tokens.PurposeMFAEnrollment)(w, r)
+
+	case path == "/2fa/activate" && r.Method == http.MethodPost:
+		tokens.PurposeMiddleware(h.ActivateTOTP, tokens.PurposeAccess, tokens.PurposeMFAEnrollment)(w, r)
+
 	case path == "/pvz":
 		if r.Method == http.MethodPost {
-			tokens.AuthMiddleware(h.CreatePVZ, "moderator")(w, r)
+			tokens.PermissionMiddleware(h.CreatePVZ, tokens.PermPVZCreate)(w, r)
 		} else if r.Method == http.MethodGet {
-			tokens.AuthMiddleware(h.ListPVZ, "moderator", "employee")(w, r)
+			tokens.PermissionMiddleware(h.ListPVZ, tokens.PermPVZRead)(w, r)
 		} else {
 			http.Error(w, `{"message":"method not allowed"}`, http.StatusMethodNotAllowed)
 		}
 
+	case path == "/users" && r.Method == http.MethodGet:
+		tokens.PermissionMiddleware(h.ListUsers, tokens.PermUserManage)(w, r)
+
+	case strings.HasPrefix(path, "/users/") && r.Method == http.MethodPost:
+		if strings.HasSuffix(path, "/2fa/reset") {
+			tokens.PermissionMiddleware(h.ResetTOTP, tokens.PermUserManage)(w, r)
+		} else if strings.HasSuffix(path, "/unlock") {
+			tokens.PermissionMiddleware(h.UnlockUser, tokens.PermUserManage)(w, r)
+		} else if strings.HasSuffix(path, "/deactivate") {
+			tokens.PermissionMiddleware(h.DeactivateUser, tokens.PermUserManage)(w, r)
+		} else if strings.HasSuffix(path, "/reactivate") {
+			tokens.PermissionMiddleware(h.ReactivateUser, tokens.PermUserManage)(w, r)
+		} else if strings.HasSuffix(path, "/role") {
+			tokens.PermissionMiddleware(h.ChangeUserRole, tokens.PermUserManage)(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+
+	case path == "/invites" && r.Method == http.MethodPost:
+		tokens.PermissionMiddleware(h.CreateInvite, tokens.PermUserManage)(w, r)
+
+	case path == "/api_keys":
+		if r.Method == http.MethodPost {
+			tokens.PermissionMiddleware(h.CreateAPIKey, tokens.PermAPIKeyManage)(w, r)
+		} else if r.Method == http.MethodGet {
+			tokens.PermissionMiddleware(h.ListAPIKeys, tokens.PermAPIKeyManage)(w, r)
+		} else {
+			http.Error(w, `{"message":"method not allowed"}`, http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(path, "/api_keys/") && r.Method == http.MethodDelete:
+		tokens.PermissionMiddleware(h.RevokeAPIKey, tokens.PermAPIKeyManage)(w, r)
+
+	case path == "/roles" && r.Method == http.MethodGet:
+		tokens.PermissionMiddleware(h.ListRoles, tokens.PermRoleManage)(w, r)
+
+	case strings.HasPrefix(path, "/roles/") && r.Method == http.MethodPut:
+		tokens.PermissionMiddleware(h.SaveRole, tokens.PermRoleManage)(w, r)
+
+	case path == "/assignments":
+		if r.Method == http.MethodPost {
+			tokens.PermissionMiddleware(h.AssignEmployee, tokens.PermAssignmentManage)(w, r)
+		} else if r.Method == http.MethodGet {
+			tokens.PermissionMiddleware(h.ListAssignments, tokens.PermAssignmentManage)(w, r)
+		} else {
+			http.Error(w, `{"message":"method not allowed"}`, http.StatusMethodNotAllowed)
+		}
+
+	case strings.HasPrefix(path, "/assignments/") && r.Method == http.MethodDelete:
+		tokens.PermissionMiddleware(h.RevokeAssignment, tokens.PermAssignmentManage)(w, r)
+
+	case path == "/slo" && r.Method == http.MethodGet && h.SLO != nil:
+		tokens.PermissionMiddleware(h.SLOReport, tokens.PermAuditRead)(w, r)
+
 	case path == "/receptions" && r.Method == http.MethodPost:
-		tokens.AuthMiddleware(h.CreateReception, "employee")(w, r)
+		tokens.PermissionMiddleware(h.CreateReception, tokens.PermReceptionCreate)(w, r)
 
 	case path == "/products" && r.Method == http.MethodPost:
-		tokens.AuthMiddleware(h.AddProduct, "employee")(w, r)
+		tokens.PermissionMiddleware(h.AddProduct, tokens.PermProductAdd)(w, r)
 
 	case strings.HasPrefix(path, "/pvz/"):
 		if strings.HasSuffix(path, "/delete_last_product") {
-			tokens.AuthMiddleware(h.DeleteLastProduct, "employee")(w, r)
+			tokens.PermissionMiddleware(h.DeleteLastProduct, tokens.PermProductDelete)(w, r)
 		} else if strings.HasSuffix(path, "/close_last_reception") {
-			tokens.AuthMiddleware(h.CloseLastReception, "employee")(w, r)
+			tokens.PermissionMiddleware(h.CloseLastReception, tokens.PermReceptionClose)(w, r)
+		} else if strings.HasSuffix(path, "/force_close_reception") && r.Method == http.MethodPost {
+			tokens.PermissionMiddleware(h.ForceCloseReception, tokens.PermReceptionForceClose)(w, r)
+		} else if strings.HasSuffix(path, "/reopen_last_reception") && r.Method == http.MethodPost {
+			tokens.PermissionMiddleware(h.ReopenLastReception, tokens.PermReceptionReopen)(w, r)
+		} else if strings.HasSuffix(path, "/reception_events") && r.Method == http.MethodGet {
+			tokens.PermissionMiddleware(h.ReceptionEvents, tokens.PermAuditRead)(w, r)
+		} else if strings.HasSuffix(path, "/reception_timeout") && r.Method == http.MethodPost {
+			tokens.PermissionMiddleware(h.SetReceptionTimeout, tokens.PermPVZConfigure)(w, r)
+		} else if strings.HasSuffix(path, "/manifest") {
+			if r.Method == http.MethodPost {
+				tokens.PermissionMiddleware(h.UploadManifest, tokens.PermManifestUpload)(w, r)
+			} else if r.Method == http.MethodGet {
+				tokens.PermissionMiddleware(h.ManifestReport, tokens.PermManifestRead)(w, r)
+			} else {
+				http.Error(w, `{"message":"method not allowed"}`, http.StatusMethodNotAllowed)
+			}
+		} else if strings.Count(path, "/") == 2 && r.Method == http.MethodGet {
+			tokens.PermissionMiddleware(h.GetPVZ, tokens.PermPVZRead)(w, r)
 		} else {
 			http.NotFound(w, r)
 		}
@@ -69,12 +238,22 @@ type dummyLoginReq struct {
 }
 
 func (h *HttpHandlers) DummyLogin(w http.ResponseWriter, r *http.Request) {
+	if h.DisableDummyLogin {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.dummyLoginAllowed(r) {
+		http.Error(w, `{"message":"dummyLogin is not available from this address"}`, http.StatusForbidden)
+		return
+	}
+
 	var req dummyLoginReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Role != "employee" && req.Role != "moderator") {
+	// dummy tokens stay limited to the roles of the original API, never admin
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Role != tokens.RoleEmployee && req.Role != tokens.RoleModerator) {
 		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
 		return
 	}
-	token, err := tokens.CreateToken(uuid.NewString(), req.Role)
+	token, err := tokens.CreateDummyToken(uuid.NewString(), req.Role)
 	if err != nil {
 		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
 		return
@@ -82,26 +261,63 @@ func (h *HttpHandlers) DummyLogin(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(token)
 }
 
+// dummyLoginAllowed checks the peer address only; forwarded headers can be spoofed.
+func (h *HttpHandlers) dummyLoginAllowed(r *http.Request) bool {
+	ip := net.ParseIP(clientIP(r))
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, network := range h.DummyLoginAllowlist {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // ----------
 
 type registerReq struct {
-	Email    string `json:"email"`
-	Password string `json:"password"`
-	Role     string `json:"role"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	Role        string `json:"role"`
+	InviteToken string `json:"inviteToken"`
 }
 
+// Register lets anyone sign up as an employee. Any other role requires an invite
+// issued by a user manager; the role then comes from the invite.
 func (h *HttpHandlers) Register(w http.ResponseWriter, r *http.Request) {
 	var req registerReq
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Role != "employee" && req.Role != "moderator") {
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || !validEmail(req.Email) || req.Password == "" {
 		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
 		return
 	}
 
-	err := h.Data.Register(req.Email, req.Password, req.Role)
-	if err != nil {
-		http.Error(w, `{"message":"cannot create user"}`, http.StatusBadRequest)
-		return
+	if req.InviteToken != "" {
+		err, role := h.data(r.Context()).RegisterWithInvite(req.Email, req.Password, tokens.HashOpaqueToken(req.InviteToken), time.Now())
+		if err != nil {
+			http.Error(w, `{"message":"invalid invite or cannot create user"}`, http.StatusBadRequest)
+			return
+		}
+		req.Role = role
+	} else {
+		if req.Role == "" {
+			req.Role = tokens.RoleEmployee
+		}
+		if req.Role != tokens.RoleEmployee {
+			http.Error(w, `{"message":"invite required for role"}`, http.StatusForbidden)
+			return
+		}
+		err := h.data(r.Context()).Register(req.Email, req.Password, req.Role)
+		if err != nil {
+			http.Error(w, `{"message":"cannot create user"}`, http.StatusBadRequest)
+			return
+		}
 	}
+	h.sendEmailToken(r.Context(), req.Email, domain.EmailTokenVerify)
 
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(map[string]string{"email": req.Email, "role": req.Role})
@@ -121,21 +337,316 @@ func (h *HttpHandlers) Login(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err, user := h.Data.Login(req.Email)
-	if err != nil {
-		http.Error(w, `{"message":"invalid credentials"}`, http.StatusUnauthorized)
+	accountKey, ipKey := "email:"+strings.ToLower(req.Email), "ip:"+clientIP(r)
+	if h.loginBlocked(r.Context(), w, accountKey, ipKey) {
 		return
 	}
-	if user.PasswordHash != req.Password {
+
+	err, user := h.data(r.Context()).Login(req.Email)
+	// users provisioned through SSO have no password and cannot log in locally
+	if err != nil || user.PasswordHash == "" || user.PasswordHash != req.Password {
+		h.loginFailed(r.Context(), accountKey, ipKey)
+		metrics.LoginFailures.WithLabelValues("bad_credentials").Inc()
 		http.Error(w, `{"message":"invalid credentials"}`, http.StatusUnauthorized)
 		return
 	}
-	token, _ := tokens.CreateToken(user.ID, user.Role)
+	if user.DeactivatedAt != nil {
+		metrics.LoginFailures.WithLabelValues("deactivated").Inc()
+		http.Error(w, `{"message":"user is deactivated"}`, http.StatusUnauthorized)
+		return
+	}
+	if h.RequireEmailVerification && !user.EmailVerified {
+		metrics.LoginFailures.WithLabelValues("unverified_email").Inc()
+		http.Error(w, `{"message":"email is not verified"}`, http.StatusForbidden)
+		return
+	}
+	h.loginSucceeded(r.Context(), accountKey)
+	if h.secondFactorStep(w, user) {
+		return
+	}
+	err, permissions := h.data(r.Context()).RolePermissions(user.Role)
+	if err != nil {
+		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
+		return
+	}
+	token, _ := tokens.CreateTokenWithPermissions(user.ID, user.Role, permissions)
 	json.NewEncoder(w).Encode(token)
 }
 
 // ----------
 
+func (h *HttpHandlers) ListUsers(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	err, users := h.data(r.Context()).ListUsers(r.URL.Query().Get("q"), r.URL.Query().Get("role"), limit, offset)
+	if err != nil {
+		http.Error(w, `{"message":"cannot list users"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(users)
+}
+
+func (h *HttpHandlers) DeactivateUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, false)
+}
+
+func (h *HttpHandlers) ReactivateUser(w http.ResponseWriter, r *http.Request) {
+	h.setUserActive(w, r, true)
+}
+
+func (h *HttpHandlers) setUserActive(w http.ResponseWriter, r *http.Request, active bool) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[2]
+	if id == userID(r) {
+		http.Error(w, `{"message":"cannot change own account"}`, http.StatusBadRequest)
+		return
+	}
+	if !h.canManageUser(w, r, id) {
+		return
+	}
+
+	err := h.data(r.Context()).SetUserActive(id, active, time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (h *HttpHandlers) UnlockUser(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[2]
+
+	err := h.data(r.Context()).UnlockUser(id)
+	if err != nil {
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+type changeRoleReq struct {
+	Role string `json:"role"`
+}
+
+func (h *HttpHandlers) ChangeUserRole(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[2]
+	if id == userID(r) {
+		http.Error(w, `{"message":"cannot change own account"}`, http.StatusBadRequest)
+		return
+	}
+
+	var req changeRoleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	if !h.canManageUser(w, r, id) || !h.canGrantRole(w, r, req.Role) {
+		return
+	}
+
+	err := h.data(r.Context()).ChangeUserRole(id, req.Role)
+	if err != nil {
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]string{"id": id, "role": req.Role})
+}
+
+type createInviteReq struct {
+	Email     string `json:"email"`
+	Role      string `json:"role"`
+	ExpiresIn string `json:"expiresIn"`
+}
+
+type createInviteResp struct {
+	Token string `json:"token"`
+	domain.Invite
+}
+
+func (h *HttpHandlers) CreateInvite(w http.ResponseWriter, r *http.Request) {
+	var req createInviteReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Role == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	expiresIn := 72 * time.Hour
+	if req.ExpiresIn != "" {
+		var err error
+		expiresIn, err = time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, `{"message":"bad expiresIn"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if !h.canGrantRole(w, r, req.Role) {
+		return
+	}
+
+	token, hash, err := tokens.NewOpaqueToken()
+	if err != nil {
+		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
+		return
+	}
+	inv := domain.Invite{
+		TokenHash: hash,
+		Email:     req.Email,
+		Role:      req.Role,
+		CreatedBy: userID(r),
+		ExpiresAt: time.Now().Add(expiresIn),
+	}
+	err = h.data(r.Context()).CreateInvite(&inv)
+	if err != nil {
+		http.Error(w, `{"message":"cannot create invite"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(createInviteResp{Token: token, Invite: inv})
+}
+
+// canGrantRole checks that the role exists and grants nothing beyond the caller's own
+// permissions, so user managers cannot escalate privileges. Writes the error otherwise.
+func (h *HttpHandlers) canGrantRole(w http.ResponseWriter, r *http.Request, role string) bool {
+	err, permissions := h.data(r.Context()).RolePermissions(role)
+	if err != nil {
+		http.Error(w, `{"message":"unknown role"}`, http.StatusBadRequest)
+		return false
+	}
+	if c := tokens.ClaimsFromContext(r.Context()); c == nil || !c.Covers(permissions) {
+		http.Error(w, `{"message":"cannot grant role with more permissions than your own"}`, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// canManageUser checks that the user holds no permission beyond the caller's own, so user
+// managers cannot act on more privileged accounts. Writes the error otherwise.
+func (h *HttpHandlers) canManageUser(w http.ResponseWriter, r *http.Request, id string) bool {
+	err, permissions := h.data(r.Context()).UserPermissions(id)
+	if err != nil {
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+		return false
+	}
+	if c := tokens.ClaimsFromContext(r.Context()); c == nil || !c.Covers(permissions) {
+		http.Error(w, `{"message":"cannot manage user with more permissions than your own"}`, http.StatusForbidden)
+		return false
+	}
+
+	return true
+}
+
+// ----------
+
+func (h *HttpHandlers) ListRoles(w http.ResponseWriter, r *http.Request) {
+	err, roles := h.data(r.Context()).ListRoles()
+	if err != nil {
+		http.Error(w, `{"message":"cannot list roles"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(roles)
+}
+
+type saveRoleReq struct {
+	Permissions []string `json:"permissions"`
+	Description string   `json:"description"`
+}
+
+func (h *HttpHandlers) SaveRole(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	name := parts[2]
+
+	var req saveRoleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || name == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	for _, perm := range req.Permissions {
+		if !tokens.IsKnownPermission(perm) {
+			http.Error(w, `{"message":"unknown permission"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	role := domain.Role{Name: name, Permissions: req.Permissions, Description: req.Description}
+	if role.Permissions == nil {
+		role.Permissions = []string{}
+	}
+	err := h.data(r.Context()).SaveRole(&role)
+	if err != nil {
+		http.Error(w, `{"message":"cannot save role"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(role)
+}
+
+// ----------
+
+type assignEmployeeReq struct {
+	UserID    string     `json:"userId"`
+	PVZID     string     `json:"pvzId"`
+	ValidFrom *time.Time `json:"validFrom"`
+	ValidTo   *time.Time `json:"validTo"`
+}
+
+func (h *HttpHandlers) AssignEmployee(w http.ResponseWriter, r *http.Request) {
+	var req assignEmployeeReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.UserID == "" || req.PVZID == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	a := domain.Assignment{
+		ID:        uuid.NewString(),
+		UserID:    req.UserID,
+		PVZID:     req.PVZID,
+		ValidFrom: time.Now(),
+		ValidTo:   req.ValidTo,
+		CreatedBy: userID(r),
+	}
+	if req.ValidFrom != nil {
+		a.ValidFrom = *req.ValidFrom
+	}
+	if a.ValidTo != nil && !a.ValidTo.After(a.ValidFrom) {
+		http.Error(w, `{"message":"validTo must be after validFrom"}`, http.StatusBadRequest)
+		return
+	}
+
+	err := h.data(r.Context()).AssignEmployee(&a)
+	if err != nil {
+		http.Error(w, `{"message":"cannot assign employee"}`, http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
+
+func (h *HttpHandlers) ListAssignments(w http.ResponseWriter, r *http.Request) {
+	limit, offset := pagination(r)
+	err, assignments := h.data(r.Context()).ListAssignments(r.URL.Query().Get("userId"), r.URL.Query().Get("pvzId"), limit, offset)
+	if err != nil {
+		http.Error(w, `{"message":"cannot list assignments"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(assignments)
+}
+
+func (h *HttpHandlers) RevokeAssignment(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[2]
+
+	err := h.data(r.Context()).RevokeAssignment(id, time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"cannot revoke assignment"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// ----------
+
 type createPVZReq struct {
 	City string `json:"city"`
 }
@@ -151,7 +662,7 @@ func (h *HttpHandlers) CreatePVZ(w http.ResponseWriter, r *http.Request) {
 
 	id := uuid.NewString()
 	regTime := time.Now()
-	err := h.Data.CreatePVZ(req.City, id, regTime)
+	err := h.data(r.Context()).CreatePVZ(req.City, id, regTime)
 
 	if err != nil {
 		http.Error(w, `{"message":"cannot create pvz"}`, http.StatusInternalServerError)
@@ -172,25 +683,60 @@ type PVZWithRecs struct {
 	Receptions []RecWithProds `json:"receptions"`
 }
 
-func (h *HttpHandlers) ListPVZ(w http.ResponseWriter, r *http.Request) {
-	startStr := r.URL.Query().Get("startDate")
-	endStr := r.URL.Query().Get("endDate")
-	limitStr := r.URL.Query().Get("limit")
-	offsetStr := r.URL.Query().Get("offset")
-	if limitStr == "" {
-		limitStr = "10"
+// authorizePVZ lets users with the pvz.any permission act on any PVZ and everyone else
+// only on the PVZs they are assigned to right now. Otherwise it writes 403 and returns false.
+func (h *HttpHandlers) authorizePVZ(w http.ResponseWriter, r *http.Request, pvzID string) bool {
+	tracing.SetPVZ(r.Context(), pvzID)
+	c := tokens.ClaimsFromContext(r.Context())
+	// API keys are limited by their own PVZ scope instead of assignments
+	if c != nil && c.APIKeyID != "" {
+		if !c.AllowsPVZ(pvzID) {
+			http.Error(w, `{"message":"pvz is outside of api key scope"}`, http.StatusForbidden)
+			return false
+		}
+		return true
+	}
+	if !h.EnforceAssignments || c == nil || c.Can(tokens.PermPVZAny) {
+		return true
+	}
+
+	err, assigned := h.data(r.Context()).IsAssigned(c.UserID, pvzID, time.Now())
+	if err != nil {
+		http.Error(w, `{"message":"cannot check assignment"}`, http.StatusInternalServerError)
+		return false
 	}
-	if offsetStr == "" {
-		offsetStr = "0"
+	if !assigned {
+		http.Error(w, `{"message":"pvz is not assigned to user"}`, http.StatusForbidden)
+		return false
 	}
-	limit, err := strconv.Atoi(limitStr)
+
+	return true
+}
+
+func userID(r *http.Request) string {
+	if c := tokens.ClaimsFromContext(r.Context()); c != nil {
+		return c.UserID
+	}
+	return ""
+}
+
+func pagination(r *http.Request) (limit, offset int) {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
 	if err != nil || limit < 1 {
 		limit = 10
 	}
-	offset, err := strconv.Atoi(offsetStr)
+	offset, err = strconv.Atoi(r.URL.Query().Get("offset"))
 	if err != nil || offset < 0 {
 		offset = 0
 	}
+
+	return limit, offset
+}
+
+func (h *HttpHandlers) ListPVZ(w http.ResponseWriter, r *http.Request) {
+	startStr := r.URL.Query().Get("startDate")
+	endStr := r.URL.Query().Get("endDate")
+	limit, offset := pagination(r)
 	if startStr == "" {
 		startStr = time.Now().Add(-24 * time.Hour).Format(time.RFC3339)
 	}
@@ -198,14 +744,41 @@ func (h *HttpHandlers) ListPVZ(w http.ResponseWriter, r *http.Request) {
 		endStr = time.Now().Format(time.RFC3339)
 	}
 
-	err, result := h.Data.ListPVZ(endStr, startStr, limit, offset)
+	err, result := h.data(r.Context()).ListPVZ(endStr, startStr, limit, offset)
 	if err != nil {
 		http.Error(w, fmt.Sprintf(`{"message":"db error: %v"}`, err), http.StatusInternalServerError)
 		return
 	}
+	if c := tokens.ClaimsFromContext(r.Context()); c != nil && len(c.PVZIDs) > 0 {
+		allowed := []domain.PVZ{}
+		for _, pvz := range *result {
+			if c.AllowsPVZ(pvz.ID) {
+				allowed = append(allowed, pvz)
+			}
+		}
+		result = &allowed
+	}
 	json.NewEncoder(w).Encode(result)
 }
 
+func (h *HttpHandlers) GetPVZ(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	err, pvz := h.data(r.Context()).GetPVZ(pvzId)
+	if err != nil {
+		http.Error(w, `{"message":"pvz not found"}`, http.StatusNotFound)
+		return
+	}
+	if notModified(w, r, pvz.Version) {
+		return
+	}
+	json.NewEncoder(w).Encode(pvz)
+}
+
 // ----------
 
 type createReceptionReq struct {
@@ -215,43 +788,63 @@ type createReceptionReq struct {
 func (h *HttpHandlers) CreateReception(w http.ResponseWriter, r *http.Request) {
 	var req createReceptionReq
 	json.NewDecoder(r.Body).Decode(&req)
+	if !h.authorizePVZ(w, r, req.PVZID) {
+		return
+	}
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
 
 	id := uuid.NewString()
 	dateTime := time.Now()
-	err, lastElem := h.Data.CreateReception(req.PVZID, id, dateTime)
+	err, lastElem, version := h.data(r.Context()).CreateReception(req.PVZID, id, dateTime, ifVersion)
 	if err != nil {
-		http.Error(w, `{"message":"cannot create reception"}`, http.StatusInternalServerError)
+		mutationFailed(w, err, "cannot create reception")
 		return
 	}
+	metrics.ReceptionsOpened.WithLabelValues(h.pvzCity(r.Context(), req.PVZID)).Inc()
 
+	w.Header().Set("ETag", etag(version))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(&lastElem)
 }
 
 // ----------
 
+var allowedTypes = map[string]bool{"электроника": true, "одежда": true, "обувь": true}
+
 type addProductReq struct {
-	Type  string `json:"type"`
-	PVZID string `json:"pvzId"`
+	Type    string `json:"type"`
+	Barcode string `json:"barcode"`
+	PVZID   string `json:"pvzId"`
 }
 
 func (h *HttpHandlers) AddProduct(w http.ResponseWriter, r *http.Request) {
 	var req addProductReq
 	json.NewDecoder(r.Body).Decode(&req)
-	var allowedTypes = map[string]bool{"электроника": true, "одежда": true, "обувь": true}
 	if !allowedTypes[req.Type] {
 		http.Error(w, `{"message":"bad type"}`, http.StatusBadRequest)
 		return
 	}
+	if !h.authorizePVZ(w, r, req.PVZID) {
+		return
+	}
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
 
 	id := uuid.NewString()
 	dateTime := time.Now()
-	err, lastElem := h.Data.AddProduct(id, dateTime, req.Type, req.PVZID)
+	err, lastElem, version := h.data(r.Context()).AddProduct(id, dateTime, req.Type, req.Barcode, req.PVZID, ifVersion)
 	if err != nil {
-		http.Error(w, `{"message":"cannot add product"}`, http.StatusInternalServerError)
+		mutationFailed(w, err, "cannot add product")
 		return
 	}
+	metrics.ProductsReceived.WithLabelValues(req.Type, h.pvzCity(r.Context(), req.PVZID)).Inc()
 
+	w.Header().Set("ETag", etag(version))
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(&lastElem)
 }
@@ -261,13 +854,22 @@ func (h *HttpHandlers) AddProduct(w http.ResponseWriter, r *http.Request) {
 func (h *HttpHandlers) DeleteLastProduct(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
 
-	err := h.Data.DeleteLastProduct(pvzId)
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
 
+	err, version := h.data(r.Context()).DeleteLastProduct(pvzId, ifVersion)
 	if err != nil {
-		http.Error(w, `{"message":"cannot delete"}`, http.StatusInternalServerError)
+		mutationFailed(w, err, "cannot delete")
 		return
 	}
+	metrics.ProductsDeleted.WithLabelValues(h.pvzCity(r.Context(), pvzId)).Inc()
+	w.Header().Set("ETag", etag(version))
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -276,11 +878,241 @@ func (h *HttpHandlers) DeleteLastProduct(w http.ResponseWriter, r *http.Request)
 func (h *HttpHandlers) CloseLastReception(w http.ResponseWriter, r *http.Request) {
 	parts := strings.Split(r.URL.Path, "/")
 	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	err, receptionID, version := h.data(r.Context()).CloseLastReception(pvzId, time.Now(), ifVersion)
+	if err != nil {
+		mutationFailed(w, err, "cannot delete")
+		return
+	}
+	h.receptionClosed(r.Context(), pvzId, metrics.ClosedByEmployee)
+
+	err, report := h.data(r.Context()).ReconcileManifest(pvzId, receptionID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reconcile manifest", "pvz_id", pvzId, "reception_id", receptionID, "err", err)
+	}
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusOK)
+	if report != nil {
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// ----------
+
+type receptionOverrideReq struct {
+	Reason string `json:"reason"`
+}
+
+type forceCloseResp struct {
+	Event  *domain.ReceptionEvent    `json:"event"`
+	Report *domain.DiscrepancyReport `json:"report,omitempty"`
+}
+
+func (h *HttpHandlers) ForceCloseReception(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	var req receptionOverrideReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, `{"message":"reason is required"}`, http.StatusBadRequest)
+		return
+	}
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	actor := userID(r)
+	err, event, version := h.data(r.Context()).ForceCloseReception(pvzId, time.Now(), req.Reason, actor, ifVersion)
+	if err != nil {
+		mutationFailed(w, err, "cannot close reception")
+		return
+	}
+	h.receptionClosed(r.Context(), pvzId, metrics.ClosedByForce)
+
+	err, report := h.data(r.Context()).ReconcileManifest(pvzId, event.ReceptionID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "reconcile manifest", "pvz_id", pvzId, "reception_id", event.ReceptionID, "err", err)
+	}
+	w.Header().Set("ETag", etag(version))
+	json.NewEncoder(w).Encode(forceCloseResp{Event: event, Report: report})
+}
+
+func (h *HttpHandlers) ReopenLastReception(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	var req receptionOverrideReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		http.Error(w, `{"message":"reason is required"}`, http.StatusBadRequest)
+		return
+	}
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	actor := userID(r)
+	err, event, version := h.data(r.Context()).ReopenLastReception(pvzId, time.Now(), req.Reason, actor, ifVersion)
+	if err != nil {
+		mutationFailed(w, err, "cannot reopen reception")
+		return
+	}
+	w.Header().Set("ETag", etag(version))
+	json.NewEncoder(w).Encode(event)
+}
+
+func (h *HttpHandlers) ReceptionEvents(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+	limit, offset := pagination(r)
+
+	// the version is read first: events never lag behind the ETag served with them
+	err, version := h.data(r.Context()).PVZVersion(pvzId)
+	if err != nil {
+		http.Error(w, `{"message":"cannot list events"}`, http.StatusInternalServerError)
+		return
+	}
+	if notModified(w, r, version) {
+		return
+	}
+
+	err, events := h.data(r.Context()).ReceptionEvents(pvzId, limit, offset)
+	if err != nil {
+		http.Error(w, `{"message":"cannot list events"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(events)
+}
+
+// ----------
+
+type receptionTimeoutReq struct {
+	Timeout string `json:"timeout"`
+}
+
+func (h *HttpHandlers) SetReceptionTimeout(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	var req receptionTimeoutReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	var timeout time.Duration
+	if req.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(req.Timeout)
+		if err != nil || timeout < 0 {
+			http.Error(w, `{"message":"bad timeout"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
 
-	err := h.Data.CloseLastReception(pvzId, time.Now())
+	err, version := h.data(r.Context()).SetReceptionTimeout(pvzId, timeout, ifVersion)
 	if err != nil {
-		http.Error(w, `{"message":"cannot delete"}`, http.StatusInternalServerError)
+		mutationFailed(w, err, "cannot set timeout")
 		return
 	}
+	w.Header().Set("ETag", etag(version))
 	w.WriteHeader(http.StatusOK)
 }
+
+// ----------
+
+type uploadManifestReq struct {
+	Items []domain.ManifestItem `json:"items"`
+}
+
+func (h *HttpHandlers) UploadManifest(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	var req uploadManifestReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Items) == 0 {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	for _, item := range req.Items {
+		if item.Barcode == "" || !allowedTypes[item.Type] {
+			http.Error(w, `{"message":"bad manifest item"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ifVersion, ok := ifMatch(w, r)
+	if !ok {
+		return
+	}
+
+	id := uuid.NewString()
+	uploadedAt := time.Now()
+	err, version := h.data(r.Context()).UploadManifest(pvzId, id, req.Items, uploadedAt, ifVersion)
+	if err != nil {
+		mutationFailed(w, err, "cannot upload manifest")
+		return
+	}
+
+	w.Header().Set("ETag", etag(version))
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(domain.Manifest{ID: id, PVZID: pvzId, UploadedAt: uploadedAt, Items: req.Items})
+}
+
+// ----------
+
+func (h *HttpHandlers) ManifestReport(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	pvzId := parts[2]
+	if !h.authorizePVZ(w, r, pvzId) {
+		return
+	}
+
+	err, version := h.data(r.Context()).PVZVersion(pvzId)
+	if err != nil {
+		http.Error(w, `{"message":"cannot build report"}`, http.StatusInternalServerError)
+		return
+	}
+	if notModified(w, r, version) {
+		return
+	}
+
+	err, report := h.data(r.Context()).ManifestReport(pvzId)
+	if err != nil {
+		http.Error(w, `{"message":"cannot build report"}`, http.StatusInternalServerError)
+		return
+	}
+	if report == nil {
+		http.Error(w, `{"message":"no pending manifest"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(report)
+}
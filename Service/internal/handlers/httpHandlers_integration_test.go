@@ -2,42 +2,277 @@ package handlers
 
 import (
 	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/mailer"
+	"AvitoPVZService/Service/internal/oidc"
+	"AvitoPVZService/Service/internal/oidc/oidctest"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
 	"AvitoPVZService/Service/internal/tokens"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 )
 
 type memoryRepo struct {
-	pvzs []domain.PVZ
+	pvzs     []domain.PVZ
+	failures map[string]int
+	locks    map[string]time.Time
+	totp     domain.TOTP
+
+	password      string
+	emailVerified bool
+	emailTokens   map[string]string
+	identities    map[string]*domain.User
+	idempotency   map[string]*domain.IdempotencyRecord
+}
+
+func (m *memoryRepo) WithContext(ctx context.Context) interfaces.Repository {
+	return m
 }
 
 func (m *memoryRepo) Register(email, password, role string) error {
 	return nil
 }
 func (m *memoryRepo) Login(email string) (error, *domain.User) {
-	return nil, &domain.User{ID: "test-user", PasswordHash: "pass", Role: "moderator"}
+	password := m.password
+	if password == "" {
+		password = "pass"
+	}
+	return nil, &domain.User{ID: "test-user", PasswordHash: password, Role: "moderator",
+		TOTPEnabled: m.totp.Enabled, EmailVerified: m.emailVerified}
 }
-func (m *memoryRepo) CreatePVZ(city, id string, regTime time.Time) error {
-	m.pvzs = append(m.pvzs, domain.PVZ{ID: id, City: city, RegistrationDate: regTime})
+func (m *memoryRepo) ProvisionExternalUser(issuer, subject, email, role string, at time.Time) (error, *domain.User) {
+	if m.identities == nil {
+		m.identities = map[string]*domain.User{}
+	}
+	u, ok := m.identities[issuer+"|"+subject]
+	if !ok {
+		u = &domain.User{ID: "sso-" + subject, Email: email, RegistrationDate: at, EmailVerified: true}
+		m.identities[issuer+"|"+subject] = u
+	}
+	u.Role = role
+	return nil, u
+}
+func (m *memoryRepo) CreateEmailToken(email, purpose, tokenHash string, expiresAt time.Time) (error, bool) {
+	for _, u := range m.identities {
+		if u.Email == email && purpose == domain.EmailTokenReset {
+			return nil, false
+		}
+	}
+	if m.emailTokens == nil {
+		m.emailTokens = map[string]string{}
+	}
+	m.emailTokens[tokenHash] = purpose
+	return nil, true
+}
+func (m *memoryRepo) useEmailToken(tokenHash, purpose string) bool {
+	if m.emailTokens[tokenHash] != purpose {
+		return false
+	}
+	delete(m.emailTokens, tokenHash)
+	return true
+}
+func (m *memoryRepo) VerifyEmail(tokenHash string, at time.Time) (error, bool) {
+	if !m.useEmailToken(tokenHash, domain.EmailTokenVerify) {
+		return nil, false
+	}
+	m.emailVerified = true
+	return nil, true
+}
+func (m *memoryRepo) ResetPassword(tokenHash, password string, at time.Time) (error, bool) {
+	if !m.useEmailToken(tokenHash, domain.EmailTokenReset) {
+		return nil, false
+	}
+	m.password = password
+	m.emailVerified = true
+	return nil, true
+}
+func (m *memoryRepo) GetTOTP(userID string) (error, *domain.TOTP) {
+	totp := m.totp
+	return nil, &totp
+}
+func (m *memoryRepo) SetTOTPSecret(userID, secret string) error {
+	if m.totp.Enabled {
+		return errors.New("2fa already enabled")
+	}
+	m.totp.Secret = secret
 	return nil
 }
-func (m *memoryRepo) CreateReception(PVZID, id string, dateTime time.Time) (error, *json.RawMessage) {
+func (m *memoryRepo) EnableTOTP(userID string, recoveryHashes []string) error {
+	m.totp.Enabled = true
+	return nil
+}
+func (m *memoryRepo) UseTOTPStep(userID string, step int64) (error, bool) {
+	if step <= m.totp.LastStep {
+		return nil, false
+	}
+	m.totp.LastStep = step
+	return nil, true
+}
+func (m *memoryRepo) UseRecoveryCode(userID, codeHash string, at time.Time) (error, bool) {
+	return nil, false
+}
+func (m *memoryRepo) ResetTOTP(userID string) error {
+	m.totp = domain.TOTP{}
+	return nil
+}
+func (m *memoryRepo) RolePermissions(role string) (error, []string) {
+	return nil, tokens.DefaultRolePermissions[role]
+}
+func (m *memoryRepo) ListRoles() (error, []domain.Role) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) SaveRole(role *domain.Role) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) AssignEmployee(a *domain.Assignment) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) RevokeAssignment(id string, at time.Time) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) ListAssignments(userID, PVZID string, limit, offset int) (error, []domain.Assignment) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) IsAssigned(userID, PVZID string, at time.Time) (error, bool) {
+	return errors.New("not implemented"), false
+}
+func (m *memoryRepo) LoginBlockedUntil(keys []string, now time.Time) (error, time.Time) {
+	var until time.Time
+	for _, k := range keys {
+		if m.locks[k].After(until) {
+			until = m.locks[k]
+		}
+	}
+	return nil, until
+}
+func (m *memoryRepo) RecordLoginFailure(key string, now time.Time, window time.Duration) (error, int) {
+	if m.failures == nil {
+		m.failures = map[string]int{}
+	}
+	m.failures[key]++
+	return nil, m.failures[key]
+}
+func (m *memoryRepo) LockLogin(key string, until time.Time) error {
+	if m.locks == nil {
+		m.locks = map[string]time.Time{}
+	}
+	m.locks[key] = until
+	return nil
+}
+func (m *memoryRepo) ResetLoginFailures(key string) error {
+	delete(m.failures, key)
+	delete(m.locks, key)
+	return nil
+}
+func (m *memoryRepo) UnlockUser(id string) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) RegisterWithInvite(email, password, inviteHash string, at time.Time) (error, string) {
+	return errors.New("not implemented"), ""
+}
+func (m *memoryRepo) CreateInvite(inv *domain.Invite) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) ListUsers(search, role string, limit, offset int) (error, []domain.User) {
 	return errors.New("not implemented"), nil
 }
-func (m *memoryRepo) AddProduct(id string, dateTime time.Time, prodType, PVZID string) (error, *json.RawMessage) {
+func (m *memoryRepo) SetUserActive(id string, active bool, at time.Time) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) ChangeUserRole(id, role string) error {
+	return errors.New("not implemented")
+}
+func (m *memoryRepo) IsUserDeactivated(id string) (error, bool) {
+	return nil, false
+}
+func (m *memoryRepo) UserPermissions(id string) (error, []string) {
 	return errors.New("not implemented"), nil
 }
-func (m *memoryRepo) DeleteLastProduct(PVZID string) error {
+func (m *memoryRepo) CreateAPIKey(k *domain.APIKey) error {
 	return errors.New("not implemented")
 }
-func (m *memoryRepo) CloseLastReception(PVZID string, closedAt time.Time) error {
+func (m *memoryRepo) ListAPIKeys(limit, offset int) (error, []domain.APIKey) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) RevokeAPIKey(id string, at time.Time) error {
 	return errors.New("not implemented")
 }
+func (m *memoryRepo) UseAPIKey(keyHash string, at time.Time) (error, *domain.APIKey) {
+	return nil, nil
+}
+func (m *memoryRepo) StartIdempotentRequest(subject, key, requestHash string, now, expiresAt time.Time) (error, *domain.IdempotencyRecord) {
+	if m.idempotency == nil {
+		m.idempotency = map[string]*domain.IdempotencyRecord{}
+	}
+	if rec, ok := m.idempotency[subject+"|"+key]; ok {
+		return nil, rec
+	}
+	m.idempotency[subject+"|"+key] = &domain.IdempotencyRecord{RequestHash: requestHash}
+	return nil, nil
+}
+func (m *memoryRepo) CompleteIdempotentRequest(subject, key string, record *domain.IdempotencyRecord) error {
+	m.idempotency[subject+"|"+key] = record
+	return nil
+}
+func (m *memoryRepo) ReleaseIdempotentRequest(subject, key string) error {
+	delete(m.idempotency, subject+"|"+key)
+	return nil
+}
+func (m *memoryRepo) DeleteExpiredIdempotencyKeys(now time.Time) (error, int64) {
+	return nil, 0
+}
+func (m *memoryRepo) CreatePVZ(city, id string, regTime time.Time) error {
+	m.pvzs = append(m.pvzs, domain.PVZ{ID: id, City: city, RegistrationDate: regTime})
+	return nil
+}
+func (m *memoryRepo) GetPVZ(PVZID string) (error, *domain.PVZ) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) PVZVersion(PVZID string) (error, int64) {
+	return errors.New("not implemented"), 0
+}
+func (m *memoryRepo) CreateReception(PVZID, id string, dateTime time.Time, ifVersion int64) (error, *json.RawMessage, int64) {
+	return errors.New("not implemented"), nil, 0
+}
+func (m *memoryRepo) AddProduct(id string, dateTime time.Time, prodType, barcode, PVZID string, ifVersion int64) (error, *json.RawMessage, int64) {
+	return errors.New("not implemented"), nil, 0
+}
+func (m *memoryRepo) DeleteLastProduct(PVZID string, ifVersion int64) (error, int64) {
+	return errors.New("not implemented"), 0
+}
+func (m *memoryRepo) CloseLastReception(PVZID string, closedAt time.Time, ifVersion int64) (error, string, int64) {
+	return errors.New("not implemented"), "", 0
+}
+func (m *memoryRepo) ForceCloseReception(PVZID string, closedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	return errors.New("not implemented"), nil, 0
+}
+func (m *memoryRepo) ReopenLastReception(PVZID string, reopenedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	return errors.New("not implemented"), nil, 0
+}
+func (m *memoryRepo) ReceptionEvents(PVZID string, limit, offset int) (error, []domain.ReceptionEvent) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) CloseStaleReceptions(now time.Time, idleTimeout time.Duration) (error, []domain.ReceptionEvent) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) SetReceptionTimeout(PVZID string, timeout time.Duration, ifVersion int64) (error, int64) {
+	return errors.New("not implemented"), 0
+}
+func (m *memoryRepo) UploadManifest(PVZID, id string, items []domain.ManifestItem, uploadedAt time.Time, ifVersion int64) (error, int64) {
+	return errors.New("not implemented"), 0
+}
+func (m *memoryRepo) ManifestReport(PVZID string) (error, *domain.DiscrepancyReport) {
+	return errors.New("not implemented"), nil
+}
+func (m *memoryRepo) ReconcileManifest(PVZID, receptionID string) (error, *domain.DiscrepancyReport) {
+	return errors.New("not implemented"), nil
+}
 func (m *memoryRepo) ListPVZ(endStr, startStr string, limit, offset int) (error, *[]domain.PVZ) {
 	return nil, &m.pvzs
 }
@@ -101,3 +336,310 @@ func TestCreateAndListPVZ(t *testing.T) {
 		t.Errorf("expected 1 pvz, got %d", len(list))
 	}
 }
+
+func TestLogin_LockoutAfterFailures(t *testing.T) {
+	repo := &memoryRepo{}
+	h := NewHttpHandlers(repo)
+	h.AccountLockout = tokens.LockoutPolicy{MaxFailures: 3, Window: time.Minute, Lockout: time.Minute}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	login := func(password string) *http.Response {
+		body, _ := json.Marshal(map[string]string{"email": "user@example.com", "password": password})
+		resp, err := http.Post(server.URL+"/login", "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i := 0; i < 3; i++ {
+		if resp := login("wrong"); resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("attempt %d: expected 401, got %d", i+1, resp.StatusCode)
+		}
+	}
+
+	resp := login("pass")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 for locked account, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+}
+
+func TestLogin_TOTPEnrollmentAndSecondFactor(t *testing.T) {
+	repo := &memoryRepo{}
+	h := NewHttpHandlers(repo)
+	h.MFARequiredRoles = []string{"moderator"}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	post := func(path, token string, payload interface{}, out interface{}) int {
+		body, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, server.URL+path, bytes.NewReader(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+		defer resp.Body.Close()
+		if out != nil {
+			json.NewDecoder(resp.Body).Decode(out)
+		}
+		return resp.StatusCode
+	}
+	credentials := map[string]string{"email": "mod@example.com", "password": "pass"}
+
+	var login mfaResp
+	post("/login", "", credentials, &login)
+	if !login.MFAEnrollmentRequired || login.MFAToken == "" {
+		t.Fatalf("expected enrollment requirement, got %+v", login)
+	}
+	if code := post("/pvz", login.MFAToken, map[string]string{"city": "Москва"}, nil); code != http.StatusUnauthorized {
+		t.Fatalf("enrollment token must not grant access, got %d", code)
+	}
+
+	var enroll enrollTOTPResp
+	post("/2fa/enroll", login.MFAToken, nil, &enroll)
+	if enroll.Secret == "" {
+		t.Fatal("expected secret")
+	}
+	now := time.Now()
+	code, _ := tokens.TOTPCode(enroll.Secret, tokens.TOTPStep(now))
+	var activated activateTOTPResp
+	if status := post("/2fa/activate", login.MFAToken, map[string]string{"code": code}, &activated); status != http.StatusOK {
+		t.Fatalf("expected 200 on activate, got %d", status)
+	}
+	if len(activated.RecoveryCodes) != recoveryCodesCount {
+		t.Fatalf("expected %d recovery codes, got %d", recoveryCodesCount, len(activated.RecoveryCodes))
+	}
+
+	login = mfaResp{}
+	post("/login", "", credentials, &login)
+	if !login.MFARequired {
+		t.Fatalf("expected second factor requirement, got %+v", login)
+	}
+
+	// The step used for activation is burnt, so the next one is needed.
+	next, _ := tokens.TOTPCode(enroll.Secret, tokens.TOTPStep(now)+1)
+	var token string
+	if status := post("/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": next}, &token); status != http.StatusOK {
+		t.Fatalf("expected 200 on second factor, got %d", status)
+	}
+	if status := post("/login/2fa", "", map[string]string{"mfaToken": login.MFAToken, "code": next}, nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected replayed code to be rejected, got %d", status)
+	}
+	if status := post("/pvz", token, map[string]string{"city": "Москва"}, nil); status != http.StatusCreated {
+		t.Fatalf("expected access token to work, got %d", status)
+	}
+}
+
+type captureMailer struct {
+	messages []mailer.Message
+}
+
+func (c *captureMailer) Send(ctx context.Context, msg mailer.Message) error {
+	c.messages = append(c.messages, msg)
+	return nil
+}
+
+// lastToken extracts the code from the last sent message.
+func (c *captureMailer) lastToken(t *testing.T) string {
+	if len(c.messages) == 0 {
+		t.Fatal("no mail sent")
+	}
+	body := c.messages[len(c.messages)-1].Body
+	i := strings.Index(body, "Код: ")
+	if i < 0 {
+		t.Fatalf("no code in mail: %s", body)
+	}
+	return strings.Fields(body[i+len("Код: "):])[0]
+}
+
+func TestEmailVerificationAndPasswordReset(t *testing.T) {
+	repo := &memoryRepo{}
+	mails := &captureMailer{}
+	h := NewHttpHandlers(repo)
+	h.Mailer = mails
+	h.RequireEmailVerification = true
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	post := func(path string, payload interface{}) int {
+		body, _ := json.Marshal(payload)
+		resp, err := http.Post(server.URL+path, "application/json", bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+		resp.Body.Close()
+		// mails go out in the background
+		h.WaitMails(context.Background())
+		return resp.StatusCode
+	}
+	email := "user@example.com"
+
+	if code := post("/login", map[string]string{"email": email, "password": "pass"}); code != http.StatusForbidden {
+		t.Fatalf("expected 403 for unverified email, got %d", code)
+	}
+	if code := post("/email/verify/resend", map[string]string{"email": email}); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	if code := post("/email/verify", map[string]string{"token": mails.lastToken(t)}); code != http.StatusOK {
+		t.Fatalf("expected 200 on verify, got %d", code)
+	}
+	if code := post("/login", map[string]string{"email": email, "password": "pass"}); code != http.StatusOK {
+		t.Fatalf("expected 200 after verification, got %d", code)
+	}
+
+	if code := post("/password/reset/request", map[string]string{"email": email}); code != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", code)
+	}
+	token := mails.lastToken(t)
+	if code := post("/password/reset/confirm", map[string]string{"token": token, "password": "new"}); code != http.StatusOK {
+		t.Fatalf("expected 200 on reset, got %d", code)
+	}
+	if code := post("/password/reset/confirm", map[string]string{"token": token, "password": "other"}); code != http.StatusBadRequest {
+		t.Fatalf("expected used token to be rejected, got %d", code)
+	}
+	if code := post("/login", map[string]string{"email": email, "password": "new"}); code != http.StatusOK {
+		t.Fatalf("expected 200 with new password, got %d", code)
+	}
+}
+
+func TestOIDCLogin_ProvisionsUserWithMappedRole(t *testing.T) {
+	iss, err := oidctest.NewIssuer("pvz")
+	if err != nil {
+		t.Fatalf("NewIssuer error: %v", err)
+	}
+	defer iss.Close()
+
+	repo := &memoryRepo{}
+	mails := &captureMailer{}
+	h := NewHttpHandlers(repo)
+	h.Mailer = mails
+	server := httptest.NewServer(h)
+	defer server.Close()
+	h.OIDC, err = oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:      iss.URL,
+		ClientID:    "pvz",
+		RedirectURL: server.URL + "/oidc/callback",
+		Roles:       []oidc.GroupRole{{Role: "employee", Groups: []string{"pvz-staff"}}},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider error: %v", err)
+	}
+
+	// authorization code flow: the browser comes back with the state cookie and the code
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(server.URL + "/oidc/login")
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || len(resp.Cookies()) == 0 {
+		t.Fatalf("expected redirect with state cookie, got %d", resp.StatusCode)
+	}
+	state := resp.Cookies()[0]
+
+	iss.AddCode("code1", iss.Claims("sub1", "staff@example.com", []string{"pvz-staff"}))
+	req, _ := http.NewRequest(http.MethodGet, server.URL+"/oidc/callback?code=code1&state="+state.Value, nil)
+	req.AddCookie(state)
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+	var token string
+	json.NewDecoder(resp.Body).Decode(&token)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 on callback, got %d", resp.StatusCode)
+	}
+	claims, err := tokens.ParsePurposeToken(token, tokens.PurposeAccess)
+	if err != nil || claims.Role != "employee" || claims.UserID != "sso-sub1" {
+		t.Fatalf("unexpected token claims %+v, %v", claims, err)
+	}
+
+	// an SSO user has no local password, so a reset must not give them one
+	body, _ := json.Marshal(map[string]string{"email": "staff@example.com"})
+	resp, err = http.Post(server.URL+"/password/reset/request", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+	resp.Body.Close()
+	h.WaitMails(context.Background())
+	if resp.StatusCode != http.StatusAccepted || len(mails.messages) != 0 {
+		t.Errorf("expected reset to be refused silently, got %d and %d mails", resp.StatusCode, len(mails.messages))
+	}
+
+	// ID token without a mapped group
+	body, _ = json.Marshal(oidcTokenReq{IDToken: iss.IDToken("sub2", "other@example.com", []string{"guests"})})
+	resp, err = http.Post(server.URL+"/oidc/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("expected 403 for unmapped groups, got %d", resp.StatusCode)
+	}
+
+	// SSO logins pass the second factor like password logins
+	h.MFARequiredRoles = []string{"employee"}
+	body, _ = json.Marshal(oidcTokenReq{IDToken: iss.IDToken("sub1", "staff@example.com", []string{"pvz-staff"})})
+	resp, err = http.Post(server.URL+"/oidc/token", "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed request: %v", err)
+	}
+	var mfa mfaResp
+	json.NewDecoder(resp.Body).Decode(&mfa)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !mfa.MFAEnrollmentRequired || mfa.MFAToken == "" {
+		t.Errorf("expected 2fa enrollment instead of an access token, got %d %+v", resp.StatusCode, mfa)
+	}
+}
+
+func TestIdempotencyKey_ReplaysFirstResponse(t *testing.T) {
+	repo := &memoryRepo{}
+	server := httptest.NewServer(NewHttpHandlers(repo))
+	defer server.Close()
+	token, _ := tokens.CreateToken("user1", "moderator")
+
+	create := func(key, city string) (*http.Response, domain.PVZ) {
+		body, _ := json.Marshal(map[string]string{"city": city})
+		req, _ := http.NewRequest(http.MethodPost, server.URL+"/pvz", bytes.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		req.Header.Set("Idempotency-Key", key)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("failed request: %v", err)
+		}
+		defer resp.Body.Close()
+		var pvz domain.PVZ
+		json.NewDecoder(resp.Body).Decode(&pvz)
+		return resp, pvz
+	}
+
+	first, created := create("key-1", "Москва")
+	if first.StatusCode != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", first.StatusCode)
+	}
+	retry, replayed := create("key-1", "Москва")
+	if retry.StatusCode != http.StatusCreated || retry.Header.Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("expected replayed 201, got %d", retry.StatusCode)
+	}
+	if replayed.ID != created.ID || len(repo.pvzs) != 1 {
+		t.Errorf("retry must not create another pvz: %d pvzs", len(repo.pvzs))
+	}
+
+	if resp, _ := create("key-1", "Казань"); resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for different payload, got %d", resp.StatusCode)
+	}
+	if resp, _ := create("key-2", "Казань"); resp.StatusCode != http.StatusCreated || len(repo.pvzs) != 2 {
+		t.Errorf("new key must run the request, got %d", resp.StatusCode)
+	}
+}
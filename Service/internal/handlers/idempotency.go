@@ -0,0 +1,223 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/tokens"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader   = "Idempotency-Key"
+	defaultIdempotencyTTL  = 24 * time.Hour
+	maxIdempotencyKeyLen   = 255
+	idempotencyReplayedHdr = "Idempotent-Replayed"
+)
+
+// idempotent runs a mutating request at most once per Idempotency-Key and caller. A retry
+// with the same key gets the stored response; a retry with a different payload gets 422,
+// and one arriving while the first request is still running gets 409. Anonymous requests
+// are not tracked: there is no caller to scope the key to.
+func (h *HttpHandlers) idempotent(w http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	key := r.Header.Get(idempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLen {
+		http.Error(w, `{"message":"idempotency key is too long"}`, http.StatusBadRequest)
+		return
+	}
+	c := tokens.ClaimsFromContext(r.Context())
+	if c == nil {
+		c = tokens.Identify(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"))
+	}
+	if c == nil {
+		next(w, r)
+		return
+	}
+	subject := c.UserID
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	hash := requestHash(r, body)
+
+	ttl := h.IdempotencyTTL
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	now := time.Now()
+	err, record := h.data(r.Context()).StartIdempotentRequest(subject, key, hash, now, now.Add(ttl))
+	if err != nil {
+		http.Error(w, `{"message":"cannot check idempotency key"}`, http.StatusInternalServerError)
+		return
+	}
+	if record != nil {
+		replayIdempotent(w, record, hash)
+		return
+	}
+
+	rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	next(rec, r)
+
+	// settle the key even if the client is gone, or retries would get 409 until it expires
+	data := h.data(context.WithoutCancel(r.Context()))
+	if !storableStatus(rec.status) {
+		if err := data.ReleaseIdempotentRequest(subject, key); err != nil {
+			slog.ErrorContext(r.Context(), "release idempotency key", "err", err)
+		}
+		return
+	}
+	err = data.CompleteIdempotentRequest(subject, key, &domain.IdempotencyRecord{
+		RequestHash: hash,
+		Completed:   true,
+		StatusCode:  rec.status,
+		ContentType: rec.Header().Get("Content-Type"),
+		Body:        rec.body.Bytes(),
+	})
+	if err != nil {
+		slog.ErrorContext(r.Context(), "store idempotent response", "err", err)
+	}
+}
+
+func replayIdempotent(w http.ResponseWriter, record *domain.IdempotencyRecord, hash string) {
+	if record.RequestHash != hash {
+		http.Error(w, `{"message":"idempotency key was used with a different request"}`, http.StatusUnprocessableEntity)
+		return
+	}
+	if !record.Completed {
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, `{"message":"request with this idempotency key is in progress"}`, http.StatusConflict)
+		return
+	}
+
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set(idempotencyReplayedHdr, "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Body)
+}
+
+func requestHash(r *http.Request, body []byte) string {
+	sum := sha256.New()
+	sum.Write([]byte(r.Method + " " + r.URL.RequestURI() + "\n"))
+	sum.Write(body)
+	return hex.EncodeToString(sum.Sum(nil))
+}
+
+// storableStatus leaves out server errors and answers that depend on the moment rather than
+// the request (auth, throttling, conflicts), so that retries of those run again.
+func storableStatus(status int) bool {
+	switch status {
+	case http.StatusUnauthorized, http.StatusForbidden, http.StatusConflict, http.StatusPreconditionFailed,
+		http.StatusTooManyRequests:
+		return false
+	}
+	return status < http.StatusInternalServerError
+}
+
+// responseRecorder passes the response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// GrpcIdempotentMethods lists the mutating gRPC methods honouring "idempotency-key" metadata,
+// with a constructor for their response used to decode stored responses. The gRPC API is
+// read-only so far, so the list is empty.
+var GrpcIdempotentMethods = map[string]func() interface{}{}
+
+// IdempotencyInterceptor is the gRPC counterpart of the Idempotency-Key header. It has to run
+// after the auth interceptor, which puts the caller into the context.
+func IdempotencyInterceptor(repo interfaces.Repository, ttl time.Duration) grpc.UnaryServerInterceptor {
+	if ttl <= 0 {
+		ttl = defaultIdempotencyTTL
+	}
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		newResponse, ok := GrpcIdempotentMethods[info.FullMethod]
+		md, _ := metadata.FromIncomingContext(ctx)
+		key := tokens.First(md.Get("idempotency-key"))
+		c := tokens.ClaimsFromContext(ctx)
+		if !ok || key == "" || c == nil {
+			return handler(ctx, req)
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			return nil, status.Error(codes.InvalidArgument, "idempotency key is too long")
+		}
+
+		payload, err := json.Marshal(req)
+		if err != nil {
+			return nil, status.Error(codes.Internal, "cannot hash request")
+		}
+		sum := sha256.Sum256(append([]byte(info.FullMethod+"\n"), payload...))
+		hash := hex.EncodeToString(sum[:])
+
+		now := time.Now()
+		err, record := repo.WithContext(ctx).StartIdempotentRequest(c.UserID, key, hash, now, now.Add(ttl))
+		if err != nil {
+			return nil, status.Error(codes.Internal, "cannot check idempotency key")
+		}
+		if record != nil {
+			switch {
+			case record.RequestHash != hash:
+				return nil, status.Error(codes.InvalidArgument, "idempotency key was used with a different request")
+			case !record.Completed:
+				return nil, status.Error(codes.Aborted, "request with this idempotency key is in progress")
+			}
+			resp := newResponse()
+			if err := json.Unmarshal(record.Body, resp); err != nil {
+				return nil, status.Error(codes.Internal, "cannot decode stored response")
+			}
+			return resp, nil
+		}
+
+		resp, err := handler(ctx, req)
+		done := repo.WithContext(context.WithoutCancel(ctx))
+		if err != nil {
+			if err := done.ReleaseIdempotentRequest(c.UserID, key); err != nil {
+				slog.ErrorContext(ctx, "release idempotency key", "err", err)
+			}
+			return resp, err
+		}
+		body, err := json.Marshal(resp)
+		if err == nil {
+			err = done.CompleteIdempotentRequest(c.UserID, key, &domain.IdempotencyRecord{
+				RequestHash: hash, Completed: true, ContentType: "application/json", Body: body,
+			})
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "store idempotent response", "err", err)
+		}
+
+		return resp, nil
+	}
+}
@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// pvzCity returns the city of a PVZ for the KPI labels, "unknown" if it cannot be read.
+func (h *HttpHandlers) pvzCity(ctx context.Context, pvzID string) string {
+	if city, ok := h.cities.Load(pvzID); ok {
+		return city.(string)
+	}
+	err, pvz := h.data(ctx).GetPVZ(pvzID)
+	if err != nil || pvz == nil {
+		return "unknown"
+	}
+	h.cities.Store(pvzID, pvz.City)
+
+	return pvz.City
+}
+
+// receptionClosed records how long the just closed reception was open.
+func (h *HttpHandlers) receptionClosed(ctx context.Context, pvzID, closedBy string) {
+	err, pvz := h.data(ctx).GetPVZ(pvzID)
+	if err != nil || pvz == nil {
+		return
+	}
+	h.cities.Store(pvzID, pvz.City)
+	if openedAt, ok := pvz.LastReceptionOpenedAt(); ok {
+		metrics.ReceptionDuration.WithLabelValues(pvz.City, closedBy).Observe(time.Since(openedAt).Seconds())
+	}
+}
+
+// SLOReport summarizes the requests of the last SLO window against the configured targets.
+func (h *HttpHandlers) SLOReport(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(h.SLO.Report())
+}
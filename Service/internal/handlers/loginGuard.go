@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/tokens"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// loginBlocked answers 429 with Retry-After while the account or the client IP is
+// waiting out a delay or a lockout after failed logins.
+func (h *HttpHandlers) loginBlocked(ctx context.Context, w http.ResponseWriter, accountKey, ipKey string) bool {
+	if !h.AccountLockout.Enabled() && !h.IPLockout.Enabled() {
+		return false
+	}
+
+	now := time.Now()
+	err, until := h.data(ctx).LoginBlockedUntil([]string{accountKey, ipKey}, now)
+	if err != nil {
+		slog.ErrorContext(ctx, "check login lock", "err", err)
+		return false
+	}
+	if !until.After(now) {
+		return false
+	}
+
+	metrics.LoginFailures.WithLabelValues("locked").Inc()
+	retryAfter := int(until.Sub(now).Seconds()) + 1
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	http.Error(w, `{"message":"too many failed login attempts"}`, http.StatusTooManyRequests)
+
+	return true
+}
+
+func (h *HttpHandlers) loginFailed(ctx context.Context, accountKey, ipKey string) {
+	// a client hanging up right after a wrong guess must not skip the count
+	ctx = context.WithoutCancel(ctx)
+	h.recordLoginFailure(ctx, accountKey, h.AccountLockout)
+	h.recordLoginFailure(ctx, ipKey, h.IPLockout)
+}
+
+func (h *HttpHandlers) recordLoginFailure(ctx context.Context, key string, policy tokens.LockoutPolicy) {
+	if !policy.Enabled() {
+		return
+	}
+
+	now := time.Now()
+	err, failures := h.data(ctx).RecordLoginFailure(key, now, policy.Window)
+	if err != nil {
+		slog.ErrorContext(ctx, "record login failure", "err", err)
+		return
+	}
+	if delay := policy.Delay(failures); delay > 0 {
+		if err := h.data(ctx).LockLogin(key, now.Add(delay)); err != nil {
+			slog.ErrorContext(ctx, "lock login", "err", err)
+		}
+	}
+}
+
+func (h *HttpHandlers) loginSucceeded(ctx context.Context, accountKey string) {
+	if !h.AccountLockout.Enabled() {
+		return
+	}
+	if err := h.data(ctx).ResetLoginFailures(accountKey); err != nil {
+		slog.ErrorContext(ctx, "reset login failures", "err", err)
+	}
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/tokens"
+	"crypto/subtle"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const oidcStateCookie = "oidc_state"
+
+// OIDCLogin redirects to the issuer; the state is kept in a cookie to be checked on callback.
+func (h *HttpHandlers) OIDCLogin(w http.ResponseWriter, r *http.Request) {
+	state, _, err := tokens.NewOpaqueToken()
+	if err != nil {
+		http.Error(w, `{"message":"cannot start login"}`, http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    state,
+		Path:     "/oidc",
+		MaxAge:   int((10 * time.Minute).Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	http.Redirect(w, r, h.OIDC.AuthCodeURL(state), http.StatusFound)
+}
+
+func (h *HttpHandlers) OIDCCallback(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(oidcStateCookie)
+	state := r.URL.Query().Get("state")
+	if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+		http.Error(w, `{"message":"invalid state"}`, http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcStateCookie, Path: "/oidc", MaxAge: -1})
+
+	code := r.URL.Query().Get("code")
+	if code == "" {
+		http.Error(w, `{"message":"missing code"}`, http.StatusBadRequest)
+		return
+	}
+	rawIDToken, err := h.OIDC.Exchange(r.Context(), code)
+	if err != nil {
+		slog.WarnContext(r.Context(), "oidc exchange", "err", err)
+		metrics.LoginFailures.WithLabelValues("oidc_invalid_token").Inc()
+		http.Error(w, `{"message":"cannot exchange code"}`, http.StatusUnauthorized)
+		return
+	}
+
+	h.oidcLogin(w, r, rawIDToken)
+}
+
+type oidcTokenReq struct {
+	IDToken string `json:"idToken"`
+}
+
+// OIDCToken exchanges an ID token obtained by the client directly from the issuer.
+func (h *HttpHandlers) OIDCToken(w http.ResponseWriter, r *http.Request) {
+	var req oidcTokenReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.IDToken == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	h.oidcLogin(w, r, req.IDToken)
+}
+
+// oidcLogin verifies the ID token, provisions the local user and issues the access token.
+// The second factor is required as on /login: the MFA of the issuer is not relied upon.
+func (h *HttpHandlers) oidcLogin(w http.ResponseWriter, r *http.Request, rawIDToken string) {
+	id, err := h.OIDC.Verify(r.Context(), rawIDToken)
+	if err != nil {
+		metrics.LoginFailures.WithLabelValues("oidc_invalid_token").Inc()
+		http.Error(w, `{"message":"invalid id token"}`, http.StatusUnauthorized)
+		return
+	}
+	role := h.OIDC.RoleFor(id.Groups)
+	if role == "" {
+		metrics.LoginFailures.WithLabelValues("oidc_no_role").Inc()
+		http.Error(w, `{"message":"no role for user groups"}`, http.StatusForbidden)
+		return
+	}
+	if !validEmail(id.Email) {
+		http.Error(w, `{"message":"id token has no valid email"}`, http.StatusUnauthorized)
+		return
+	}
+
+	err, user := h.data(r.Context()).ProvisionExternalUser(id.Issuer, id.Subject, id.Email, role, time.Now())
+	if err != nil {
+		slog.ErrorContext(r.Context(), "oidc provision", "subject", id.Subject, "err", err)
+		http.Error(w, `{"message":"cannot provision user"}`, http.StatusConflict)
+		return
+	}
+	if user.DeactivatedAt != nil {
+		metrics.LoginFailures.WithLabelValues("deactivated").Inc()
+		http.Error(w, `{"message":"user is deactivated"}`, http.StatusUnauthorized)
+		return
+	}
+	if h.secondFactorStep(w, user) {
+		return
+	}
+
+	err, permissions := h.data(r.Context()).RolePermissions(user.Role)
+	if err != nil {
+		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
+		return
+	}
+	token, _ := tokens.CreateTokenWithPermissions(user.ID, user.Role, permissions)
+	json.NewEncoder(w).Encode(token)
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/ratelimit"
+	"AvitoPVZService/Service/internal/tokens"
+	"context"
+	"fmt"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// rateLimit answers 429 with Retry-After once the caller has used up the limit of the route.
+// The caller is the user of the token, the API key or, for anonymous requests, the client IP.
+// Returns the request carrying resolved API key claims, and true if it was rejected.
+func (h *HttpHandlers) rateLimit(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	c := tokens.Identify(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"))
+	subject, role := rateLimitSubject(c, clientIP(r))
+
+	ok, retryAfter, rule := h.RateLimiter.Allow(r.URL.Path, role, subject)
+	if ok {
+		return r.WithContext(tokens.WithResolvedAPIKey(r.Context(), c)), false
+	}
+
+	metrics.RateLimited.WithLabelValues("http", rule).Inc()
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfterSeconds(retryAfter)))
+	http.Error(w, `{"message":"rate limit exceeded"}`, http.StatusTooManyRequests)
+
+	return r, true
+}
+
+// RateLimitInterceptor applies the limiter to gRPC calls, keyed like the HTTP API with the
+// full method name as the route. It has to run before the auth interceptor.
+func RateLimitInterceptor(limiter *ratelimit.Limiter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		c := tokens.Identify(tokens.First(md.Get("authorization")), tokens.First(md.Get("x-api-key")))
+		var ip string
+		if p, ok := peer.FromContext(ctx); ok {
+			ip, _, _ = net.SplitHostPort(p.Addr.String())
+		}
+		subject, role := rateLimitSubject(c, ip)
+
+		ok, retryAfter, rule := limiter.Allow(info.FullMethod, role, subject)
+		if !ok {
+			metrics.RateLimited.WithLabelValues("grpc", rule).Inc()
+			grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfterSeconds(retryAfter))))
+			return nil, status.Error(codes.ResourceExhausted, fmt.Sprintf("rate limit exceeded, retry after %s", retryAfter.Round(time.Second)))
+		}
+
+		return handler(tokens.WithResolvedAPIKey(ctx, c), req)
+	}
+}
+
+func rateLimitSubject(c *tokens.Claims, ip string) (subject, role string) {
+	switch {
+	case c == nil:
+		return "ip:" + ip, ""
+	case c.APIKeyID != "":
+		return "apikey:" + c.APIKeyID, c.Role
+	default:
+		return "user:" + c.UserID, c.Role
+	}
+}
+
+func retryAfterSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,34 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/logging"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// withRequestID keeps the X-Request-ID of the caller, or assigns one, and echoes it back so
+// that a support ticket can quote it.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	ctx, id := logging.WithRequestID(r.Context(), r.Header.Get(logging.RequestIDHeader))
+	w.Header().Set(logging.RequestIDHeader, id)
+
+	return r.WithContext(ctx)
+}
+
+// logRequest writes the access log line. Only the path is logged: query strings may carry
+// OIDC codes and similar secrets.
+func logRequest(r *http.Request, route string, status int, took time.Duration) {
+	level := slog.LevelInfo
+	if status >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	slog.Log(r.Context(), level, "http request",
+		"method", r.Method,
+		"path", r.URL.Path,
+		"route", route,
+		"status", status,
+		"duration_ms", took.Milliseconds(),
+		"ip", clientIP(r),
+	)
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/slo"
+	"AvitoPVZService/Service/internal/tracing"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// idRoutes are the first path segments followed by an id.
+var idRoutes = map[string]bool{"pvz": true, "users": true, "api_keys": true, "assignments": true, "roles": true}
+
+// knownRoutes bounds the route label: anything else, e.g. a scan for random paths, is "other".
+var knownRoutes = map[string]bool{
+	"/dummyLogin": true, "/register": true, "/login": true, "/login/2fa": true,
+	"/email/verify": true, "/email/verify/resend": true,
+	"/password/reset/request": true, "/password/reset/confirm": true,
+	"/oidc/login": true, "/oidc/callback": true, "/oidc/token": true,
+	"/2fa/enroll": true, "/2fa/activate": true,
+	"/pvz": true, "/pvz/{id}": true,
+	"/pvz/{id}/delete_last_product": true, "/pvz/{id}/close_last_reception": true,
+	"/pvz/{id}/force_close_reception": true, "/pvz/{id}/reopen_last_reception": true,
+	"/pvz/{id}/reception_events": true, "/pvz/{id}/reception_timeout": true, "/pvz/{id}/manifest": true,
+	"/users": true, "/users/{id}/2fa/reset": true, "/users/{id}/unlock": true,
+	"/users/{id}/deactivate": true, "/users/{id}/reactivate": true, "/users/{id}/role": true,
+	"/invites": true, "/api_keys": true, "/api_keys/{id}": true,
+	"/roles": true, "/roles/{id}": true, "/assignments": true, "/assignments/{id}": true,
+	"/receptions": true, "/products": true, "/slo": true,
+}
+
+// routeLabel turns a request path into its route template.
+func routeLabel(path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(segments) > 1 && idRoutes[segments[0]] {
+		segments[1] = "{id}"
+	}
+	route := "/" + strings.Join(segments, "/")
+	if !knownRoutes[route] {
+		return "other"
+	}
+
+	return route
+}
+
+// statusWriter remembers the status code written by a handler.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// observeHTTP runs next in a server span under a request ID and records its latency and
+// status, including requests rejected by the rate limiter, in the access log, the metrics
+// and the SLO tracker if there is one.
+func observeHTTP(w http.ResponseWriter, r *http.Request, tracker *slo.Tracker, next http.HandlerFunc) {
+	metrics.HTTPRequestsInFlight.Inc()
+	defer metrics.HTTPRequestsInFlight.Dec()
+
+	start := time.Now()
+	r, span := tracing.StartHTTP(r)
+	r = withRequestID(w, r)
+	sw := &statusWriter{ResponseWriter: w}
+	next(sw, r)
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	took := time.Since(start)
+	route := routeLabel(r.URL.Path)
+	tracing.EndHTTP(span, r.Method, route, sw.status)
+	logRequest(r, route, sw.status, took)
+	metrics.HTTPRequestDuration.WithLabelValues(r.Method, route, strconv.Itoa(sw.status)).Observe(took.Seconds())
+	if tracker != nil {
+		tracker.Observe(r.Method+" "+route, sw.status, took)
+	}
+}
+
+// MetricsInterceptor records the latency and status code of gRPC calls. It goes first in
+// the chain so that rejected calls are counted too.
+func MetricsInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		metrics.GRPCRequestDuration.WithLabelValues(info.FullMethod, status.Code(err).String()).
+			Observe(time.Since(start).Seconds())
+
+		return resp, err
+	}
+}
@@ -0,0 +1,220 @@
+package handlers
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/tokens"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	mfaTokenTTL           = 5 * time.Minute
+	mfaEnrollmentTokenTTL = 15 * time.Minute
+	recoveryCodesCount    = 10
+)
+
+type mfaResp struct {
+	MFARequired           bool   `json:"mfaRequired,omitempty"`
+	MFAEnrollmentRequired bool   `json:"mfaEnrollmentRequired,omitempty"`
+	MFAToken              string `json:"mfaToken"`
+}
+
+// secondFactorStep answers the password step of the login when the user has to pass or
+// enroll a second factor. Returns false if the final token can be issued right away.
+func (h *HttpHandlers) secondFactorStep(w http.ResponseWriter, user *domain.User) bool {
+	var resp mfaResp
+	var err error
+	switch {
+	case user.TOTPEnabled:
+		resp.MFARequired = true
+		resp.MFAToken, err = tokens.CreatePurposeToken(user.ID, user.Role, tokens.PurposeMFA, mfaTokenTTL)
+	case h.mfaRequired(user.Role):
+		resp.MFAEnrollmentRequired = true
+		resp.MFAToken, err = tokens.CreatePurposeToken(user.ID, user.Role, tokens.PurposeMFAEnrollment, mfaEnrollmentTokenTTL)
+	default:
+		return false
+	}
+
+	if err != nil {
+		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
+		return true
+	}
+	json.NewEncoder(w).Encode(resp)
+
+	return true
+}
+
+func (h *HttpHandlers) mfaRequired(role string) bool {
+	for _, r := range h.MFARequiredRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// ----------
+
+type secondFactorReq struct {
+	MFAToken     string `json:"mfaToken"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recoveryCode"`
+}
+
+// LoginSecondFactor exchanges the mfa token and a TOTP or recovery code for the access token.
+func (h *HttpHandlers) LoginSecondFactor(w http.ResponseWriter, r *http.Request) {
+	var req secondFactorReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || (req.Code == "" && req.RecoveryCode == "") {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+	c, err := tokens.ParsePurposeToken(req.MFAToken, tokens.PurposeMFA)
+	if err != nil {
+		http.Error(w, `{"message":"invalid mfa token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	mfaKey, ipKey := "mfa:"+c.UserID, "ip:"+clientIP(r)
+	if h.loginBlocked(r.Context(), w, mfaKey, ipKey) {
+		return
+	}
+
+	var ok bool
+	if req.RecoveryCode != "" {
+		err, ok = h.data(r.Context()).UseRecoveryCode(c.UserID, tokens.HashOpaqueToken(strings.TrimSpace(req.RecoveryCode)), time.Now())
+	} else {
+		err, ok = h.checkTOTP(r.Context(), c.UserID, req.Code, true)
+	}
+	if err != nil {
+		http.Error(w, `{"message":"cannot check second factor"}`, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		h.loginFailed(r.Context(), mfaKey, ipKey)
+		metrics.LoginFailures.WithLabelValues("bad_second_factor").Inc()
+		http.Error(w, `{"message":"invalid code"}`, http.StatusUnauthorized)
+		return
+	}
+	h.loginSucceeded(r.Context(), mfaKey)
+
+	err, permissions := h.data(r.Context()).RolePermissions(c.Role)
+	if err != nil {
+		http.Error(w, `{"message":"token error"}`, http.StatusInternalServerError)
+		return
+	}
+	token, _ := tokens.CreateTokenWithPermissions(c.UserID, c.Role, permissions)
+	json.NewEncoder(w).Encode(token)
+}
+
+// checkTOTP validates the code against the stored secret and burns its time step so the
+// same code cannot be replayed.
+func (h *HttpHandlers) checkTOTP(ctx context.Context, userID, code string, mustBeEnabled bool) (error, bool) {
+	err, totp := h.data(ctx).GetTOTP(userID)
+	if err != nil {
+		return err, false
+	}
+	if totp.Secret == "" || totp.Enabled != mustBeEnabled {
+		return nil, false
+	}
+
+	step, valid := tokens.ValidateTOTP(totp.Secret, strings.TrimSpace(code), time.Now())
+	if !valid {
+		return nil, false
+	}
+
+	return h.data(ctx).UseTOTPStep(userID, step)
+}
+
+// ----------
+
+type enrollTOTPResp struct {
+	Secret string `json:"secret"`
+	URL    string `json:"url"`
+}
+
+// EnrollTOTP generates a new secret to be added to an authenticator app. 2FA is switched
+// on only after ActivateTOTP confirms a code from the app.
+func (h *HttpHandlers) EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	uid := userID(r)
+	secret, err := tokens.NewTOTPSecret()
+	if err != nil {
+		http.Error(w, `{"message":"cannot generate secret"}`, http.StatusInternalServerError)
+		return
+	}
+
+	err = h.data(r.Context()).SetTOTPSecret(uid, secret)
+	if err != nil {
+		http.Error(w, `{"message":"2fa is already enabled"}`, http.StatusConflict)
+		return
+	}
+
+	json.NewEncoder(w).Encode(enrollTOTPResp{Secret: secret, URL: tokens.TOTPURL(h.TOTPIssuer, uid, secret)})
+}
+
+type activateTOTPReq struct {
+	Code string `json:"code"`
+}
+
+type activateTOTPResp struct {
+	RecoveryCodes []string `json:"recoveryCodes"`
+}
+
+func (h *HttpHandlers) ActivateTOTP(w http.ResponseWriter, r *http.Request) {
+	uid := userID(r)
+	var req activateTOTPReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Code == "" {
+		http.Error(w, `{"message":"bad request"}`, http.StatusBadRequest)
+		return
+	}
+
+	err, ok := h.checkTOTP(r.Context(), uid, req.Code, false)
+	if err != nil {
+		http.Error(w, `{"message":"cannot check code"}`, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, `{"message":"invalid code"}`, http.StatusBadRequest)
+		return
+	}
+
+	codes, err := tokens.NewRecoveryCodes(recoveryCodesCount)
+	if err != nil {
+		http.Error(w, `{"message":"cannot generate recovery codes"}`, http.StatusInternalServerError)
+		return
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, tokens.HashOpaqueToken(code))
+	}
+
+	err = h.data(r.Context()).EnableTOTP(uid, hashes)
+	if err != nil {
+		http.Error(w, `{"message":"cannot enable 2fa"}`, http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(activateTOTPResp{RecoveryCodes: codes})
+}
+
+// ResetTOTP drops the 2FA of another, no more privileged user, who enrolls again at the next login.
+func (h *HttpHandlers) ResetTOTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path, "/")
+	id := parts[2]
+	if id == userID(r) {
+		http.Error(w, `{"message":"cannot change own account"}`, http.StatusBadRequest)
+		return
+	}
+	if !h.canManageUser(w, r, id) {
+		return
+	}
+
+	err := h.data(r.Context()).ResetTOTP(id)
+	if err != nil {
+		http.Error(w, `{"message":"user not found"}`, http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
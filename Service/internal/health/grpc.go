@@ -0,0 +1,39 @@
+package health
+
+import (
+	"context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer implements grpc.health.v1.Health on top of the readiness checks. The empty
+// service name stands for the whole server. Watch is not supported: probes poll Check.
+type GRPCServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+
+	checker  *Checker
+	services map[string]bool
+}
+
+func NewGRPCServer(checker *Checker, services ...string) *GRPCServer {
+	known := map[string]bool{"": true}
+	for _, s := range services {
+		known[s] = true
+	}
+
+	return &GRPCServer{checker: checker, services: known}
+}
+
+func (s *GRPCServer) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if !s.services[req.GetService()] {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+
+	resp := &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}
+	if !s.checker.Run(ctx).Ready() {
+		resp.Status = grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,71 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyHandler_ReportsFailedDependency(t *testing.T) {
+	c := New(time.Second)
+	c.Add("postgres", func(ctx context.Context) error { return errors.New("connection refused") })
+	c.Add("migrations", func(ctx context.Context) error { return nil })
+
+	rec := httptest.NewRecorder()
+	c.ReadyHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	var report Report
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	if report.Checks["postgres"].Error != "connection refused" || report.Checks["migrations"].Status != StatusUp {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestRun_TimesOutHangingCheck(t *testing.T) {
+	c := New(10 * time.Millisecond)
+	c.Add("postgres", func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+
+	if c.Run(context.Background()).Ready() {
+		t.Error("a hanging dependency must not be reported as up")
+	}
+}
+
+func TestGRPCServer_Check(t *testing.T) {
+	up := true
+	c := New(time.Second)
+	c.Add("postgres", func(ctx context.Context) error {
+		if !up {
+			return errors.New("down")
+		}
+		return nil
+	})
+	s := NewGRPCServer(c, "pvz.v1.PVZService")
+
+	resp, err := s.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "pvz.v1.PVZService"})
+	if err != nil || resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING, got %v %v", resp, err)
+	}
+	up = false
+	resp, _ = s.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{})
+	if resp.Status != grpc_health_v1.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("expected NOT_SERVING, got %v", resp.Status)
+	}
+	_, err = s.Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: "other"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("expected NotFound for unknown service, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/grpc"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultShutdownTimeout bounds the whole shutdown when no timeout is configured.
+const DefaultShutdownTimeout = 30 * time.Second
+
+type server struct {
+	name  string
+	serve func() error
+	stop  func(ctx context.Context) error
+}
+
+type hook struct {
+	name string
+	stop func(ctx context.Context) error
+}
+
+// Manager runs the servers of the process and stops everything in order on shutdown:
+// first all servers stop accepting traffic and drain in-flight requests, then the
+// registered hooks run in reverse order (background workers before the pool they use).
+type Manager struct {
+	ShutdownTimeout time.Duration
+
+	servers []server
+	hooks   []hook
+}
+
+func New(shutdownTimeout time.Duration) *Manager {
+	return &Manager{ShutdownTimeout: shutdownTimeout}
+}
+
+// Serve registers a server. serve blocks until the server stops; stop must make it return
+// after draining in-flight work or when ctx expires.
+func (m *Manager) Serve(name string, serve func() error, stop func(ctx context.Context) error) {
+	m.servers = append(m.servers, server{name: name, serve: serve, stop: stop})
+}
+
+// ServeHTTP registers an http.Server listening on its Addr.
+func (m *Manager) ServeHTTP(name string, srv *http.Server) {
+	m.Serve(name, func() error {
+		if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, srv.Shutdown)
+}
+
+// ServeGRPC registers a gRPC server. On shutdown it waits for running calls with
+// GracefulStop and cancels whatever is left when the deadline expires.
+func (m *Manager) ServeGRPC(name string, srv *grpc.Server, serve func() error) {
+	m.Serve(name, serve, func(ctx context.Context) error {
+		done := make(chan struct{})
+		go func() {
+			srv.GracefulStop()
+			close(done)
+		}()
+		select {
+		case <-done:
+			return nil
+		case <-ctx.Done():
+			srv.Stop()
+			return ctx.Err()
+		}
+	})
+}
+
+// OnShutdown registers a hook run after the servers have stopped. Hooks run in reverse
+// order of registration and share the shutdown deadline.
+func (m *Manager) OnShutdown(name string, stop func(ctx context.Context) error) {
+	m.hooks = append(m.hooks, hook{name: name, stop: stop})
+}
+
+// Run starts the servers and blocks until ctx is cancelled (normally by SIGTERM/SIGINT)
+// or one of the servers fails, then shuts everything down. It returns the server failure,
+// if any, or the first shutdown error.
+func (m *Manager) Run(ctx context.Context) error {
+	failed := make(chan error, len(m.servers))
+	for _, s := range m.servers {
+		go func(s server) {
+			if err := s.serve(); err != nil {
+				slog.Error("server failed", "server", s.name, "err", err)
+				failed <- err
+			}
+		}(s)
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case runErr = <-failed:
+		slog.Error("shutting down after server failure")
+	}
+
+	timeout := m.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := m.shutdown(shutdownCtx)
+	if runErr != nil {
+		return runErr
+	}
+
+	return err
+}
+
+func (m *Manager) shutdown(ctx context.Context) error {
+	var mu sync.Mutex
+	var firstErr error
+	record := func(name string, err error) {
+		if err == nil {
+			return
+		}
+		slog.Error("stop failed", "component", name, "err", err)
+		mu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		mu.Unlock()
+	}
+
+	// servers stop together, so none keeps taking traffic while another drains
+	var wg sync.WaitGroup
+	for _, s := range m.servers {
+		wg.Add(1)
+		go func(s server) {
+			defer wg.Done()
+			record(s.name, s.stop(ctx))
+		}(s)
+	}
+	wg.Wait()
+
+	for i := len(m.hooks) - 1; i >= 0; i-- {
+		record(m.hooks[i].name, m.hooks[i].stop(ctx))
+	}
+
+	return firstErr
+}
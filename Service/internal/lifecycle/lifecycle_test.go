@@ -0,0 +1,107 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestManager_DrainsInFlightRequest(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("scanned"))
+	})}
+
+	m := New(time.Second)
+	m.Serve("http", func() error {
+		if err := srv.Serve(lis); !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+		return nil
+	}, srv.Shutdown)
+
+	ctx, stop := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- m.Run(ctx) }()
+
+	respCh := make(chan string)
+	go func() {
+		resp, err := http.Get("http://" + lis.Addr().String())
+		if err != nil {
+			respCh <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		respCh <- string(body)
+	}()
+
+	<-started
+	stop()
+	if got := <-respCh; got != "scanned" {
+		t.Errorf("in-flight request was dropped: %q", got)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("expected clean shutdown, got %v", err)
+	}
+}
+
+func TestManager_HooksRunInReverseAfterServers(t *testing.T) {
+	var mu sync.Mutex
+	var order []string
+	note := func(s string) {
+		mu.Lock()
+		order = append(order, s)
+		mu.Unlock()
+	}
+
+	stopped := make(chan struct{})
+	m := New(time.Second)
+	m.Serve("server", func() error {
+		<-stopped
+		return nil
+	}, func(ctx context.Context) error {
+		note("server")
+		close(stopped)
+		return nil
+	})
+	m.OnShutdown("pool", func(ctx context.Context) error { note("pool"); return nil })
+	m.OnShutdown("jobs", func(ctx context.Context) error { note("jobs"); return nil })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := m.Run(ctx); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if strings.Join(order, ",") != "server,jobs,pool" {
+		t.Errorf("unexpected stop order: %v", order)
+	}
+}
+
+func TestManager_ServerFailureStopsTheRest(t *testing.T) {
+	hookRan := false
+	m := New(time.Second)
+	m.Serve("broken", func() error { return errors.New("address in use") },
+		func(ctx context.Context) error { return nil })
+	m.OnShutdown("pool", func(ctx context.Context) error { hookRan = true; return nil })
+
+	err := m.Run(context.Background())
+	if err == nil || err.Error() != "address in use" {
+		t.Errorf("expected server failure, got %v", err)
+	}
+	if !hookRan {
+		t.Error("shutdown hooks must run after a server failure")
+	}
+}
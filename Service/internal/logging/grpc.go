@@ -0,0 +1,50 @@
+package logging
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// UnaryServerInterceptor is the gRPC counterpart of the HTTP request ID and access log:
+// it takes "x-request-id" from the metadata, returns it in the response header and logs
+// every call once it is done, including calls rejected by later interceptors.
+func UnaryServerInterceptor() grpc.UnaryServerInterceptor {
+	header := strings.ToLower(RequestIDHeader)
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+		var incoming string
+		if values := md.Get(header); len(values) > 0 {
+			incoming = values[0]
+		}
+		ctx, id := WithRequestID(ctx, incoming)
+		_ = grpc.SetHeader(ctx, metadata.Pairs(header, id))
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		code := status.Code(err)
+
+		level := slog.LevelInfo
+		if serverFault[code] {
+			level = slog.LevelError
+		}
+		attrs := []any{"method", info.FullMethod, "code", code.String(), "duration_ms", time.Since(start).Milliseconds()}
+		if err != nil {
+			attrs = append(attrs, "err", status.Convert(err).Message())
+		}
+		slog.Log(ctx, level, "grpc request", attrs...)
+
+		return resp, err
+	}
+}
+
+// serverFault are the codes logged as errors, like a 5xx over HTTP.
+var serverFault = map[codes.Code]bool{
+	codes.Unknown: true, codes.DeadlineExceeded: true, codes.Unimplemented: true,
+	codes.Internal: true, codes.Unavailable: true, codes.DataLoss: true,
+}
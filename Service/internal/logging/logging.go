@@ -0,0 +1,166 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"go.opentelemetry.io/otel/trace"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Formats accepted by Setup.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// RequestIDHeader carries the request ID in and out of HTTP requests; gRPC uses the same
+// name in lowercase as metadata.
+const RequestIDHeader = "X-Request-ID"
+
+const maxRequestIDLen = 128
+
+const redacted = "[REDACTED]"
+
+// Setup builds the logger for the level ("debug", "info", "warn", "error") and format and
+// installs it as the default, which also sends the standard log package through it.
+func Setup(out io.Writer, level, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("log level: %w", err)
+	}
+	opts := &slog.HandlerOptions{Level: lvl, ReplaceAttr: redact}
+
+	var handler slog.Handler
+	switch format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(out, opts)
+	case FormatText:
+		handler = slog.NewTextHandler(out, opts)
+	default:
+		return nil, fmt.Errorf("log format must be %s or %s, got %q", FormatJSON, FormatText, format)
+	}
+	logger := slog.New(contextHandler{handler})
+	slog.SetDefault(logger)
+
+	return logger, nil
+}
+
+// sensitiveKeys are matched against attribute keys in lowercase without "_" and "-".
+var sensitiveKeys = []string{"password", "token", "secret", "authorization", "apikey", "cookie", "recoverycode", "totp"}
+
+// redact hides the values of attributes that may carry credentials, whatever the caller
+// named them, and bearer credentials passed under an innocent key.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	key := strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(a.Key))
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+	if a.Value.Kind() == slog.KindString {
+		v := a.Value.String()
+		if strings.HasPrefix(v, "Bearer ") || strings.HasPrefix(v, "ApiKey ") {
+			return slog.String(a.Key, redacted)
+		}
+	}
+
+	return a
+}
+
+// contextHandler adds the request ID, the caller and the trace of the context to every record.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if info := fromContext(ctx); info != nil {
+		r.AddAttrs(slog.String("request_id", info.id))
+		if userID := info.user(); userID != "" {
+			r.AddAttrs(slog.String("user_id", userID))
+		}
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+type requestKey struct{}
+
+// requestInfo is shared by everything handling one request, so that the user found by the
+// auth middleware deep in the chain reaches the access log written at the top.
+type requestInfo struct {
+	id string
+
+	mu     sync.Mutex
+	userID string
+}
+
+func (i *requestInfo) user() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.userID
+}
+
+func fromContext(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestKey{}).(*requestInfo)
+	return info
+}
+
+// WithRequestID starts the log context of a request. An ID supplied by the caller is kept if
+// it is sane, otherwise a new one is generated; the ID in use is returned to be echoed back.
+func WithRequestID(ctx context.Context, id string) (context.Context, string) {
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	return context.WithValue(ctx, requestKey{}, &requestInfo{id: id}), id
+}
+
+// RequestID returns the ID of the request in ctx, or "" outside of a request.
+func RequestID(ctx context.Context) string {
+	if info := fromContext(ctx); info != nil {
+		return info.id
+	}
+	return ""
+}
+
+// SetUser records the authenticated caller for the logs of the request.
+func SetUser(ctx context.Context, userID string) {
+	if info := fromContext(ctx); info != nil {
+		info.mu.Lock()
+		info.userID = userID
+		info.mu.Unlock()
+	}
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
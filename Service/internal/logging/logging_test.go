@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"log/slog"
+	"testing"
+)
+
+func capture(t *testing.T, level string) *bytes.Buffer {
+	t.Helper()
+	prev := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(prev) })
+
+	var buf bytes.Buffer
+	if _, err := Setup(&buf, level, FormatJSON); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func lastLine(t *testing.T, buf *bytes.Buffer) map[string]interface{} {
+	t.Helper()
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	var entry map[string]interface{}
+	if err := json.Unmarshal(lines[len(lines)-1], &entry); err != nil {
+		t.Fatalf("not a JSON log line %q: %v", buf.String(), err)
+	}
+	return entry
+}
+
+func TestSetup_RedactsCredentials(t *testing.T) {
+	buf := capture(t, "info")
+
+	slog.Info("login", "email", "a@b.c", "password", "hunter2", "refresh_token", "r1",
+		"X-API-Key", "pvz_abc", "header", "Bearer eyJ.x.y")
+
+	entry := lastLine(t, buf)
+	for _, key := range []string{"password", "refresh_token", "X-API-Key", "header"} {
+		if entry[key] != redacted {
+			t.Errorf("%s must be redacted, got %v", key, entry[key])
+		}
+	}
+	if entry["email"] != "a@b.c" {
+		t.Errorf("email must be kept, got %v", entry["email"])
+	}
+}
+
+func TestSetup_RejectsUnknownLevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	if _, err := Setup(&buf, "verbose", FormatJSON); err == nil {
+		t.Error("expected an error for an unknown level")
+	}
+	if _, err := Setup(&buf, "info", "xml"); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		keep     bool
+	}{
+		{"caller id", "ticket-42.retry:1", true},
+		{"missing", "", false},
+		{"header injection", "abc\r\nX-Admin: 1", false},
+		{"too long", string(bytes.Repeat([]byte("a"), maxRequestIDLen+1)), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, id := WithRequestID(context.Background(), tt.incoming)
+			if (id == tt.incoming) != tt.keep || id == "" {
+				t.Errorf("got id %q for %q", id, tt.incoming)
+			}
+			if RequestID(ctx) != id {
+				t.Errorf("context carries %q, want %q", RequestID(ctx), id)
+			}
+		})
+	}
+}
+
+func TestContextHandler_AddsRequestAndUser(t *testing.T) {
+	buf := capture(t, "info")
+
+	ctx, id := WithRequestID(context.Background(), "")
+	SetUser(ctx, "emp1")
+	slog.InfoContext(ctx, "something happened")
+
+	entry := lastLine(t, buf)
+	if entry["request_id"] != id || entry["user_id"] != "emp1" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
+
+func TestUnaryServerInterceptor_LogsCall(t *testing.T) {
+	buf := capture(t, "info")
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "ticket-42"))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pvz.v1.PVZService/GetPVZList"}
+	_, _ = UnaryServerInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		SetUser(ctx, "mod1")
+		return nil, status.Error(codes.Internal, "db is down")
+	})
+
+	entry := lastLine(t, buf)
+	if entry["request_id"] != "ticket-42" || entry["user_id"] != "mod1" || entry["code"] != "Internal" || entry["level"] != "ERROR" {
+		t.Errorf("unexpected entry %v", entry)
+	}
+}
@@ -0,0 +1,27 @@
+package mailer
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer_WritesMessage(t *testing.T) {
+	dir := t.TempDir()
+	m := NewFile(dir)
+
+	err := m.Send(context.Background(), Message{To: "user@example.com", Subject: "Hello", Body: "token: abc"})
+	if err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+	data, _ := os.ReadFile(dir + "/" + files[0].Name())
+	if !strings.Contains(string(data), "To: user@example.com") || !strings.Contains(string(data), "token: abc") {
+		t.Errorf("unexpected message: %s", data)
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"time"
+)
+
+var (
+	openReceptionDesc = prometheus.NewDesc("pvz_open_receptions",
+		"Open receptions per PVZ (1 while a reception is open).", []string{"pvz_id", "city"}, nil)
+	openReceptionAgeDesc = prometheus.NewDesc("pvz_open_reception_age_seconds",
+		"Time since the open reception of a PVZ was opened.", []string{"pvz_id", "city"}, nil)
+	openReceptionProductsDesc = prometheus.NewDesc("pvz_open_reception_products",
+		"Products in the open reception of a PVZ.", []string{"pvz_id", "city"}, nil)
+)
+
+// receptionsCollector reads the open receptions from the database on every scrape, so
+// the gauges are right on every replica and after restarts.
+type receptionsCollector struct {
+	list func() (error, []domain.OpenReception)
+}
+
+// RegisterOpenReceptions exposes the receptions returned by list as per PVZ gauges.
+func RegisterOpenReceptions(list func() (error, []domain.OpenReception)) {
+	prometheus.MustRegister(&receptionsCollector{list: list})
+}
+
+func (c *receptionsCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- openReceptionDesc
+	ch <- openReceptionAgeDesc
+	ch <- openReceptionProductsDesc
+}
+
+func (c *receptionsCollector) Collect(ch chan<- prometheus.Metric) {
+	err, receptions := c.list()
+	if err != nil {
+		slog.Error("collect open receptions", "err", err)
+		return
+	}
+
+	now := time.Now()
+	for _, r := range receptions {
+		ch <- prometheus.MustNewConstMetric(openReceptionDesc, prometheus.GaugeValue, 1, r.PVZID, r.City)
+		ch <- prometheus.MustNewConstMetric(openReceptionAgeDesc, prometheus.GaugeValue, now.Sub(r.OpenedAt).Seconds(), r.PVZID, r.City)
+		ch <- prometheus.MustNewConstMetric(openReceptionProductsDesc, prometheus.GaugeValue, float64(r.Products), r.PVZID, r.City)
+	}
+}
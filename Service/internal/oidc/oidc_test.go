@@ -0,0 +1,79 @@
+package oidc_test
+
+import (
+	"AvitoPVZService/Service/internal/oidc"
+	"AvitoPVZService/Service/internal/oidc/oidctest"
+	"context"
+	"testing"
+	"time"
+)
+
+func newProvider(t *testing.T) (*oidc.Provider, *oidctest.Issuer) {
+	iss, err := oidctest.NewIssuer("pvz")
+	if err != nil {
+		t.Fatalf("NewIssuer error: %v", err)
+	}
+	t.Cleanup(iss.Close)
+
+	p, err := oidc.NewProvider(context.Background(), oidc.Config{
+		Issuer:   iss.URL,
+		ClientID: "pvz",
+		Roles: []oidc.GroupRole{
+			{Role: "moderator", Groups: []string{"pvz-moderators"}},
+			{Role: "employee", Groups: []string{"pvz-staff"}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("NewProvider error: %v", err)
+	}
+	return p, iss
+}
+
+func TestVerify_Success(t *testing.T) {
+	p, iss := newProvider(t)
+	id, err := p.Verify(context.Background(), iss.IDToken("sub1", "a@b.c", []string{"pvz-staff", "pvz-moderators"}))
+	if err != nil {
+		t.Fatalf("Verify error: %v", err)
+	}
+	if id.Subject != "sub1" || id.Email != "a@b.c" {
+		t.Errorf("unexpected identity: %+v", id)
+	}
+	if role := p.RoleFor(id.Groups); role != "moderator" {
+		t.Errorf("expected moderator, got %q", role)
+	}
+}
+
+func TestVerify_WrongAudience(t *testing.T) {
+	p, iss := newProvider(t)
+	claims := iss.Claims("sub1", "a@b.c", nil)
+	claims["aud"] = "other"
+	if _, err := p.Verify(context.Background(), iss.Sign(claims)); err == nil {
+		t.Error("expected audience error")
+	}
+}
+
+func TestVerify_Expired(t *testing.T) {
+	p, iss := newProvider(t)
+	claims := iss.Claims("sub1", "a@b.c", nil)
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	if _, err := p.Verify(context.Background(), iss.Sign(claims)); err == nil {
+		t.Error("expected expiry error")
+	}
+}
+
+func TestExchange(t *testing.T) {
+	p, iss := newProvider(t)
+	iss.AddCode("code1", iss.Claims("sub1", "a@b.c", []string{"pvz-staff"}))
+
+	raw, err := p.Exchange(context.Background(), "code1")
+	if err != nil {
+		t.Fatalf("Exchange error: %v", err)
+	}
+	id, err := p.Verify(context.Background(), raw)
+	if err != nil || p.RoleFor(id.Groups) != "employee" {
+		t.Errorf("unexpected identity %+v, %v", id, err)
+	}
+	if _, err := p.Exchange(context.Background(), "code1"); err == nil {
+		t.Error("expected code to be single use")
+	}
+}
@@ -0,0 +1,118 @@
+// Package oidctest runs a minimal OpenID Connect issuer for tests and local runs.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/golang-jwt/jwt/v4"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+const keyID = "test-key"
+
+type Issuer struct {
+	URL      string
+	ClientID string
+
+	server *httptest.Server
+	key    *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]jwt.MapClaims
+}
+
+// NewIssuer starts the issuer; ID tokens are issued for clientID.
+func NewIssuer(clientID string) (*Issuer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	iss := &Issuer{ClientID: clientID, key: key, codes: map[string]jwt.MapClaims{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", iss.discovery)
+	mux.HandleFunc("/jwks", iss.jwks)
+	mux.HandleFunc("/token", iss.token)
+	iss.server = httptest.NewServer(mux)
+	iss.URL = iss.server.URL
+
+	return iss, nil
+}
+
+func (iss *Issuer) Close() {
+	iss.server.Close()
+}
+
+// IDToken signs an ID token for the subject with the given email and groups.
+func (iss *Issuer) IDToken(subject, email string, groups []string) string {
+	return iss.Sign(iss.Claims(subject, email, groups))
+}
+
+func (iss *Issuer) Claims(subject, email string, groups []string) jwt.MapClaims {
+	return jwt.MapClaims{
+		"iss":    iss.URL,
+		"aud":    iss.ClientID,
+		"sub":    subject,
+		"email":  email,
+		"groups": groups,
+		"iat":    time.Now().Unix(),
+		"exp":    time.Now().Add(time.Hour).Unix(),
+	}
+}
+
+func (iss *Issuer) Sign(claims jwt.MapClaims) string {
+	t := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	t.Header["kid"] = keyID
+	signed, _ := t.SignedString(iss.key)
+	return signed
+}
+
+// AddCode registers an authorization code that the token endpoint exchanges for an ID token.
+func (iss *Issuer) AddCode(code string, claims jwt.MapClaims) {
+	iss.mu.Lock()
+	iss.codes[code] = claims
+	iss.mu.Unlock()
+}
+
+func (iss *Issuer) discovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 iss.URL,
+		"authorization_endpoint": iss.URL + "/authorize",
+		"token_endpoint":         iss.URL + "/token",
+		"jwks_uri":               iss.URL + "/jwks",
+	})
+}
+
+func (iss *Issuer) jwks(w http.ResponseWriter, r *http.Request) {
+	pub := iss.key.PublicKey
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": keyID,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		}},
+	})
+}
+
+func (iss *Issuer) token(w http.ResponseWriter, r *http.Request) {
+	code := r.FormValue("code")
+	iss.mu.Lock()
+	claims, ok := iss.codes[code]
+	delete(iss.codes, code)
+	iss.mu.Unlock()
+	if !ok || r.FormValue("client_id") != iss.ClientID {
+		http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]string{"id_token": iss.Sign(claims), "token_type": "Bearer"})
+}
@@ -0,0 +1,186 @@
+package ratelimit
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Rate requests per second on average with bursts of up to Burst requests.
+type Limit struct {
+	Rate  float64
+	Burst int
+}
+
+// Rule applies the limit to a route, optionally only for one role. Route is an exact path
+// (or gRPC method), a prefix ending with "*", or "*" for everything.
+type Rule struct {
+	Route string
+	Role  string
+	Limit Limit
+}
+
+// ParseRules reads rules written as "route[@role]=N/unit[:burst]", unit being s, m or h,
+// e.g. "/login=10/m", "/pvz/*@employee=20/s:40" or "*=50/s:100". The burst defaults to N.
+func ParseRules(specs []string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(specs))
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		target, limit, ok := strings.Cut(spec, "=")
+		if !ok {
+			return nil, fmt.Errorf("rate limit %q: expected route=limit", spec)
+		}
+		route, role, _ := strings.Cut(target, "@")
+		l, err := ParseLimit(limit)
+		if err != nil {
+			return nil, fmt.Errorf("rate limit %q: %w", spec, err)
+		}
+		rules = append(rules, Rule{Route: route, Role: role, Limit: l})
+	}
+
+	return rules, nil
+}
+
+func ParseLimit(s string) (Limit, error) {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+	count, unit, ok := strings.Cut(rate, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("expected N/unit")
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("bad count %q", count)
+	}
+
+	var per time.Duration
+	switch unit {
+	case "s":
+		per = time.Second
+	case "m":
+		per = time.Minute
+	case "h":
+		per = time.Hour
+	default:
+		return Limit{}, fmt.Errorf("bad unit %q", unit)
+	}
+
+	l := Limit{Rate: float64(n) / per.Seconds(), Burst: n}
+	if hasBurst {
+		l.Burst, err = strconv.Atoi(burst)
+		if err != nil || l.Burst <= 0 {
+			return Limit{}, fmt.Errorf("bad burst %q", burst)
+		}
+	}
+
+	return l, nil
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	limit  Limit
+}
+
+// full reports whether the bucket has refilled by now, so dropping it changes nothing.
+func (b *bucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.limit.Rate >= float64(b.limit.Burst)
+}
+
+// Limiter keeps one token bucket per rule and subject (user, API key or IP).
+type Limiter struct {
+	rules []Rule
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	calls   int
+}
+
+func New(rules []Rule) *Limiter {
+	return &Limiter{rules: rules, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// Allow takes a token for the subject on the route. If there is none left it returns false
+// and how long to wait for the next one. Requests matching no rule are not limited.
+// The returned rule is the route of the applied rule, for metrics.
+func (l *Limiter) Allow(route, role, subject string) (ok bool, retryAfter time.Duration, rule string) {
+	r, found := l.match(route, role)
+	if !found {
+		return true, 0, ""
+	}
+
+	key := r.Route + "@" + r.Role + "|" + subject
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(r.Limit.Burst), last: now, limit: r.Limit}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(r.Limit.Burst), b.tokens+now.Sub(b.last).Seconds()*r.Limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0, r.Route
+	}
+
+	wait := time.Duration((1 - b.tokens) / r.Limit.Rate * float64(time.Second))
+	return false, wait, r.Route
+}
+
+// match picks the most specific rule: exact route over prefix over "*", and a rule for
+// the role over a rule for everyone on the same route.
+func (l *Limiter) match(route, role string) (Rule, bool) {
+	var best Rule
+	bestScore := -1
+	for _, r := range l.rules {
+		var score int
+		switch {
+		case r.Route == route:
+			score = 3 << 16
+		case r.Route == "*":
+			score = 1 << 16
+		case strings.HasSuffix(r.Route, "*") && strings.HasPrefix(route, strings.TrimSuffix(r.Route, "*")):
+			score = 2<<16 + len(r.Route)
+		default:
+			continue
+		}
+		if r.Role != "" {
+			if r.Role != role {
+				continue
+			}
+			score += 1 << 15
+		}
+		if score > bestScore {
+			best, bestScore = r, score
+		}
+	}
+
+	return best, bestScore >= 0
+}
+
+const sweepEvery = 1024
+
+// sweep drops buckets that have been idle long enough to be full again. Slow rules such as
+// 10/h keep their buckets for up to Burst/Rate.
+func (l *Limiter) sweep(now time.Time) {
+	l.calls++
+	if l.calls%sweepEvery != 0 {
+		return
+	}
+	for key, b := range l.buckets {
+		if b.full(now) {
+			delete(l.buckets, key)
+		}
+	}
+}
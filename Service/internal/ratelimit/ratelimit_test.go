@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules([]string{"*=50/s:100", "/login=10/m", "/pvz/*@employee=20/s"})
+	if err != nil {
+		t.Fatalf("ParseRules error: %v", err)
+	}
+	if len(rules) != 3 {
+		t.Fatalf("expected 3 rules, got %d", len(rules))
+	}
+	if rules[1].Limit.Burst != 10 || rules[1].Limit.Rate != 10.0/60 {
+		t.Errorf("unexpected login limit: %+v", rules[1].Limit)
+	}
+	if rules[2].Route != "/pvz/*" || rules[2].Role != "employee" {
+		t.Errorf("unexpected role rule: %+v", rules[2])
+	}
+
+	for _, bad := range []string{"/login", "/login=10", "/login=10/d", "/login=0/s", "/login=1/s:x"} {
+		if _, err := ParseRules([]string{bad}); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestLimiter_TokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := New([]Rule{{Route: "/login", Limit: Limit{Rate: 1, Burst: 2}}})
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _, _ := l.Allow("/login", "", "ip:1"); !ok {
+			t.Fatalf("request %d within burst rejected", i+1)
+		}
+	}
+	ok, retryAfter, rule := l.Allow("/login", "", "ip:1")
+	if ok || retryAfter != time.Second || rule != "/login" {
+		t.Fatalf("expected rejection with 1s retry, got %v %v %q", ok, retryAfter, rule)
+	}
+	if ok, _, _ := l.Allow("/login", "", "ip:2"); !ok {
+		t.Error("other subjects must have their own bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _, _ := l.Allow("/login", "", "ip:1"); !ok {
+		t.Error("expected a token after refill")
+	}
+	if ok, _, _ := l.Allow("/pvz", "", "ip:1"); !ok {
+		t.Error("routes without rules are not limited")
+	}
+}
+
+func TestLimiter_MostSpecificRule(t *testing.T) {
+	l := New([]Rule{
+		{Route: "*", Limit: Limit{Rate: 1, Burst: 1}},
+		{Route: "/pvz/*", Limit: Limit{Rate: 1, Burst: 2}},
+		{Route: "/pvz/*", Role: "moderator", Limit: Limit{Rate: 1, Burst: 3}},
+		{Route: "/pvz/1/manifest", Limit: Limit{Rate: 1, Burst: 4}},
+	})
+
+	cases := []struct {
+		route, role string
+		burst       int
+	}{
+		{"/users", "", 1},
+		{"/pvz/1/close_last_reception", "employee", 2},
+		{"/pvz/1/close_last_reception", "moderator", 3},
+		{"/pvz/1/manifest", "moderator", 4},
+	}
+	for _, tc := range cases {
+		r, ok := l.match(tc.route, tc.role)
+		if !ok || r.Limit.Burst != tc.burst {
+			t.Errorf("%s@%s: expected burst %d, got %+v", tc.route, tc.role, tc.burst, r)
+		}
+	}
+}
+
+func TestLimiter_SweepKeepsSlowBuckets(t *testing.T) {
+	now := time.Unix(0, 0)
+	rules, _ := ParseRules([]string{"/login=10/h"})
+	l := New(rules)
+	l.now = func() time.Time { return now }
+	allow := func() bool {
+		ok, _, _ := l.Allow("/login", "", "ip:1")
+		return ok
+	}
+	sweep := func() {
+		l.calls = sweepEvery - 1
+		l.Allow("/login", "", "ip:2")
+	}
+
+	for i := 0; i < 10; i++ {
+		allow()
+	}
+	if allow() {
+		t.Fatal("expected the burst to be spent")
+	}
+
+	// idle for longer than a fast rule needs, but far from a full bucket of a 10/h rule
+	now = now.Add(30 * time.Minute)
+	sweep()
+	for i := 0; i < 5; i++ {
+		if !allow() {
+			t.Fatalf("request %d rejected, 5 tokens must have refilled", i+1)
+		}
+	}
+	if allow() {
+		t.Error("sweep must not reset a bucket that is not full yet")
+	}
+
+	now = now.Add(time.Hour)
+	sweep()
+	if _, ok := l.buckets["/login@|ip:1"]; ok {
+		t.Error("expected the refilled bucket to be dropped")
+	}
+}
@@ -0,0 +1,128 @@
+package db
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/internal/tracing"
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// instrumentedPool records the latency of every query under the name of the repository
+// method that ran it, and traces it as a child span of the request in ctx. Rows are timed
+// until they are closed and a single row until it is scanned, so the measurement covers
+// reading the result, not just sending the query.
+type instrumentedPool struct {
+	interfaces.PgxPoolIface
+}
+
+func (p instrumentedPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	ctx, obs := observeQuery(ctx, queryName(), sql)
+	rows, err := p.PgxPoolIface.Query(ctx, sql, args...)
+	if err != nil {
+		obs(err)
+		return rows, err
+	}
+
+	return &instrumentedRows{Rows: rows, obs: obs}, nil
+}
+
+func (p instrumentedPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	ctx, obs := observeQuery(ctx, queryName(), sql)
+	return &instrumentedRow{row: p.PgxPoolIface.QueryRow(ctx, sql, args...), obs: obs}
+}
+
+func (p instrumentedPool) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	ctx, obs := observeQuery(ctx, queryName(), sql)
+	tag, err := p.PgxPoolIface.Exec(ctx, sql, arguments...)
+	obs(err)
+
+	return tag, err
+}
+
+type instrumentedRow struct {
+	row pgx.Row
+	obs func(error)
+}
+
+func (r *instrumentedRow) Scan(dest ...interface{}) error {
+	err := r.row.Scan(dest...)
+	r.obs(err)
+
+	return err
+}
+
+type instrumentedRows struct {
+	pgx.Rows
+	obs  func(error)
+	done bool
+}
+
+func (r *instrumentedRows) Close() {
+	r.Rows.Close()
+	if !r.done {
+		r.done = true
+		r.obs(r.Rows.Err())
+	}
+}
+
+func (r *instrumentedRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	// rows exhausted: pgx closes them itself, record now in case Close is never called
+	if !r.done {
+		r.done = true
+		r.obs(r.Rows.Err())
+	}
+
+	return false
+}
+
+func observeQuery(ctx context.Context, name, sql string) (context.Context, func(error)) {
+	start := time.Now()
+	ctx, span := tracing.Tracer().Start(ctx, name,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBOperationName(name), semconv.DBQueryText(sql)),
+	)
+
+	return ctx, func(err error) {
+		outcome := "ok"
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			outcome = "error"
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		metrics.DBQueryDuration.WithLabelValues(name, outcome).Observe(time.Since(start).Seconds())
+		span.End()
+	}
+}
+
+// queryName is the PostgresRepository method two frames up: the caller of the pool method.
+func queryName() string {
+	pc, _, _, ok := runtime.Caller(2)
+	if !ok {
+		return "unknown"
+	}
+	fn := runtime.FuncForPC(pc)
+	if fn == nil {
+		return "unknown"
+	}
+	// "…/db.(*PostgresRepository).Method" or "…Method.func1" for closures
+	parts := strings.Split(fn.Name(), ".")
+	for i := len(parts) - 1; i > 0; i-- {
+		if !strings.HasPrefix(parts[i], "func") {
+			return parts[i]
+		}
+	}
+
+	return parts[0]
+}
@@ -3,53 +3,870 @@ package db
 import (
 	"AvitoPVZService/Service/internal/domain"
 	"AvitoPVZService/Service/internal/handlers"
+	"AvitoPVZService/Service/internal/metrics"
 	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"AvitoPVZService/Service/migration"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"google.golang.org/protobuf/types/known/timestamppb"
-	"log"
 	"sync"
 	"time"
 )
 
 const poolSize = 5
 
+// RequiredSchemaVersion is the number of the last migration embedded in the binary.
+var RequiredSchemaVersion = migration.Latest()
+
+// staleReceptionsLockKey is the advisory lock taken by the replica that closes stale receptions.
+const staleReceptionsLockKey = 7_271_001
+
 type PostgresRepository struct {
 	Pool interfaces.PgxPoolIface
 
-	mu          sync.RWMutex
-	poolChannel chan struct{}
+	// primary is Pool without instrumentation, the fallback of replica reads.
+	primary  interfaces.PgxPoolIface
+	replicas *ReplicaSet
+
+	mu          sync.RWMutex
+	poolChannel chan struct{}
+	// ctx is the request the repository was bound to by WithContext.
+	ctx context.Context
+}
+
+func New(pool interfaces.PgxPoolIface) *PostgresRepository {
+	return NewWithRetry(pool, Retry{})
+}
+
+// NewWithRetry is New with statements resent on transient errors, see Retry.
+func NewWithRetry(pool interfaces.PgxPoolIface, retry Retry) *PostgresRepository {
+	primary := retryingPool{PgxPoolIface: pool, retry: retry}
+	return &PostgresRepository{
+		Pool:        instrumentedPool{primary},
+		primary:     primary,
+		mu:          sync.RWMutex{},
+		poolChannel: make(chan struct{}, poolSize),
+	}
+}
+
+// WithContext returns a repository whose queries run in ctx: they are cancelled with the
+// request and traced as its children.
+func (r *PostgresRepository) WithContext(ctx context.Context) interfaces.Repository {
+	return &PostgresRepository{Pool: r.Pool, primary: r.primary, replicas: r.replicas, poolChannel: r.poolChannel, ctx: ctx}
+}
+
+// UseReplicas sends the reads that tolerate lag to the fresh replicas of set. Call it before
+// the repository is shared.
+func (r *PostgresRepository) UseReplicas(set *ReplicaSet) {
+	r.replicas = set
+}
+
+// reader is the pool for reads that tolerate lag: listings and reports nobody reads right
+// after writing them. Everything else, including the permission checks, reads from the
+// primary so a client sees its own writes.
+func (r *PostgresRepository) reader() interfaces.PgxPoolIface {
+	replica := r.replicas.pick()
+	if replica == nil {
+		if r.replicas != nil {
+			metrics.DBReplicaReads.WithLabelValues("primary").Inc()
+		}
+		return r.Pool
+	}
+	metrics.DBReplicaReads.WithLabelValues(replica.Name).Inc()
+
+	return instrumentedPool{replicaPool{replica: replica, primary: r.primary}}
+}
+
+func (r *PostgresRepository) requestContext() context.Context {
+	if r.ctx == nil {
+		return context.Background()
+	}
+	return r.ctx
+}
+
+// readContext is requestContext for statements that only read, which the pool may resend
+// after losing the connection mid-statement. Locking reads such as SELECT ... FOR UPDATE and
+// statements with side effects must use requestContext.
+func (r *PostgresRepository) readContext() context.Context {
+	return idempotent(r.requestContext())
+}
+
+// Ping checks that the database answers queries.
+func (r *PostgresRepository) Ping(ctx context.Context) error {
+	_, err := r.Pool.Exec(idempotent(ctx), `SELECT 1`)
+
+	return err
+}
+
+// SchemaVersion returns the last migration applied by goose.
+func (r *PostgresRepository) SchemaVersion(ctx context.Context) (error, int64) {
+	const query = `SELECT COALESCE(MAX(version_id), 0) FROM goose_db_version WHERE is_applied`
+
+	var version int64
+	err := r.Pool.QueryRow(idempotent(ctx), query).Scan(&version)
+
+	return err, version
+}
+
+// CheckSchema fails when the database lags behind the migrations this build expects.
+func (r *PostgresRepository) CheckSchema(ctx context.Context) error {
+	err, version := r.SchemaVersion(ctx)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version < RequiredSchemaVersion {
+		return fmt.Errorf("schema version %d, want %d: apply migrations", version, RequiredSchemaVersion)
+	}
+
+	return nil
+}
+
+func (r *PostgresRepository) Register(email, password, role string) error {
+	id := uuid.NewString()
+	const query = `INSERT INTO avito_schema.users(id,email,password_hash,role,registration_date) VALUES($1,$2,$3,$4,$5)`
+	_, err := r.Pool.Exec(r.requestContext(), query, id, email, password, role, time.Now())
+
+	return err
+}
+
+func (r *PostgresRepository) Login(email string) (error, *domain.User) {
+	var user domain.User
+	const query = `SELECT id,password_hash,role,deactivated_at,totp_enabled,email_verified_at IS NOT NULL FROM avito_schema.users WHERE email=$1`
+	row := r.Pool.QueryRow(r.readContext(), query, email)
+	err := row.Scan(&user.ID, &user.PasswordHash, &user.Role, &user.DeactivatedAt, &user.TOTPEnabled, &user.EmailVerified)
+
+	return err, &user
+}
+
+// ProvisionExternalUser returns the user linked to the external identity, creating it on the
+// first login. The role follows the group mapping of the issuer on every login. Fails if the
+// email already belongs to a local account.
+func (r *PostgresRepository) ProvisionExternalUser(issuer, subject, email, role string, at time.Time) (error, *domain.User) {
+	const query = `
+	WITH existing AS (
+		UPDATE avito_schema.user_identities
+		SET last_login_at = $6
+		WHERE issuer = $1 AND subject = $2
+		RETURNING user_id
+	), updated AS (
+		UPDATE avito_schema.users
+		SET role = $5
+		WHERE id = (SELECT user_id FROM existing)
+		RETURNING id, email, role, registration_date, deactivated_at, totp_enabled
+	), created AS (
+		INSERT INTO avito_schema.users(id, email, password_hash, role, registration_date, email_verified_at)
+		SELECT $3, $4, '', $5, $6, $6
+		WHERE NOT EXISTS (SELECT 1 FROM existing)
+		RETURNING id, email, role, registration_date, deactivated_at, totp_enabled
+	), linked AS (
+		INSERT INTO avito_schema.user_identities(issuer, subject, user_id, last_login_at)
+		SELECT $1, $2, id, $6 FROM created
+	)
+	SELECT id, email, role, registration_date, deactivated_at, totp_enabled FROM updated
+	UNION ALL
+	SELECT id, email, role, registration_date, deactivated_at, totp_enabled FROM created;
+	`
+
+	var u domain.User
+	err := r.Pool.QueryRow(r.requestContext(), query, issuer, subject, uuid.NewString(), email, role, at).
+		Scan(&u.ID, &u.Email, &u.Role, &u.RegistrationDate, &u.DeactivatedAt, &u.TOTPEnabled)
+	if err != nil {
+		return err, nil
+	}
+	u.EmailVerified = true
+
+	return nil, &u
+}
+
+// CreateEmailToken stores a token for the active user with the email. Returns false if there
+// is no such user, the email is already verified when a verification token is requested, or a
+// reset is requested for an SSO user, who has no local password.
+func (r *PostgresRepository) CreateEmailToken(email, purpose, tokenHash string, expiresAt time.Time) (error, bool) {
+	const query = `
+	INSERT INTO avito_schema.email_tokens(token_hash, user_id, purpose, expires_at)
+	SELECT $1, id, $2, $3
+	  FROM avito_schema.users
+	 WHERE email = $4
+	   AND deactivated_at IS NULL
+	   AND ($2 <> 'verify_email' OR email_verified_at IS NULL)
+	   AND ($2 <> 'reset_password' OR password_hash <> '');
+	`
+
+	tag, err := r.Pool.Exec(r.requestContext(), query, tokenHash, purpose, expiresAt, email)
+	if err != nil {
+		return err, false
+	}
+
+	return nil, tag.RowsAffected() == 1
+}
+
+func (r *PostgresRepository) VerifyEmail(tokenHash string, at time.Time) (error, bool) {
+	const query = `
+	WITH token AS (
+		UPDATE avito_schema.email_tokens
+		SET used_at = $1
+		WHERE token_hash = $2
+		  AND purpose = 'verify_email'
+		  AND used_at IS NULL
+		  AND expires_at > $1
+		RETURNING user_id
+	)
+	UPDATE avito_schema.users u
+	SET email_verified_at = COALESCE(u.email_verified_at, $1)
+	FROM token
+	WHERE u.id = token.user_id;
+	`
+
+	tag, err := r.Pool.Exec(r.requestContext(), query, at, tokenHash)
+	if err != nil {
+		return err, false
+	}
+
+	return nil, tag.RowsAffected() == 1
+}
+
+// ResetPassword sets the new password and burns the token together with every other pending
+// reset token of the user. Following the link also proves the ownership of the email. SSO users
+// have no password to reset, so they cannot get a local one this way.
+func (r *PostgresRepository) ResetPassword(tokenHash, password string, at time.Time) (error, bool) {
+	const query = `
+	WITH token AS (
+		UPDATE avito_schema.email_tokens
+		SET used_at = $1
+		WHERE token_hash = $2
+		  AND purpose = 'reset_password'
+		  AND used_at IS NULL
+		  AND expires_at > $1
+		RETURNING user_id
+	), others AS (
+		UPDATE avito_schema.email_tokens t
+		SET used_at = $1
+		FROM token
+		WHERE t.user_id = token.user_id
+		  AND t.purpose = 'reset_password'
+		  AND t.token_hash <> $2
+		  AND t.used_at IS NULL
+	)
+	UPDATE avito_schema.users u
+	SET password_hash = $3,
+		email_verified_at = COALESCE(u.email_verified_at, $1)
+	FROM token
+	WHERE u.id = token.user_id
+	  AND u.password_hash <> '';
+	`
+
+	tag, err := r.Pool.Exec(r.requestContext(), query, at, tokenHash, password)
+	if err != nil {
+		return err, false
+	}
+
+	return nil, tag.RowsAffected() == 1
+}
+
+func (r *PostgresRepository) GetTOTP(userID string) (error, *domain.TOTP) {
+	const query = `SELECT COALESCE(totp_secret, ''), totp_enabled, COALESCE(totp_last_step, 0) FROM avito_schema.users WHERE id = $1`
+
+	var t domain.TOTP
+	err := r.Pool.QueryRow(r.readContext(), query, userID).Scan(&t.Secret, &t.Enabled, &t.LastStep)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &t
+}
+
+// SetTOTPSecret stores a new, not yet confirmed secret. Fails if 2FA is already enabled.
+func (r *PostgresRepository) SetTOTPSecret(userID, secret string) error {
+	const query = `
+	UPDATE avito_schema.users
+	SET totp_secret = $1,
+		totp_last_step = NULL
+	WHERE id = $2
+	  AND totp_enabled = false
+	RETURNING id;
+	`
+
+	var updatedID string
+	err := r.Pool.QueryRow(r.requestContext(), query, secret, userID).Scan(&updatedID)
+
+	return err
+}
+
+// EnableTOTP turns on 2FA and replaces the recovery codes in one statement.
+func (r *PostgresRepository) EnableTOTP(userID string, recoveryHashes []string) error {
+	const query = `
+	WITH enabled AS (
+		UPDATE avito_schema.users
+		SET totp_enabled = true
+		WHERE id = $1
+		  AND totp_secret IS NOT NULL
+		RETURNING id
+	), cleared AS (
+		DELETE FROM avito_schema.recovery_codes WHERE user_id = $1
+	), inserted AS (
+		INSERT INTO avito_schema.recovery_codes(user_id, code_hash)
+		SELECT enabled.id, code FROM enabled, unnest($2::text[]) AS code
+	)
+	SELECT id FROM enabled;
+	`
+
+	var enabledID string
+	err := r.Pool.QueryRow(r.requestContext(), query, userID, recoveryHashes).Scan(&enabledID)
+
+	return err
+}
+
+// UseTOTPStep records the step of an accepted code; returns false if it was already used.
+func (r *PostgresRepository) UseTOTPStep(userID string, step int64) (error, bool) {
+	const query = `
+	UPDATE avito_schema.users
+	SET totp_last_step = $1
+	WHERE id = $2
+	  AND (totp_last_step IS NULL OR totp_last_step < $1);
+	`
+
+	tag, err := r.Pool.Exec(r.requestContext(), query, step, userID)
+	if err != nil {
+		return err, false
+	}
+
+	return nil, tag.RowsAffected() == 1
+}
+
+func (r *PostgresRepository) UseRecoveryCode(userID, codeHash string, at time.Time) (error, bool) {
+	const query = `
+	UPDATE avito_schema.recovery_codes
+	SET used_at = $1
+	WHERE user_id = $2
+	  AND code_hash = $3
+	  AND used_at IS NULL;
+	`
+
+	tag, err := r.Pool.Exec(r.requestContext(), query, at, userID, codeHash)
+	if err != nil {
+		return err, false
+	}
+
+	return nil, tag.RowsAffected() == 1
+}
+
+// ResetTOTP disables 2FA and drops the secret and recovery codes, e.g. after a lost device.
+func (r *PostgresRepository) ResetTOTP(userID string) error {
+	const query = `
+	WITH reset AS (
+		UPDATE avito_schema.users
+		SET totp_secret = NULL,
+			totp_enabled = false,
+			totp_last_step = NULL
+		WHERE id = $1
+		RETURNING id
+	), cleared AS (
+		DELETE FROM avito_schema.recovery_codes WHERE user_id = $1
+	)
+	SELECT id FROM reset;
+	`
+
+	var resetID string
+	err := r.Pool.QueryRow(r.requestContext(), query, userID).Scan(&resetID)
+
+	return err
+}
+
+// LoginBlockedUntil returns the latest lock among the keys, or zero time if none is locked.
+func (r *PostgresRepository) LoginBlockedUntil(keys []string, now time.Time) (error, time.Time) {
+	const query = `
+	SELECT locked_until
+	  FROM avito_schema.login_attempts
+	 WHERE key = ANY($1)
+	   AND locked_until > $2
+	 ORDER BY locked_until DESC
+	 LIMIT 1;
+	`
+
+	var lockedUntil time.Time
+	err := r.Pool.QueryRow(r.readContext(), query, keys, now).Scan(&lockedUntil)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, time.Time{}
+	}
+
+	return err, lockedUntil
+}
+
+// RecordLoginFailure counts a failed login for the key and returns the number of failures
+// within the window, restarting the count when the previous failure is older than that.
+func (r *PostgresRepository) RecordLoginFailure(key string, now time.Time, window time.Duration) (error, int) {
+	const query = `
+	INSERT INTO avito_schema.login_attempts(key, failures, last_failure_at) VALUES($1, 1, $2)
+	ON CONFLICT (key) DO UPDATE
+	SET failures = CASE
+			WHEN login_attempts.last_failure_at < $2::timestamptz - make_interval(secs => $3) THEN 1
+			ELSE login_attempts.failures + 1
+		END,
+		last_failure_at = $2
+	RETURNING failures;
+	`
+
+	var failures int
+	err := r.Pool.QueryRow(r.requestContext(), query, key, now, window.Seconds()).Scan(&failures)
+
+	return err, failures
+}
+
+func (r *PostgresRepository) LockLogin(key string, until time.Time) error {
+	const query = `UPDATE avito_schema.login_attempts SET locked_until = $1 WHERE key = $2`
+	_, err := r.Pool.Exec(r.requestContext(), query, until, key)
+
+	return err
+}
+
+func (r *PostgresRepository) ResetLoginFailures(key string) error {
+	const query = `DELETE FROM avito_schema.login_attempts WHERE key = $1`
+	_, err := r.Pool.Exec(r.requestContext(), query, key)
+
+	return err
+}
+
+// UnlockUser clears failed attempts and the lock of the user's account key.
+func (r *PostgresRepository) UnlockUser(id string) error {
+	const query = `
+	WITH target AS (
+		SELECT 'email:' || lower(email) AS key FROM avito_schema.users WHERE id = $1
+	), cleared AS (
+		DELETE FROM avito_schema.login_attempts USING target WHERE login_attempts.key = target.key
+	)
+	SELECT key FROM target;
+	`
+
+	var key string
+	err := r.Pool.QueryRow(r.requestContext(), query, id).Scan(&key)
+
+	return err
+}
+
+// RegisterWithInvite creates the user with the role of the invite and marks the invite used
+// in one statement, so a failed registration does not burn the invite.
+func (r *PostgresRepository) RegisterWithInvite(email, password, inviteHash string, at time.Time) (error, string) {
+	const query = `
+	WITH invite AS (
+		UPDATE avito_schema.invites
+		SET used_at = $1
+		WHERE token_hash = $2
+		  AND used_at IS NULL
+		  AND expires_at > $1
+		  AND (email = '' OR email = $3)
+		RETURNING role
+	)
+	INSERT INTO avito_schema.users(id, email, password_hash, role, registration_date)
+	SELECT $4, $3, $5, role, $1 FROM invite
+	RETURNING role;
+	`
+
+	var role string
+	err := r.Pool.QueryRow(r.requestContext(), query, at, inviteHash, email, uuid.NewString(), password).Scan(&role)
+
+	return err, role
+}
+
+func (r *PostgresRepository) CreateInvite(inv *domain.Invite) error {
+	const query = `INSERT INTO avito_schema.invites(token_hash, email, role, created_by, expires_at) VALUES($1,$2,$3,$4,$5)`
+	_, err := r.Pool.Exec(r.requestContext(), query, inv.TokenHash, inv.Email, inv.Role, inv.CreatedBy, inv.ExpiresAt)
+
+	return err
+}
+
+// ListUsers searches users by email substring and role; empty filters match all.
+func (r *PostgresRepository) ListUsers(search, role string, limit, offset int) (error, []domain.User) {
+	const query = `
+	SELECT id, email, role, registration_date, deactivated_at
+	  FROM avito_schema.users
+	 WHERE ($1 = '' OR email ILIKE '%' || $1 || '%')
+	   AND ($2 = '' OR role = $2)
+	 ORDER BY registration_date DESC
+	 LIMIT $3 OFFSET $4;
+	`
+
+	rows, err := r.Pool.Query(r.readContext(), query, search, role, limit, offset)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	users := []domain.User{}
+	for rows.Next() {
+		var u domain.User
+		if err := rows.Scan(&u.ID, &u.Email, &u.Role, &u.RegistrationDate, &u.DeactivatedAt); err != nil {
+			return err, nil
+		}
+		users = append(users, u)
+	}
+
+	return rows.Err(), users
+}
+
+// SetUserActive deactivates the user at the given moment or clears the deactivation.
+func (r *PostgresRepository) SetUserActive(id string, active bool, at time.Time) error {
+	const query = `
+	UPDATE avito_schema.users
+	SET deactivated_at = CASE WHEN $1 THEN NULL ELSE $2::timestamptz END
+	WHERE id = $3
+	RETURNING id;
+	`
+
+	var updatedID string
+	err := r.Pool.QueryRow(r.requestContext(), query, active, at, id).Scan(&updatedID)
+
+	return err
+}
+
+func (r *PostgresRepository) ChangeUserRole(id, role string) error {
+	const query = `UPDATE avito_schema.users SET role = $1 WHERE id = $2 RETURNING id`
+
+	var updatedID string
+	err := r.Pool.QueryRow(r.requestContext(), query, role, id).Scan(&updatedID)
+
+	return err
+}
+
+// IsUserDeactivated reports whether the user exists and is deactivated. Unknown ids
+// (e.g. dummyLogin tokens) are not deactivated.
+func (r *PostgresRepository) IsUserDeactivated(id string) (error, bool) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, false
+	}
+
+	const query = `SELECT EXISTS (SELECT 1 FROM avito_schema.users WHERE id = $1 AND deactivated_at IS NOT NULL)`
+
+	var deactivated bool
+	err := r.Pool.QueryRow(r.readContext(), query, id).Scan(&deactivated)
+
+	return err, deactivated
+}
+
+// UserPermissions returns the permissions of the user's current role.
+func (r *PostgresRepository) UserPermissions(id string) (error, []string) {
+	const query = `
+	SELECT r.permissions
+	  FROM avito_schema.users u
+	  JOIN avito_schema.roles r ON r.name = u.role
+	 WHERE u.id = $1;
+	`
+
+	var permissions []string
+	err := r.Pool.QueryRow(r.readContext(), query, id).Scan(&permissions)
+
+	return err, permissions
+}
+
+func (r *PostgresRepository) RolePermissions(role string) (error, []string) {
+	const query = `SELECT permissions FROM avito_schema.roles WHERE name = $1`
+
+	var permissions []string
+	err := r.Pool.QueryRow(r.readContext(), query, role).Scan(&permissions)
+
+	return err, permissions
+}
+
+func (r *PostgresRepository) ListRoles() (error, []domain.Role) {
+	const query = `SELECT name, permissions, description FROM avito_schema.roles ORDER BY name`
+
+	rows, err := r.Pool.Query(r.readContext(), query)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	roles := []domain.Role{}
+	for rows.Next() {
+		var role domain.Role
+		if err := rows.Scan(&role.Name, &role.Permissions, &role.Description); err != nil {
+			return err, nil
+		}
+		roles = append(roles, role)
+	}
+
+	return rows.Err(), roles
+}
+
+// SaveRole creates the role or replaces the permission set of an existing one.
+func (r *PostgresRepository) SaveRole(role *domain.Role) error {
+	const query = `
+	INSERT INTO avito_schema.roles(name, permissions, description) VALUES($1,$2,$3)
+	ON CONFLICT (name) DO UPDATE
+	SET permissions = EXCLUDED.permissions,
+		description = EXCLUDED.description;
+	`
+	_, err := r.Pool.Exec(r.requestContext(), query, role.Name, role.Permissions, role.Description)
+
+	return err
+}
+
+func (r *PostgresRepository) AssignEmployee(a *domain.Assignment) error {
+	const query = `INSERT INTO avito_schema.assignments(id, user_id, pvz_id, valid_from, valid_to, created_by) VALUES($1,$2,$3,$4,$5,$6)`
+	_, err := r.Pool.Exec(r.requestContext(), query, a.ID, a.UserID, a.PVZID, a.ValidFrom, a.ValidTo, a.CreatedBy)
+
+	return err
+}
+
+// RevokeAssignment ends the assignment at the given moment, keeping it for history.
+func (r *PostgresRepository) RevokeAssignment(id string, at time.Time) error {
+	const query = `
+	UPDATE avito_schema.assignments
+	SET valid_to = GREATEST($1, valid_from + interval '1 microsecond')
+	WHERE id = $2
+	  AND (valid_to IS NULL OR valid_to > $1)
+	RETURNING id;
+	`
+
+	var revokedID string
+	err := r.Pool.QueryRow(r.requestContext(), query, at, id).Scan(&revokedID)
+
+	return err
+}
+
+// ListAssignments returns assignments filtered by user and/or PVZ; empty filters match all.
+func (r *PostgresRepository) ListAssignments(userID, PVZID string, limit, offset int) (error, []domain.Assignment) {
+	const query = `
+	SELECT id, user_id, pvz_id, valid_from, valid_to, created_by
+	  FROM avito_schema.assignments
+	 WHERE ($1 = '' OR user_id::text = $1)
+	   AND ($2 = '' OR pvz_id::text = $2)
+	 ORDER BY valid_from DESC
+	 LIMIT $3 OFFSET $4;
+	`
+
+	rows, err := r.Pool.Query(r.readContext(), query, userID, PVZID, limit, offset)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	assignments := []domain.Assignment{}
+	for rows.Next() {
+		var a domain.Assignment
+		if err := rows.Scan(&a.ID, &a.UserID, &a.PVZID, &a.ValidFrom, &a.ValidTo, &a.CreatedBy); err != nil {
+			return err, nil
+		}
+		assignments = append(assignments, a)
+	}
+
+	return rows.Err(), assignments
+}
+
+// IsAssigned reports whether the user has an assignment to the PVZ valid at the given moment.
+func (r *PostgresRepository) IsAssigned(userID, PVZID string, at time.Time) (error, bool) {
+	const query = `
+	SELECT EXISTS (
+		SELECT 1
+		  FROM avito_schema.assignments
+		 WHERE user_id = $1
+		   AND pvz_id = $2
+		   AND valid_from <= $3
+		   AND (valid_to IS NULL OR valid_to > $3)
+	);
+	`
+
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, false
+	}
+	if _, err := uuid.Parse(PVZID); err != nil {
+		return nil, false
+	}
+
+	var assigned bool
+	err := r.Pool.QueryRow(r.readContext(), query, userID, PVZID, at).Scan(&assigned)
+
+	return err, assigned
 }
 
-func New(pool interfaces.PgxPoolIface) *PostgresRepository {
-	return &PostgresRepository{
-		Pool:        pool,
-		mu:          sync.RWMutex{},
-		poolChannel: make(chan struct{}, poolSize),
+func (r *PostgresRepository) CreateAPIKey(k *domain.APIKey) error {
+	const query = `
+	INSERT INTO avito_schema.api_keys(id, name, key_hash, permissions, pvz_ids, created_by, created_at, expires_at)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8);
+	`
+	_, err := r.Pool.Exec(r.requestContext(), query,
+		k.ID, k.Name, k.KeyHash, k.Permissions, k.PVZIDs, k.CreatedBy, k.CreatedAt, k.ExpiresAt)
+
+	return err
+}
+
+func (r *PostgresRepository) ListAPIKeys(limit, offset int) (error, []domain.APIKey) {
+	const query = `
+	SELECT id, name, permissions, pvz_ids, created_by, created_at, expires_at, last_used_at, revoked_at
+	  FROM avito_schema.api_keys
+	 ORDER BY created_at DESC
+	 LIMIT $1 OFFSET $2;
+	`
+
+	rows, err := r.Pool.Query(r.readContext(), query, limit, offset)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	keys := []domain.APIKey{}
+	for rows.Next() {
+		var k domain.APIKey
+		err := rows.Scan(&k.ID, &k.Name, &k.Permissions, &k.PVZIDs, &k.CreatedBy, &k.CreatedAt,
+			&k.ExpiresAt, &k.LastUsedAt, &k.RevokedAt)
+		if err != nil {
+			return err, nil
+		}
+		keys = append(keys, k)
 	}
+
+	return rows.Err(), keys
 }
 
-func (r *PostgresRepository) Register(email, password, role string) error {
-	id := uuid.NewString()
-	const query = `INSERT INTO avito_schema.users(id,email,password_hash,role,registration_date) VALUES($1,$2,$3,$4,$5)`
-	_, err := r.Pool.Exec(context.Background(), query, id, email, password, role, time.Now())
+func (r *PostgresRepository) RevokeAPIKey(id string, at time.Time) error {
+	const query = `
+	UPDATE avito_schema.api_keys
+	SET revoked_at = $1
+	WHERE id::text = $2
+	  AND revoked_at IS NULL
+	RETURNING id;
+	`
+
+	var revokedID string
+	err := r.Pool.QueryRow(r.requestContext(), query, at, id).Scan(&revokedID)
 
 	return err
 }
 
-func (r *PostgresRepository) Login(email string) (error, *domain.User) {
-	var user domain.User
-	const query = `SELECT id,password_hash,role FROM avito_schema.users WHERE email=$1`
-	row := r.Pool.QueryRow(context.Background(), query, email)
-	err := row.Scan(&user.ID, &user.PasswordHash, &user.Role)
+// UseAPIKey returns the active key with the hash and records when it was last used.
+// Returns a nil key if the key is unknown, expired or revoked.
+func (r *PostgresRepository) UseAPIKey(keyHash string, at time.Time) (error, *domain.APIKey) {
+	const query = `
+	UPDATE avito_schema.api_keys
+	SET last_used_at = $1
+	WHERE key_hash = $2
+	  AND revoked_at IS NULL
+	  AND (expires_at IS NULL OR expires_at > $1)
+	RETURNING id, name, permissions, pvz_ids, created_by, created_at, expires_at, last_used_at;
+	`
 
-	return err, &user
+	var k domain.APIKey
+	err := r.Pool.QueryRow(r.requestContext(), query, at, keyHash).
+		Scan(&k.ID, &k.Name, &k.Permissions, &k.PVZIDs, &k.CreatedBy, &k.CreatedAt, &k.ExpiresAt, &k.LastUsedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &k
+}
+
+// StartIdempotentRequest claims the key for a new request and returns nil, or returns the
+// record of the earlier request with the key. Expired records are claimed anew.
+func (r *PostgresRepository) StartIdempotentRequest(subject, key, requestHash string, now, expiresAt time.Time) (error, *domain.IdempotencyRecord) {
+	const claim = `
+	INSERT INTO avito_schema.idempotency_keys(subject, key, request_hash, created_at, expires_at)
+	VALUES($1, $2, $3, $4, $5)
+	ON CONFLICT (subject, key) DO UPDATE
+	SET request_hash = EXCLUDED.request_hash,
+		status_code = NULL,
+		content_type = '',
+		response = NULL,
+		created_at = EXCLUDED.created_at,
+		expires_at = EXCLUDED.expires_at
+	WHERE idempotency_keys.expires_at <= EXCLUDED.created_at;
+	`
+	tag, err := r.Pool.Exec(r.requestContext(), claim, subject, key, requestHash, now, expiresAt)
+	if err != nil {
+		return err, nil
+	}
+	if tag.RowsAffected() == 1 {
+		return nil, nil
+	}
+
+	const query = `
+	SELECT request_hash, status_code IS NOT NULL, COALESCE(status_code, 0), content_type, COALESCE(response, '')
+	  FROM avito_schema.idempotency_keys
+	 WHERE subject = $1 AND key = $2;
+	`
+	var rec domain.IdempotencyRecord
+	err = r.Pool.QueryRow(r.readContext(), query, subject, key).
+		Scan(&rec.RequestHash, &rec.Completed, &rec.StatusCode, &rec.ContentType, &rec.Body)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &rec
+}
+
+func (r *PostgresRepository) CompleteIdempotentRequest(subject, key string, record *domain.IdempotencyRecord) error {
+	const query = `
+	UPDATE avito_schema.idempotency_keys
+	SET status_code = $1, content_type = $2, response = $3
+	WHERE subject = $4 AND key = $5;
+	`
+	_, err := r.Pool.Exec(r.requestContext(), query, record.StatusCode, record.ContentType, record.Body, subject, key)
+
+	return err
+}
+
+// ReleaseIdempotentRequest forgets a request that failed, so that a retry runs it again.
+func (r *PostgresRepository) ReleaseIdempotentRequest(subject, key string) error {
+	const query = `DELETE FROM avito_schema.idempotency_keys WHERE subject = $1 AND key = $2 AND status_code IS NULL`
+	_, err := r.Pool.Exec(r.requestContext(), query, subject, key)
+
+	return err
+}
+
+func (r *PostgresRepository) DeleteExpiredIdempotencyKeys(now time.Time) (error, int64) {
+	const query = `DELETE FROM avito_schema.idempotency_keys WHERE expires_at <= $1`
+	tag, err := r.Pool.Exec(r.requestContext(), query, now)
+	if err != nil {
+		return err, 0
+	}
+
+	return nil, tag.RowsAffected()
 }
 
 func (r *PostgresRepository) CreatePVZ(city, id string, regTime time.Time) error {
 	const query = `INSERT INTO avito_schema.pvz(id, city, registration_date, is_reception_open, receptions) VALUES($1,$2,$3,$4,$5)`
-	_, err := r.Pool.Exec(context.Background(), query, id, city, regTime, false, "[]")
+	_, err := r.Pool.Exec(r.requestContext(), query, id, city, regTime, false, "[]")
+
+	return err
+}
+
+// GetPVZ returns the PVZ with its current version and last reception.
+func (r *PostgresRepository) GetPVZ(PVZID string) (error, *domain.PVZ) {
+	const query = `SELECT id, city, registration_date, version, receptions->-1 FROM avito_schema.pvz WHERE id = $1`
+
+	var p domain.PVZ
+	err := r.Pool.QueryRow(r.readContext(), query, PVZID).Scan(&p.ID, &p.City, &p.RegistrationDate, &p.Version, &p.LastReception)
+	if err != nil {
+		return err, nil
+	}
+
+	return nil, &p
+}
+
+func (r *PostgresRepository) PVZVersion(PVZID string) (error, int64) {
+	const query = `SELECT version FROM avito_schema.pvz WHERE id = $1`
+
+	var version int64
+	err := r.Pool.QueryRow(r.readContext(), query, PVZID).Scan(&version)
+
+	return err, version
+}
+
+// versionConflict tells a conditional update that matched no rows because of a stale version
+// apart from one that failed on the reception state. A zero ifVersion means no condition.
+func (r *PostgresRepository) versionConflict(err error, PVZID string, ifVersion int64) error {
+	if ifVersion == 0 || !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	verr, version := r.PVZVersion(PVZID)
+	if verr == nil && version != ifVersion {
+		return domain.ErrVersionMismatch
+	}
 
 	return err
 }
@@ -59,57 +876,62 @@ type receptionJson struct {
 	PvzID    string        `json:"pvz_id"`
 	OpenAt   time.Time     `json:"open_at"`
 	ClosedAt string        `json:"closed_at"`
-	Products []interface{} `json:"products"`
+	Products []productJson `json:"products"`
 }
 
-func (r *PostgresRepository) CreateReception(PVZID string, id string, dateTime time.Time) (error, *json.RawMessage) {
+func (r *PostgresRepository) CreateReception(PVZID string, id string, dateTime time.Time, ifVersion int64) (error, *json.RawMessage, int64) {
 	rec := receptionJson{
 		ID:       id,
 		PvzID:    PVZID,
 		OpenAt:   dateTime,
 		ClosedAt: "",
-		Products: []interface{}{},
+		Products: []productJson{},
 	}
 	recJSON, err := json.Marshal(rec)
 	if err != nil {
-		log.Fatal(err)
+		return err, nil, 0
 	}
 
 	const query = `
 	UPDATE avito_schema.pvz
 	SET is_reception_open = $1,
-		receptions = receptions || $2::jsonb
+		receptions = receptions || $2::jsonb,
+		version = version + 1
 	WHERE id = $3
 	  AND is_reception_open = false
-	RETURNING receptions->-1;
+	  AND ($4::bigint = 0 OR version = $4::bigint)
+	RETURNING receptions->-1, version;
 	`
 
 	var lastElem json.RawMessage
-	err = r.Pool.QueryRow(context.Background(), query, true, recJSON, PVZID).Scan(&lastElem)
+	var version int64
+	err = r.Pool.QueryRow(r.requestContext(), query, true, recJSON, PVZID, ifVersion).Scan(&lastElem, &version)
 	if err != nil {
-		log.Fatal("Update failed or no rows affected:", err)
+		return r.versionConflict(err, PVZID, ifVersion), nil, 0
 	}
 
-	return err, &lastElem
+	return nil, &lastElem, version
 }
 
 type productJson struct {
 	ID          string    `json:"id"`
 	DateTime    time.Time `json:"dateTime"`
 	Type        string    `json:"type"`
+	Barcode     string    `json:"barcode,omitempty"`
 	ReceptionID string    `json:"receptionId"`
 }
 
-func (r *PostgresRepository) AddProduct(id string, dateTime time.Time, prodType, PVZID string) (error, *json.RawMessage) {
+func (r *PostgresRepository) AddProduct(id string, dateTime time.Time, prodType, barcode, PVZID string, ifVersion int64) (error, *json.RawMessage, int64) {
 	prod := productJson{
 		ID:          id,
 		DateTime:    dateTime,
 		Type:        prodType,
+		Barcode:     barcode,
 		ReceptionID: "",
 	}
 	prodJSON, err := json.Marshal(prod)
 	if err != nil {
-		log.Fatal(err)
+		return err, nil, 0
 	}
 
 	const query = `
@@ -119,37 +941,41 @@ func (r *PostgresRepository) AddProduct(id string, dateTime time.Time, prodType,
 		'{-1,products,-1}',
 		$1::jsonb,
 		true
-	)
+	),
+		version = version + 1
 	WHERE id = $2
 	  AND is_reception_open = true
+	  AND ($3::bigint = 0 OR version = $3::bigint)
 	RETURNING
 	  receptions->-1->>'id'         AS reception_id,
-	  receptions->-1->'products'->-1 AS last_product;
+	  receptions->-1->'products'->-1 AS last_product,
+	  version;
 	`
 
 	var lastProduct json.RawMessage
 	var receptionID string
-	err = r.Pool.QueryRow(context.Background(), query, prodJSON, PVZID).Scan(&receptionID, &lastProduct)
+	var version int64
+	err = r.Pool.QueryRow(r.requestContext(), query, prodJSON, PVZID, ifVersion).Scan(&receptionID, &lastProduct, &version)
 	if err != nil {
-		log.Fatalf("update failed or no rows returned: %v", err)
+		return r.versionConflict(err, PVZID, ifVersion), nil, 0
 	}
 
 	var p productJson
 	if err := json.Unmarshal(lastProduct, &p); err != nil {
-		return err, nil
+		return err, nil, 0
 	}
 	p.ReceptionID = receptionID
 
 	updatedJSON, err := json.Marshal(p)
 	if err != nil {
-		return err, nil
+		return err, nil, 0
 	}
 	updatedRaw := json.RawMessage(updatedJSON)
 
-	return err, &updatedRaw
+	return nil, &updatedRaw, version
 }
 
-func (r *PostgresRepository) DeleteLastProduct(PVZID string) error {
+func (r *PostgresRepository) DeleteLastProduct(PVZID string, ifVersion int64) (error, int64) {
 	const query = `
 	UPDATE avito_schema.pvz
 	SET receptions = jsonb_set(
@@ -157,46 +983,473 @@ func (r *PostgresRepository) DeleteLastProduct(PVZID string) error {
 		'{-1,products}',
 		(receptions->-1->'products') - (-1),
 		false
-	)
+	),
+		version = version + 1
 	WHERE id = $1
 	  AND is_reception_open = $2
 	  AND jsonb_array_length(receptions->-1->'products') != 0
-	RETURNING id;
+	  AND ($3::bigint = 0 OR version = $3::bigint)
+	RETURNING version;
 	`
 
-	var updatedID string
-	err := r.Pool.QueryRow(context.Background(), query, PVZID, true).Scan(&updatedID)
+	var version int64
+	err := r.Pool.QueryRow(r.requestContext(), query, PVZID, true, ifVersion).Scan(&version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), 0
+	}
 
-	return err
+	return nil, version
 }
 
-func (r *PostgresRepository) CloseLastReception(PVZID string, closedAt time.Time) error {
+// CloseLastReception closes the open reception and binds the pending manifest to it in the
+// same statement. It returns the id of the closed reception.
+func (r *PostgresRepository) CloseLastReception(PVZID string, closedAt time.Time, ifVersion int64) (error, string, int64) {
 	const query = `
-	UPDATE avito_schema.pvz
-	SET
-		is_reception_open = $1,
-		receptions = jsonb_set(
-			receptions,
-			'{-1,closed_at}',
-			to_jsonb($2::text),
-			false
-		)
-	WHERE id = $3
-	  AND is_reception_open = $4
-	RETURNING id;
+	WITH closed AS (
+		UPDATE avito_schema.pvz
+		SET
+			is_reception_open = false,
+			receptions = jsonb_set(
+				receptions,
+				'{-1,closed_at}',
+				to_jsonb($1::text),
+				false
+			),
+			version = version + 1
+		WHERE id = $2
+		  AND is_reception_open = true
+		  AND ($3::bigint = 0 OR version = $3::bigint)
+		RETURNING id AS pvz_id, (receptions->-1->>'id')::uuid AS reception_id, version
+	)` + bindPendingManifest + `
+	SELECT reception_id, version FROM closed;
 `
 
 	closedAtStr := closedAt.Format("2006-01-02 15:04:05.999999")
 
-	var updatedID string
-	err := r.Pool.QueryRow(context.Background(), query, false, closedAtStr, PVZID, true).Scan(&updatedID)
+	var (
+		receptionID string
+		version     int64
+	)
+	err := r.Pool.QueryRow(r.requestContext(), query, closedAtStr, PVZID, ifVersion).Scan(&receptionID, &version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), "", 0
+	}
 
-	return err
+	return nil, receptionID, version
+}
+
+// bindPendingManifest follows a "closed" CTE of (pvz_id, reception_id) rows and binds the newest
+// pending manifest of each PVZ to the reception closed by the same statement, so a reception
+// opened right after cannot take it. A reopened reception keeps the manifest it was bound to.
+// ReconcileManifest then stores the report.
+const bindPendingManifest = `, bound AS (
+		UPDATE avito_schema.manifests
+		SET reception_id = closed.reception_id
+		FROM closed
+		WHERE NOT EXISTS (
+			SELECT 1 FROM avito_schema.manifests b WHERE b.reception_id = closed.reception_id
+		)
+		  AND manifests.id = (
+			SELECT pending.id
+			  FROM avito_schema.manifests pending
+			 WHERE pending.pvz_id = closed.pvz_id
+			   AND pending.reception_id IS NULL
+			 ORDER BY pending.uploaded_at DESC
+			 LIMIT 1
+		)
+	)`
+
+// CloseStaleReceptions closes open receptions without activity (last product or opening)
+// for longer than the PVZ timeout, falling back to idleTimeout. The whole job runs as one
+// statement under a transaction advisory lock, so only one replica closes receptions at a time.
+func (r *PostgresRepository) CloseStaleReceptions(now time.Time, idleTimeout time.Duration) (error, []domain.ReceptionEvent) {
+	const query = `
+	WITH leader AS (
+		SELECT pg_try_advisory_xact_lock($1) AS locked
+	), stale AS (
+		SELECT pvz.id
+		  FROM avito_schema.pvz, leader
+		 WHERE leader.locked
+		   AND pvz.is_reception_open = true
+		   AND GREATEST(
+				(pvz.receptions->-1->>'open_at')::timestamptz,
+				COALESCE((pvz.receptions->-1->'products'->-1->>'dateTime')::timestamptz, '-infinity')
+			) < $2::timestamptz - COALESCE(pvz.reception_idle_timeout, make_interval(secs => $3))
+		   FOR UPDATE OF pvz SKIP LOCKED
+	), closed AS (
+		UPDATE avito_schema.pvz
+		SET is_reception_open = false,
+			receptions = jsonb_set(
+				jsonb_set(receptions, '{-1,closed_at}', to_jsonb($4::text), false),
+				'{-1,auto_closed}',
+				'true'::jsonb
+			),
+			version = pvz.version + 1
+		FROM stale
+		WHERE pvz.id = stale.id
+		RETURNING pvz.id AS pvz_id, (pvz.receptions->-1->>'id')::uuid AS reception_id
+	)` + bindPendingManifest + `
+	INSERT INTO avito_schema.reception_events(id, pvz_id, reception_id, type, created_at)
+	SELECT gen_random_uuid(), pvz_id, reception_id, $5, $2 FROM closed
+	RETURNING id, pvz_id, reception_id, type, created_at;
+	`
+
+	closedAtStr := now.Format("2006-01-02 15:04:05.999999")
+	rows, err := r.Pool.Query(r.requestContext(), query,
+		staleReceptionsLockKey, now, idleTimeout.Seconds(), closedAtStr, domain.ReceptionEventAutoClosed)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	var events []domain.ReceptionEvent
+	for rows.Next() {
+		var e domain.ReceptionEvent
+		if err := rows.Scan(&e.ID, &e.PVZID, &e.ReceptionID, &e.Type, &e.CreatedAt); err != nil {
+			return err, nil
+		}
+		events = append(events, e)
+	}
+
+	return rows.Err(), events
+}
+
+// SetReceptionTimeout overrides the idle timeout of a PVZ; zero restores the global value.
+func (r *PostgresRepository) SetReceptionTimeout(PVZID string, timeout time.Duration, ifVersion int64) (error, int64) {
+	const query = `
+	UPDATE avito_schema.pvz
+	SET reception_idle_timeout = CASE WHEN $1::float8 > 0 THEN make_interval(secs => $1::float8) END,
+		version = version + 1
+	WHERE id = $2
+	  AND ($3::bigint = 0 OR version = $3::bigint)
+	RETURNING version;
+	`
+
+	var version int64
+	err := r.Pool.QueryRow(r.requestContext(), query, timeout.Seconds(), PVZID, ifVersion).Scan(&version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), 0
+	}
+
+	return nil, version
+}
+
+// UploadManifest stores a manifest and bumps the PVZ version, since the pending manifest is
+// part of what the manifest report is built from.
+func (r *PostgresRepository) UploadManifest(PVZID, id string, items []domain.ManifestItem, uploadedAt time.Time, ifVersion int64) (error, int64) {
+	itemsJSON, err := json.Marshal(items)
+	if err != nil {
+		return err, 0
+	}
+
+	const query = `
+	WITH bumped AS (
+		UPDATE avito_schema.pvz
+		SET version = version + 1
+		WHERE id = $2
+		  AND ($5::bigint = 0 OR version = $5::bigint)
+		RETURNING version
+	)
+	INSERT INTO avito_schema.manifests(id, pvz_id, uploaded_at, items)
+	SELECT $1, $2, $3, $4 FROM bumped
+	RETURNING (SELECT version FROM bumped);
+	`
+
+	var version int64
+	err = r.Pool.QueryRow(r.requestContext(), query, id, PVZID, uploadedAt, itemsJSON, ifVersion).Scan(&version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), 0
+	}
+
+	return nil, version
+}
+
+// ManifestReport matches the products of the open reception against its manifest without
+// consuming it: the one still bound to a reopened reception, else the pending one. Returns a
+// nil report when there is no such manifest for the PVZ.
+func (r *PostgresRepository) ManifestReport(PVZID string) (error, *domain.DiscrepancyReport) {
+	return r.buildReport(PVZID)
+}
+
+// ReconcileManifest stores and returns the discrepancy report of the manifest bound to the
+// reception when it was closed; nil if no manifest was pending then. The binding is done by the
+// close itself, so a failed reconcile loses only the report and can be run again.
+func (r *PostgresRepository) ReconcileManifest(PVZID, receptionID string) (error, *domain.DiscrepancyReport) {
+	const manifestQuery = `
+	SELECT id, uploaded_at, items
+	  FROM avito_schema.manifests
+	 WHERE pvz_id = $1
+	   AND reception_id = $2;
+	`
+	err, manifest := r.manifest(manifestQuery, PVZID, receptionID)
+	if err != nil || manifest == nil {
+		return err, nil
+	}
+
+	const receptionQuery = `
+	SELECT rec
+	  FROM avito_schema.pvz, jsonb_array_elements(pvz.receptions) rec
+	 WHERE pvz.id = $1
+	   AND rec->>'id' = $2;
+	`
+	var recJSON json.RawMessage
+	if err := r.Pool.QueryRow(r.readContext(), receptionQuery, PVZID, receptionID).Scan(&recJSON); err != nil {
+		return err, nil
+	}
+	var rec receptionJson
+	if err := json.Unmarshal(recJSON, &rec); err != nil {
+		return err, nil
+	}
+
+	report := domain.NewDiscrepancyReport(manifest, rec.ID, rec.products())
+	reportJSON, err := json.Marshal(report)
+	if err != nil {
+		return err, nil
+	}
+
+	const query = `UPDATE avito_schema.manifests SET report = $1::jsonb WHERE id = $2;`
+	if _, err := r.Pool.Exec(r.requestContext(), query, reportJSON, manifest.ID); err != nil {
+		return err, nil
+	}
+
+	return nil, report
+}
+
+func (r *PostgresRepository) buildReport(PVZID string) (error, *domain.DiscrepancyReport) {
+	err, manifest := r.pendingManifest(PVZID)
+	if err != nil || manifest == nil {
+		return err, nil
+	}
+
+	err, rec := r.lastReception(PVZID)
+	if err != nil {
+		return err, nil
+	}
+	if rec.ClosedAt != "" {
+		rec = &receptionJson{}
+	}
+
+	return nil, domain.NewDiscrepancyReport(manifest, rec.ID, rec.products())
+}
+
+// pendingManifest is the manifest the open reception is matched against: the one bound to it
+// before it was reopened, else the newest pending one.
+func (r *PostgresRepository) pendingManifest(PVZID string) (error, *domain.Manifest) {
+	const query = `
+	SELECT m.id, m.uploaded_at, m.items
+	  FROM avito_schema.manifests m
+	  JOIN avito_schema.pvz p ON p.id = m.pvz_id
+	 WHERE m.pvz_id = $1
+	   AND (m.reception_id IS NULL
+	        OR (p.is_reception_open AND m.reception_id = (p.receptions->-1->>'id')::uuid))
+	 ORDER BY m.reception_id IS NULL, m.uploaded_at DESC
+	 LIMIT 1;
+	`
+
+	return r.manifest(query, PVZID)
+}
+
+// manifest scans the manifest of the PVZ in args[0] selected by query; nil if there is none.
+func (r *PostgresRepository) manifest(query string, args ...interface{}) (error, *domain.Manifest) {
+	manifest := domain.Manifest{PVZID: args[0].(string)}
+	var items json.RawMessage
+	err := r.Pool.QueryRow(r.readContext(), query, args...).Scan(&manifest.ID, &manifest.UploadedAt, &items)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return err, nil
+	}
+	if err := json.Unmarshal(items, &manifest.Items); err != nil {
+		return err, nil
+	}
+
+	return nil, &manifest
+}
+
+func (r *PostgresRepository) lastReception(PVZID string) (error, *receptionJson) {
+	const query = `SELECT receptions->-1 FROM avito_schema.pvz WHERE id = $1`
+
+	var lastElem json.RawMessage
+	err := r.Pool.QueryRow(r.readContext(), query, PVZID).Scan(&lastElem)
+	if err != nil {
+		return err, nil
+	}
+
+	var rec receptionJson
+	if len(lastElem) != 0 {
+		if err := json.Unmarshal(lastElem, &rec); err != nil {
+			return err, nil
+		}
+	}
+
+	return nil, &rec
+}
+
+func (rec *receptionJson) products() []domain.Product {
+	products := make([]domain.Product, 0, len(rec.Products))
+	for _, p := range rec.Products {
+		products = append(products, domain.Product{
+			ID:          p.ID,
+			ReceptionID: rec.ID,
+			Type:        p.Type,
+			Barcode:     p.Barcode,
+			DateTime:    p.DateTime,
+		})
+	}
+
+	return products
+}
+
+// ForceCloseReception closes the open reception on behalf of a moderator and records
+// the reason in the reception history.
+func (r *PostgresRepository) ForceCloseReception(PVZID string, closedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	const query = `
+	WITH closed AS (
+		UPDATE avito_schema.pvz
+		SET is_reception_open = false,
+			receptions = jsonb_set(
+				jsonb_set(receptions, '{-1,closed_at}', to_jsonb($1::text), false),
+				'{-1,force_closed}',
+				'true'::jsonb
+			),
+			version = version + 1
+		WHERE id = $2
+		  AND is_reception_open = true
+		  AND ($8::bigint = 0 OR version = $8::bigint)
+		RETURNING id AS pvz_id, (receptions->-1->>'id')::uuid AS reception_id, version
+	)` + bindPendingManifest + `
+	INSERT INTO avito_schema.reception_events(id, pvz_id, reception_id, type, reason, actor, created_at)
+	SELECT $3, pvz_id, reception_id, $4, $5, $6, $7 FROM closed
+	RETURNING reception_id, (SELECT version FROM closed);
+	`
+
+	event := domain.ReceptionEvent{
+		ID:        uuid.NewString(),
+		PVZID:     PVZID,
+		Type:      domain.ReceptionEventForceClosed,
+		Reason:    reason,
+		Actor:     actor,
+		CreatedAt: closedAt,
+	}
+	closedAtStr := closedAt.Format("2006-01-02 15:04:05.999999")
+	var version int64
+	err := r.Pool.QueryRow(r.requestContext(), query,
+		closedAtStr, PVZID, event.ID, event.Type, reason, actor, closedAt, ifVersion).Scan(&event.ReceptionID, &version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), nil, 0
+	}
+
+	return nil, &event, version
+}
+
+// ReopenLastReception reopens the last closed reception for corrections. A manifest
+// reconciled against it stays bound and only loses its report, so the next close rebuilds the
+// report for the same manifest while a manifest uploaded in between stays pending.
+func (r *PostgresRepository) ReopenLastReception(PVZID string, reopenedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64) {
+	const query = `
+	WITH reopened AS (
+		UPDATE avito_schema.pvz
+		SET is_reception_open = true,
+			receptions = jsonb_set(
+				receptions #- '{-1,auto_closed}' #- '{-1,force_closed}',
+				'{-1,closed_at}',
+				'""'::jsonb,
+				false
+			),
+			version = version + 1
+		WHERE id = $1
+		  AND is_reception_open = false
+		  AND jsonb_array_length(receptions) > 0
+		  AND ($7::bigint = 0 OR version = $7::bigint)
+		RETURNING id, (receptions->-1->>'id')::uuid AS reception_id, version
+	), unreported AS (
+		UPDATE avito_schema.manifests
+		SET report = NULL
+		FROM reopened
+		WHERE manifests.reception_id = reopened.reception_id
+	)
+	INSERT INTO avito_schema.reception_events(id, pvz_id, reception_id, type, reason, actor, created_at)
+	SELECT $2, id, reception_id, $3, $4, $5, $6 FROM reopened
+	RETURNING reception_id, (SELECT version FROM reopened);
+	`
+
+	event := domain.ReceptionEvent{
+		ID:        uuid.NewString(),
+		PVZID:     PVZID,
+		Type:      domain.ReceptionEventReopened,
+		Reason:    reason,
+		Actor:     actor,
+		CreatedAt: reopenedAt,
+	}
+	var version int64
+	err := r.Pool.QueryRow(r.requestContext(), query,
+		PVZID, event.ID, event.Type, reason, actor, reopenedAt, ifVersion).Scan(&event.ReceptionID, &version)
+	if err != nil {
+		return r.versionConflict(err, PVZID, ifVersion), nil, 0
+	}
+
+	return nil, &event, version
+}
+
+// OpenReceptions lists the open receptions with their PVZ city, for the KPI gauges.
+func (r *PostgresRepository) OpenReceptions() (error, []domain.OpenReception) {
+	const query = `
+	SELECT id, city, (receptions->-1->>'open_at')::timestamptz, jsonb_array_length(receptions->-1->'products')
+	  FROM avito_schema.pvz
+	 WHERE is_reception_open = true;
+	`
+
+	rows, err := r.reader().Query(r.readContext(), query)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	var open []domain.OpenReception
+	for rows.Next() {
+		var o domain.OpenReception
+		if err := rows.Scan(&o.PVZID, &o.City, &o.OpenedAt, &o.Products); err != nil {
+			return err, nil
+		}
+		open = append(open, o)
+	}
+
+	return rows.Err(), open
+}
+
+// ReceptionEvents reads from the primary: the handler tags the page with the PVZ version read
+// there, and a lagging replica would serve an older page under the newer ETag.
+func (r *PostgresRepository) ReceptionEvents(PVZID string, limit, offset int) (error, []domain.ReceptionEvent) {
+	const query = `
+	SELECT id, pvz_id, reception_id, type, reason, actor, created_at
+	  FROM avito_schema.reception_events
+	 WHERE pvz_id = $1
+	 ORDER BY created_at DESC
+	 LIMIT $2 OFFSET $3;
+	`
+
+	rows, err := r.Pool.Query(r.readContext(), query, PVZID, limit, offset)
+	if err != nil {
+		return err, nil
+	}
+	defer rows.Close()
+
+	events := []domain.ReceptionEvent{}
+	for rows.Next() {
+		var e domain.ReceptionEvent
+		if err := rows.Scan(&e.ID, &e.PVZID, &e.ReceptionID, &e.Type, &e.Reason, &e.Actor, &e.CreatedAt); err != nil {
+			return err, nil
+		}
+		events = append(events, e)
+	}
+
+	return rows.Err(), events
 }
 
 func (r *PostgresRepository) ListPVZ(endStr, startStr string, limit, offset int) (error, *[]domain.PVZ) {
 	const sqlQuery = `
-	SELECT id, city, registration_date
+	SELECT id, city, registration_date, version
 	  FROM avito_schema.pvz
 	 WHERE EXISTS (
 		 SELECT 1
@@ -206,14 +1459,14 @@ func (r *PostgresRepository) ListPVZ(endStr, startStr string, limit, offset int)
 	 )
 	 LIMIT $3 OFFSET $4;
 `
-	rows, err := r.Pool.Query(context.Background(), sqlQuery, endStr, startStr, limit, offset)
+	rows, err := r.reader().Query(r.readContext(), sqlQuery, endStr, startStr, limit, offset)
 
 	defer rows.Close()
 
 	var result []domain.PVZ
 	for rows.Next() {
 		var p domain.PVZ
-		err = rows.Scan(&p.ID, &p.City, &p.RegistrationDate)
+		err = rows.Scan(&p.ID, &p.City, &p.RegistrationDate, &p.Version)
 		if err != nil {
 			continue
 		}
@@ -236,7 +1489,7 @@ func (r *PostgresRepository) GrpcListPVz(endPeriod, startPeriod string, limit, o
 	 LIMIT $3 OFFSET $4;
 `
 
-	rows, err := r.Pool.Query(context.Background(), sqlQuery, endPeriod, startPeriod, limit, offset)
+	rows, err := r.reader().Query(r.readContext(), sqlQuery, endPeriod, startPeriod, limit, offset)
 
 	defer rows.Close()
 
@@ -2,8 +2,10 @@ package db_test
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"reflect"
 	"strings"
 	"testing"
@@ -13,8 +15,16 @@ import (
 	pgproto32 "github.com/jackc/pgproto3/v2"
 	"github.com/jackc/pgx/v4"
 
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
 	"AvitoPVZService/Service/internal/domain"
+	"AvitoPVZService/Service/internal/metrics"
 	db "AvitoPVZService/Service/internal/repositories/db"
+	"AvitoPVZService/Service/internal/tracing"
 )
 
 type mockPool struct {
@@ -73,6 +83,8 @@ func (m *mockRows) Scan(dest ...interface{}) error {
 			*dd = row[i].(string)
 		case *time.Time:
 			*dd = row[i].(time.Time)
+		case *int64:
+			*dd = row[i].(int64)
 		default:
 			return fmt.Errorf("unsupported scan type %T", dd)
 		}
@@ -152,13 +164,13 @@ func TestDeleteLastProduct_Success(t *testing.T) {
 	mock := &mockPool{
 		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
 			return &mockRow{scanFunc: func(dest ...interface{}) error {
-				*(dest[0].(*string)) = "deleted-id"
+				*(dest[0].(*int64)) = 2
 				return nil
 			}}
 		},
 	}
 	repo := db.New(mock)
-	if err := repo.DeleteLastProduct("pvz1"); err != nil {
+	if err, _ := repo.DeleteLastProduct("pvz1", 0); err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
 }
@@ -167,21 +179,26 @@ func TestCloseLastReception_Success(t *testing.T) {
 	mock := &mockPool{
 		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
 			return &mockRow{scanFunc: func(dest ...interface{}) error {
-				*(dest[0].(*string)) = "pvz1"
+				*(dest[0].(*string)) = "rec1"
+				*(dest[1].(*int64)) = 2
 				return nil
 			}}
 		},
 	}
 	repo := db.New(mock)
-	if err := repo.CloseLastReception("pvz1", time.Now()); err != nil {
+	err, receptionID, version := repo.CloseLastReception("pvz1", time.Now(), 0)
+	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
+	if receptionID != "rec1" || version != 2 {
+		t.Errorf("unexpected reception %q, version %d", receptionID, version)
+	}
 }
 
 func TestListPVZ_Success(t *testing.T) {
 	t1 := time.Now().Add(-time.Hour)
 	t2 := time.Now()
-	mockRows := &mockRows{rows: [][]interface{}{{"id1", "city1", t1}, {"id2", "city2", t2}}}
+	mockRows := &mockRows{rows: [][]interface{}{{"id1", "city1", t1, int64(1)}, {"id2", "city2", t2, int64(3)}}}
 	mock := &mockPool{
 		QueryFunc: func(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
 			return mockRows, nil
@@ -192,7 +209,7 @@ func TestListPVZ_Success(t *testing.T) {
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	expected := []domain.PVZ{{ID: "id1", City: "city1", RegistrationDate: t1}, {ID: "id2", City: "city2", RegistrationDate: t2}}
+	expected := []domain.PVZ{{ID: "id1", City: "city1", RegistrationDate: t1, Version: 1}, {ID: "id2", City: "city2", RegistrationDate: t2, Version: 3}}
 	if !reflect.DeepEqual(*list, expected) {
 		t.Errorf("expected %+v, got %+v", expected, *list)
 	}
@@ -248,3 +265,520 @@ func TestLogin_NotFound(t *testing.T) {
 		t.Errorf("expected %v, got %v", want, err)
 	}
 }
+
+func TestReconcileManifest_Discrepancies(t *testing.T) {
+	items := `[{"barcode":"A","type":"обувь"},{"barcode":"B","type":"одежда"}]`
+	reception := `{"id":"rec1","pvz_id":"pvz1","closed_at":"2025-04-20 16:30:27",` +
+		`"products":[{"id":"p1","type":"обувь","barcode":"A"},{"id":"p2","type":"обувь","barcode":"A"},{"id":"p3","type":"обувь","barcode":"C"}]}`
+	var updated bool
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				if strings.Contains(sql, "avito_schema.manifests") {
+					*(dest[0].(*string)) = "man1"
+					*(dest[1].(*time.Time)) = time.Now()
+					*(dest[2].(*json.RawMessage)) = json.RawMessage(items)
+					return nil
+				}
+				*(dest[0].(*json.RawMessage)) = json.RawMessage(reception)
+				return nil
+			}}
+		},
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			updated = true
+			if args[1] != "man1" {
+				t.Errorf("unexpected args: %v", args)
+			}
+			return pgconn.CommandTag("UPDATE"), nil
+		},
+	}
+	repo := db.New(mock)
+	err, report := repo.ReconcileManifest("pvz1", "rec1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !updated {
+		t.Error("report was not stored")
+	}
+	if report.ReceptionID != "rec1" {
+		t.Errorf("unexpected reception %q", report.ReceptionID)
+	}
+	if len(report.Missing) != 1 || report.Missing[0].Barcode != "B" {
+		t.Errorf("unexpected missing: %+v", report.Missing)
+	}
+	if len(report.Extra) != 1 || report.Extra[0].Barcode != "C" {
+		t.Errorf("unexpected extra: %+v", report.Extra)
+	}
+	if len(report.Duplicate) != 1 || report.Duplicate[0].Barcode != "A" {
+		t.Errorf("unexpected duplicate: %+v", report.Duplicate)
+	}
+}
+
+func TestManifestReport_NoManifest(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				return pgx.ErrNoRows
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, report := repo.ManifestReport("pvz1")
+	if err != nil || report != nil {
+		t.Errorf("expected no report and no error, got %+v, %v", report, err)
+	}
+}
+
+func TestCloseStaleReceptions_ReturnsEvents(t *testing.T) {
+	now := time.Now()
+	mockRows := &mockRows{rows: [][]interface{}{{"ev1", "pvz1", "rec1", "auto_closed", now}}}
+	mock := &mockPool{
+		QueryFunc: func(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+			if !strings.Contains(sql, "pg_try_advisory_xact_lock") {
+				t.Errorf("stale receptions must be closed under advisory lock: %s", sql)
+			}
+			if args[2] != (2 * time.Hour).Seconds() {
+				t.Errorf("unexpected idle timeout arg: %v", args[2])
+			}
+			return mockRows, nil
+		},
+	}
+	repo := db.New(mock)
+	err, events := repo.CloseStaleReceptions(now, 2*time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []domain.ReceptionEvent{{ID: "ev1", PVZID: "pvz1", ReceptionID: "rec1", Type: "auto_closed", CreatedAt: now}}
+	if !reflect.DeepEqual(events, expected) {
+		t.Errorf("expected %+v, got %+v", expected, events)
+	}
+}
+
+func TestForceCloseReception_RecordsReason(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if !strings.Contains(sql, "INSERT INTO avito_schema.reception_events") {
+				t.Errorf("force close must be recorded in history: %s", sql)
+			}
+			if args[4] != "scanner broken" || args[5] != "mod1" {
+				t.Errorf("unexpected args: %v", args)
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*string)) = "rec1"
+				*(dest[1].(*int64)) = 5
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, event, version := repo.ForceCloseReception("pvz1", time.Now(), "scanner broken", "mod1", 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if event.ReceptionID != "rec1" || event.Type != domain.ReceptionEventForceClosed || version != 5 {
+		t.Errorf("unexpected event: %+v, version %d", event, version)
+	}
+}
+
+func TestReopenLastReception_KeepsManifestBound(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if strings.Contains(sql, "reception_id = NULL") {
+				t.Errorf("reopen must not make the manifest pending again: %s", sql)
+			}
+			if !strings.Contains(sql, "SET report = NULL") {
+				t.Errorf("reopen must drop the stale report: %s", sql)
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*string)) = "rec1"
+				*(dest[1].(*int64)) = 6
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, event, version := repo.ReopenLastReception("pvz1", time.Now(), "wrong product type", "mod1", 0)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if event.ReceptionID != "rec1" || event.Type != domain.ReceptionEventReopened || version != 6 {
+		t.Errorf("unexpected event: %+v, version %d", event, version)
+	}
+}
+
+func TestDeleteLastProduct_StaleVersion(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if strings.Contains(sql, "UPDATE avito_schema.pvz") {
+				if !strings.Contains(sql, "version = version + 1") || args[2] != int64(4) {
+					t.Errorf("delete must be conditioned on the version: %s %v", sql, args)
+				}
+				return &mockRow{scanFunc: func(dest ...interface{}) error { return pgx.ErrNoRows }}
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*int64)) = 5
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, _ := repo.DeleteLastProduct("pvz1", 4)
+	if !errors.Is(err, domain.ErrVersionMismatch) {
+		t.Fatalf("expected version mismatch, got %v", err)
+	}
+}
+
+func TestDeleteLastProduct_EmptyReceptionIsNotAConflict(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if strings.Contains(sql, "UPDATE avito_schema.pvz") {
+				return &mockRow{scanFunc: func(dest ...interface{}) error { return pgx.ErrNoRows }}
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*int64)) = 4
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, _ := repo.DeleteLastProduct("pvz1", 4)
+	if !errors.Is(err, pgx.ErrNoRows) {
+		t.Fatalf("expected no rows, got %v", err)
+	}
+}
+
+func TestCheckSchema_BehindMigrations(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*int64)) = db.RequiredSchemaVersion - 1
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	if err := repo.CheckSchema(context.Background()); err == nil {
+		t.Error("expected an error for an outdated schema")
+	}
+}
+
+func TestIsAssigned_InvalidPVZIDIsNotAssigned(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			t.Error("query must not run for malformed ids")
+			return nil
+		},
+	}
+	repo := db.New(mock)
+	err, assigned := repo.IsAssigned("6f1c6a4e-8a57-4c36-9b43-3e7a0e9c1d11", "typo-in-pvz-id", time.Now())
+	if err != nil || assigned {
+		t.Errorf("expected not assigned without error, got %v, %v", assigned, err)
+	}
+}
+
+func TestRolePermissions_Success(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if args[0] != "auditor" {
+				t.Errorf("unexpected role: %v", args[0])
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*[]string)) = []string{"pvz.read", "audit.read"}
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, perms := repo.RolePermissions("auditor")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(perms, []string{"pvz.read", "audit.read"}) {
+		t.Errorf("unexpected permissions: %v", perms)
+	}
+}
+
+func TestRegisterWithInvite_ReturnsInviteRole(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			if !strings.Contains(sql, "UPDATE avito_schema.invites") || !strings.Contains(sql, "INSERT INTO avito_schema.users") {
+				t.Errorf("invite must be consumed together with user creation: %s", sql)
+			}
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*string)) = "moderator"
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, role := repo.RegisterWithInvite("em", "pw", "hash", time.Now())
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if role != "moderator" {
+		t.Errorf("expected moderator, got %s", role)
+	}
+}
+
+func TestLoginBlockedUntil_NotLocked(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				return pgx.ErrNoRows
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, until := repo.LoginBlockedUntil([]string{"email:a@b.c", "ip:127.0.0.1"}, time.Now())
+	if err != nil || !until.IsZero() {
+		t.Errorf("expected no lock, got %v, %v", until, err)
+	}
+}
+
+func TestUseTOTPStep_Replay(t *testing.T) {
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			return pgconn.CommandTag("UPDATE 0"), nil
+		},
+	}
+	repo := db.New(mock)
+	err, ok := repo.UseTOTPStep("user1", 42)
+	if err != nil || ok {
+		t.Errorf("expected replayed step to be rejected, got %v, %v", ok, err)
+	}
+}
+
+func TestCreateEmailToken_UnknownEmail(t *testing.T) {
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			return pgconn.CommandTag("INSERT 0 0"), nil
+		},
+	}
+	repo := db.New(mock)
+	err, created := repo.CreateEmailToken("nobody@example.com", domain.EmailTokenReset, "hash", time.Now().Add(time.Hour))
+	if err != nil || created {
+		t.Errorf("expected no token for unknown email, got %v, %v", created, err)
+	}
+}
+
+func TestUseAPIKey_Unknown(t *testing.T) {
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				return pgx.ErrNoRows
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, key := repo.UseAPIKey("hash", time.Now())
+	if err != nil || key != nil {
+		t.Errorf("expected no key, got %+v, %v", key, err)
+	}
+}
+
+func TestStartIdempotentRequest_ReturnsExistingRecord(t *testing.T) {
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			return pgconn.CommandTag("INSERT 0 0"), nil
+		},
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*string)) = "hash"
+				*(dest[1].(*bool)) = true
+				*(dest[2].(*int)) = 201
+				return nil
+			}}
+		},
+	}
+	repo := db.New(mock)
+	err, rec := repo.StartIdempotentRequest("user1", "key", "hash", time.Now(), time.Now().Add(time.Hour))
+	if err != nil || rec == nil || !rec.Completed || rec.StatusCode != 201 {
+		t.Errorf("expected stored record, got %+v, %v", rec, err)
+	}
+}
+
+func TestQueriesAreTimedPerMethod(t *testing.T) {
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			return pgconn.CommandTag("INSERT 0 1"), nil
+		},
+	}
+	observed := func() uint64 {
+		var m dto.Metric
+		if err := metrics.DBQueryDuration.WithLabelValues("Register", "ok").(prometheus.Metric).Write(&m); err != nil {
+			t.Fatal(err)
+		}
+		return m.GetHistogram().GetSampleCount()
+	}
+
+	repo := db.New(mock)
+	before := observed()
+	if err := repo.Register("a@b.c", "hash", "employee"); err != nil {
+		t.Fatal(err)
+	}
+	if observed() != before+1 {
+		t.Error("query must be observed under the repository method name")
+	}
+}
+
+func TestWithContext_QueriesAreTracedInRequest(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	defer otel.SetTracerProvider(prev)
+
+	var poolCtx context.Context
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			poolCtx = ctx
+			return pgconn.CommandTag("INSERT 0 1"), nil
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, request := tracing.Tracer().Start(ctx, "POST /register")
+
+	repo := db.New(mock).WithContext(ctx)
+	if err := repo.Register("a@b.c", "hash", "employee"); err != nil {
+		t.Fatal(err)
+	}
+	request.End()
+	cancel()
+
+	spans := recorder.Ended()
+	if len(spans) != 2 || spans[0].Name() != "Register" || spans[0].Parent().SpanID() != request.SpanContext().SpanID() {
+		t.Fatalf("expected a Register span under the request, got %d spans", len(spans))
+	}
+	if poolCtx.Err() == nil {
+		t.Error("the query must run in the request context")
+	}
+}
+
+func TestNewWithRetry_ResendsReadsAfterFailover(t *testing.T) {
+	calls := 0
+	mock := &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			calls++
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				switch calls {
+				case 1:
+					return &pgconn.PgError{Code: "57P01", Message: "terminating connection due to administrator command"}
+				case 2:
+					return io.ErrUnexpectedEOF
+				}
+				*(dest[0].(*string)) = "uid"
+				return nil
+			}}
+		},
+	}
+	repo := db.NewWithRetry(mock, db.Retry{Retries: 2})
+	if err, user := repo.Login("a@b.c"); err != nil || user.ID != "uid" {
+		t.Fatalf("expected the read to succeed on the third try, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestNewWithRetry_WritesAreNotResentAfterConnectionLoss(t *testing.T) {
+	calls := 0
+	mock := &mockPool{
+		ExecFunc: func(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error) {
+			calls++
+			if calls == 1 {
+				return nil, &pgconn.PgError{Code: "40001"}
+			}
+			return nil, io.ErrUnexpectedEOF
+		},
+	}
+	repo := db.NewWithRetry(mock, db.Retry{Retries: 5})
+	if err := repo.Register("a@b.c", "hash", "employee"); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected the connection error, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("a rejected write is resent, one that may have been applied is not: got %d calls", calls)
+	}
+}
+
+// replicaMock answers the lag check with lag seconds and counts the listings it serves.
+func replicaMock(lag float64, queryErr error, served *int) *mockPool {
+	return &mockPool{
+		QueryRowFunc: func(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+			return &mockRow{scanFunc: func(dest ...interface{}) error {
+				*(dest[0].(*float64)) = lag
+				return nil
+			}}
+		},
+		QueryFunc: func(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+			*served++
+			if queryErr != nil {
+				return nil, queryErr
+			}
+			return &mockRows{}, nil
+		},
+	}
+}
+
+func TestUseReplicas_ListingsSkipLaggingReplicas(t *testing.T) {
+	var primary, fresh, lagging int
+	repo := db.New(replicaMock(0, nil, &primary))
+	set := db.NewReplicaSet(5*time.Second,
+		db.Replica{Name: "fresh", Pool: replicaMock(0.2, nil, &fresh)},
+		db.Replica{Name: "lagging", Pool: replicaMock(30, nil, &lagging)},
+	)
+	repo.UseReplicas(set)
+
+	if err, _ := repo.ListPVZ("end", "start", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if primary != 1 {
+		t.Fatalf("before the first check listings must go to the primary, got primary %d", primary)
+	}
+
+	if err := set.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 4; i++ {
+		if err, _ := repo.WithContext(context.Background()).ListPVZ("end", "start", 10, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fresh != 4 || lagging != 0 || primary != 1 {
+		t.Errorf("expected every listing on the fresh replica, got fresh %d, lagging %d, primary %d", fresh, lagging, primary)
+	}
+}
+
+func TestUseReplicas_ReceptionEventsReadPrimary(t *testing.T) {
+	var primary, replica int
+	repo := db.New(replicaMock(0, nil, &primary))
+	set := db.NewReplicaSet(5*time.Second, db.Replica{Name: "fresh", Pool: replicaMock(0, nil, &replica)})
+	if err := set.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	repo.UseReplicas(set)
+
+	if err, _ := repo.ReceptionEvents("pvz1", 10, 0); err != nil {
+		t.Fatal(err)
+	}
+	if replica != 0 || primary != 1 {
+		t.Errorf("events must be read with the version from the primary: replica %d, primary %d", replica, primary)
+	}
+}
+
+func TestUseReplicas_FallsBackToPrimary(t *testing.T) {
+	var primary, replica int
+	repo := db.New(replicaMock(0, nil, &primary))
+	set := db.NewReplicaSet(5*time.Second, db.Replica{Name: "down", Pool: replicaMock(0, io.ErrUnexpectedEOF, &replica)})
+	if err := set.Check(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	repo.UseReplicas(set)
+
+	for i := 0; i < 2; i++ {
+		if err, _ := repo.GrpcListPVz("end", "start", 10, 0); err != nil {
+			t.Fatalf("expected the primary to answer, got %v", err)
+		}
+	}
+	if replica != 1 || primary != 2 {
+		t.Errorf("the failed replica must leave rotation: replica %d, primary %d", replica, primary)
+	}
+}
@@ -0,0 +1,150 @@
+package db
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	postgres "AvitoPVZService/Service/pkg"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// Replica is a streaming standby the repository may send reads to that tolerate lag.
+type Replica struct {
+	Name string
+	Pool interfaces.PgxPoolIface
+}
+
+// ReplicaSet tracks which replicas are fresh enough to read from. A replica is used while its
+// last Check succeeded and measured a lag within maxLag, so none is used before the first one.
+type ReplicaSet struct {
+	replicas []*replica
+	maxLag   time.Duration
+	next     atomic.Uint64
+}
+
+type replica struct {
+	Replica
+	fresh atomic.Bool
+}
+
+func NewReplicaSet(maxLag time.Duration, replicas ...Replica) *ReplicaSet {
+	s := &ReplicaSet{maxLag: maxLag}
+	for _, r := range replicas {
+		s.replicas = append(s.replicas, &replica{Replica: r})
+	}
+
+	return s
+}
+
+// replicaCheckTimeout bounds the lag check of one replica.
+const replicaCheckTimeout = 3 * time.Second
+
+// replicaLagQuery is the replay delay of a standby. A standby that replayed everything it
+// received has no lag, however old its last transaction is; a server that is not in recovery
+// (a promoted standby) has none either.
+const replicaLagQuery = `
+	SELECT CASE
+		WHEN NOT pg_is_in_recovery() THEN 0
+		WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+		ELSE COALESCE(EXTRACT(EPOCH FROM NOW() - pg_last_xact_replay_timestamp()), 0)
+	END::float8`
+
+// Check measures the lag of every replica and takes the stale or unreachable ones out of
+// rotation. It fails if a replica could not be checked.
+func (s *ReplicaSet) Check(ctx context.Context) error {
+	var errs []error
+	for _, r := range s.replicas {
+		var lag float64
+		checkCtx, cancel := context.WithTimeout(ctx, replicaCheckTimeout)
+		err := r.Pool.QueryRow(checkCtx, replicaLagQuery).Scan(&lag)
+		cancel()
+		fresh := err == nil && time.Duration(lag*float64(time.Second)) <= s.maxLag
+		if err != nil {
+			lag = -1
+			errs = append(errs, fmt.Errorf("replica %s: %w", r.Name, err))
+		}
+		metrics.DBReplicaLag.WithLabelValues(r.Name).Set(lag)
+
+		if r.fresh.Swap(fresh) != fresh {
+			if fresh {
+				slog.InfoContext(ctx, "replica in rotation", "replica", r.Name, "lag_seconds", lag)
+			} else {
+				slog.WarnContext(ctx, "replica out of rotation", "replica", r.Name, "lag_seconds", lag, "err", err)
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// pick returns the next fresh replica in turn, or nil if there is none.
+func (s *ReplicaSet) pick() *replica {
+	if s == nil || len(s.replicas) == 0 {
+		return nil
+	}
+	start := s.next.Add(1)
+	for i := range s.replicas {
+		if r := s.replicas[(start+uint64(i))%uint64(len(s.replicas))]; r.fresh.Load() {
+			return r
+		}
+	}
+
+	return nil
+}
+
+// replicaPool reads from a replica and falls back to the primary when the replica cannot
+// answer; the replica then stays out of rotation until its next successful check.
+type replicaPool struct {
+	replica *replica
+	primary interfaces.PgxPoolIface
+}
+
+func (p replicaPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	rows, err := p.replica.Pool.Query(ctx, sql, args...)
+	if p.failed(ctx, err) {
+		return p.primary.Query(ctx, sql, args...)
+	}
+
+	return rows, err
+}
+
+func (p replicaPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return &replicaRow{pool: p, ctx: ctx, sql: sql, args: args}
+}
+
+// Exec always runs on the primary: a replica cannot write.
+func (p replicaPool) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	return p.primary.Exec(ctx, sql, arguments...)
+}
+
+func (p replicaPool) failed(ctx context.Context, err error) bool {
+	if !postgres.Retryable(err, true) {
+		return false
+	}
+	p.replica.fresh.Store(false)
+	slog.WarnContext(ctx, "replica out of rotation, reading from primary", "replica", p.replica.Name, "err", err)
+
+	return true
+}
+
+type replicaRow struct {
+	pool replicaPool
+	ctx  context.Context
+	sql  string
+	args []interface{}
+}
+
+func (r *replicaRow) Scan(dest ...interface{}) error {
+	err := r.pool.replica.Pool.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	if r.pool.failed(r.ctx, err) {
+		return r.pool.primary.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	}
+
+	return err
+}
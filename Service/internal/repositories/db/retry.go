@@ -0,0 +1,90 @@
+package db
+
+import (
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	postgres "AvitoPVZService/Service/pkg"
+	"context"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgx/v4"
+	"log/slog"
+)
+
+// Retry is how a repository rides out a failover: statements failing with a transient error
+// are sent again up to Retries times, see postgres.Retryable for which ones.
+type Retry struct {
+	Retries int
+	Backoff postgres.Backoff
+}
+
+// retryingPool resends statements that failed with a transient error. A statement the server
+// rejected did not take effect; one whose connection dropped mid-statement may have, so it is
+// resent only if its context was marked with idempotent.
+type retryingPool struct {
+	interfaces.PgxPoolIface
+	retry Retry
+}
+
+func (p retryingPool) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+	var rows pgx.Rows
+	err := p.do(ctx, func() (err error) {
+		rows, err = p.PgxPoolIface.Query(ctx, sql, args...)
+		return err
+	})
+
+	return rows, err
+}
+
+func (p retryingPool) QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row {
+	return &retryingRow{pool: p, ctx: ctx, sql: sql, args: args}
+}
+
+func (p retryingPool) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	var tag pgconn.CommandTag
+	err := p.do(ctx, func() (err error) {
+		tag, err = p.PgxPoolIface.Exec(ctx, sql, arguments...)
+		return err
+	})
+
+	return tag, err
+}
+
+func (p retryingPool) do(ctx context.Context, fn func() error) error {
+	idempotent := isIdempotent(ctx)
+	for retry := 0; ; retry++ {
+		err := fn()
+		if retry >= p.retry.Retries || !postgres.Retryable(err, idempotent) {
+			return err
+		}
+		slog.WarnContext(ctx, "retrying statement", "retry", retry+1, "err", err)
+		if p.retry.Backoff.Sleep(ctx, retry) != nil {
+			return err
+		}
+	}
+}
+
+// retryingRow sends the query when scanned: pgx reports the errors of QueryRow from Scan.
+type retryingRow struct {
+	pool retryingPool
+	ctx  context.Context
+	sql  string
+	args []interface{}
+}
+
+func (r *retryingRow) Scan(dest ...interface{}) error {
+	return r.pool.do(r.ctx, func() error {
+		return r.pool.PgxPoolIface.QueryRow(r.ctx, r.sql, r.args...).Scan(dest...)
+	})
+}
+
+type idempotentKey struct{}
+
+// idempotent marks the statements sent in ctx as safe to send twice: reads without locks or
+// other side effects. The repository method sending a statement decides, not its SQL.
+func idempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	marked, _ := ctx.Value(idempotentKey{}).(bool)
+	return marked
+}
@@ -0,0 +1,44 @@
+package db
+
+import (
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"io"
+	"testing"
+)
+
+// droppingPool loses the connection on every statement.
+type droppingPool struct {
+	interfaces.PgxPoolIface
+	calls int
+}
+
+func (p *droppingPool) Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error) {
+	p.calls++
+	return nil, io.ErrUnexpectedEOF
+}
+
+func TestRetryingPool_ResendsOnlyMarkedStatements(t *testing.T) {
+	tests := []struct {
+		name  string
+		ctx   context.Context
+		sql   string
+		calls int
+	}{
+		// a SELECT is not safe to resend by itself: it may lock rows or call functions
+		{"locking read", context.Background(), `SELECT pg_advisory_lock(1)`, 1},
+		{"marked read", idempotent(context.Background()), `SELECT 1`, 3},
+	}
+	for _, tt := range tests {
+		pool := &droppingPool{}
+		p := retryingPool{PgxPoolIface: pool, retry: Retry{Retries: 2}}
+		if _, err := p.Exec(tt.ctx, tt.sql); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("%s: expected the connection error, got %v", tt.name, err)
+		}
+		if pool.calls != tt.calls {
+			t.Errorf("%s: expected %d calls, got %d", tt.name, tt.calls, pool.calls)
+		}
+	}
+}
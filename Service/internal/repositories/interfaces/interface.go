@@ -3,18 +3,68 @@ package interfaces
 import (
 	"AvitoPVZService/Service/internal/domain"
 	"AvitoPVZService/Service/internal/handlers"
+	"context"
 	"encoding/json"
 	"time"
 )
 
 type Repository interface {
+	// WithContext binds the queries of the returned repository to ctx.
+	WithContext(ctx context.Context) Repository
 	Register(email, password, role string) error
 	Login(email string) (error, *domain.User)
+	ProvisionExternalUser(issuer, subject, email, role string, at time.Time) (error, *domain.User)
+	CreateEmailToken(email, purpose, tokenHash string, expiresAt time.Time) (error, bool)
+	VerifyEmail(tokenHash string, at time.Time) (error, bool)
+	ResetPassword(tokenHash, password string, at time.Time) (error, bool)
+	GetTOTP(userID string) (error, *domain.TOTP)
+	SetTOTPSecret(userID, secret string) error
+	EnableTOTP(userID string, recoveryHashes []string) error
+	UseTOTPStep(userID string, step int64) (error, bool)
+	UseRecoveryCode(userID, codeHash string, at time.Time) (error, bool)
+	ResetTOTP(userID string) error
+	LoginBlockedUntil(keys []string, now time.Time) (error, time.Time)
+	RecordLoginFailure(key string, now time.Time, window time.Duration) (error, int)
+	LockLogin(key string, until time.Time) error
+	ResetLoginFailures(key string) error
+	UnlockUser(id string) error
+	RegisterWithInvite(email, password, inviteHash string, at time.Time) (error, string)
+	CreateInvite(inv *domain.Invite) error
+	ListUsers(search, role string, limit, offset int) (error, []domain.User)
+	SetUserActive(id string, active bool, at time.Time) error
+	ChangeUserRole(id, role string) error
+	IsUserDeactivated(id string) (error, bool)
+	UserPermissions(id string) (error, []string)
+	CreateAPIKey(k *domain.APIKey) error
+	ListAPIKeys(limit, offset int) (error, []domain.APIKey)
+	RevokeAPIKey(id string, at time.Time) error
+	UseAPIKey(keyHash string, at time.Time) (error, *domain.APIKey)
+	StartIdempotentRequest(subject, key, requestHash string, now, expiresAt time.Time) (error, *domain.IdempotencyRecord)
+	CompleteIdempotentRequest(subject, key string, record *domain.IdempotencyRecord) error
+	ReleaseIdempotentRequest(subject, key string) error
+	DeleteExpiredIdempotencyKeys(now time.Time) (error, int64)
+	RolePermissions(role string) (error, []string)
+	ListRoles() (error, []domain.Role)
+	SaveRole(role *domain.Role) error
+	AssignEmployee(a *domain.Assignment) error
+	RevokeAssignment(id string, at time.Time) error
+	ListAssignments(userID, PVZID string, limit, offset int) (error, []domain.Assignment)
+	IsAssigned(userID, PVZID string, at time.Time) (error, bool)
 	CreatePVZ(city, id string, regTime time.Time) error
-	CreateReception(PVZID string, id string, dateTime time.Time) (error, *json.RawMessage)
-	AddProduct(id string, dateTime time.Time, prodType, PVZID string) (error, *json.RawMessage)
-	DeleteLastProduct(PVZID string) error
-	CloseLastReception(PVZID string, closedAt time.Time) error
+	GetPVZ(PVZID string) (error, *domain.PVZ)
+	PVZVersion(PVZID string) (error, int64)
+	CreateReception(PVZID string, id string, dateTime time.Time, ifVersion int64) (error, *json.RawMessage, int64)
+	AddProduct(id string, dateTime time.Time, prodType, barcode, PVZID string, ifVersion int64) (error, *json.RawMessage, int64)
+	DeleteLastProduct(PVZID string, ifVersion int64) (error, int64)
+	CloseLastReception(PVZID string, closedAt time.Time, ifVersion int64) (error, string, int64)
+	ForceCloseReception(PVZID string, closedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64)
+	ReopenLastReception(PVZID string, reopenedAt time.Time, reason, actor string, ifVersion int64) (error, *domain.ReceptionEvent, int64)
+	ReceptionEvents(PVZID string, limit, offset int) (error, []domain.ReceptionEvent)
+	CloseStaleReceptions(now time.Time, idleTimeout time.Duration) (error, []domain.ReceptionEvent)
+	SetReceptionTimeout(PVZID string, timeout time.Duration, ifVersion int64) (error, int64)
+	UploadManifest(PVZID, id string, items []domain.ManifestItem, uploadedAt time.Time, ifVersion int64) (error, int64)
+	ManifestReport(PVZID string) (error, *domain.DiscrepancyReport)
+	ReconcileManifest(PVZID, receptionID string) (error, *domain.DiscrepancyReport)
 	ListPVZ(endStr, startStr string, limit, offset int) (error, *[]domain.PVZ)
 	GrpcListPVz(endPeriod, startPeriod string, limit, offset int) (error, []*handlers.ProtoPVZ)
 }
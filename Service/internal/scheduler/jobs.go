@@ -0,0 +1,51 @@
+package scheduler
+
+import (
+	"AvitoPVZService/Service/internal/metrics"
+	"AvitoPVZService/Service/internal/repositories/interfaces"
+	"context"
+	"log/slog"
+	"time"
+)
+
+// CloseStaleReceptions closes receptions left open longer than idleTimeout (or the PVZ
+// specific timeout) and reconciles their manifests. Safe to run on every replica.
+func CloseStaleReceptions(repo interfaces.Repository, idleTimeout time.Duration) Job {
+	return func(ctx context.Context) error {
+		repo := repo.WithContext(ctx)
+		err, events := repo.CloseStaleReceptions(time.Now(), idleTimeout)
+		if err != nil {
+			return err
+		}
+
+		for _, e := range events {
+			slog.InfoContext(ctx, "reception closed after idle timeout", "event", e.Type, "reception_id", e.ReceptionID, "pvz_id", e.PVZID)
+			if err, pvz := repo.GetPVZ(e.PVZID); err == nil {
+				if openedAt, ok := pvz.LastReceptionOpenedAt(); ok {
+					metrics.ReceptionDuration.WithLabelValues(pvz.City, metrics.ClosedByTimeout).
+						Observe(e.CreatedAt.Sub(openedAt).Seconds())
+				}
+			}
+			if err, _ := repo.ReconcileManifest(e.PVZID, e.ReceptionID); err != nil {
+				slog.ErrorContext(ctx, "reconcile manifest", "pvz_id", e.PVZID, "reception_id", e.ReceptionID, "err", err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// PurgeIdempotencyKeys deletes stored responses whose replay window has passed.
+func PurgeIdempotencyKeys(repo interfaces.Repository) Job {
+	return func(ctx context.Context) error {
+		err, deleted := repo.WithContext(ctx).DeleteExpiredIdempotencyKeys(time.Now())
+		if err != nil {
+			return err
+		}
+		if deleted > 0 {
+			slog.InfoContext(ctx, "purged expired idempotency keys", "deleted", deleted)
+		}
+
+		return nil
+	}
+}
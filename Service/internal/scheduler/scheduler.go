@@ -0,0 +1,75 @@
+package scheduler
+
+import (
+	"AvitoPVZService/Service/internal/tracing"
+	"context"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Job is a unit of background work run periodically by the Scheduler.
+type Job func(ctx context.Context) error
+
+type task struct {
+	name     string
+	interval time.Duration
+	job      Job
+}
+
+type Scheduler struct {
+	tasks []task
+	wg    sync.WaitGroup
+}
+
+func New() *Scheduler {
+	return &Scheduler{}
+}
+
+// Every registers a job to run once per interval after Start is called.
+func (s *Scheduler) Every(name string, interval time.Duration, job Job) {
+	s.tasks = append(s.tasks, task{name: name, interval: interval, job: job})
+}
+
+// Start launches every registered job in its own goroutine until ctx is cancelled.
+func (s *Scheduler) Start(ctx context.Context) {
+	for _, t := range s.tasks {
+		s.wg.Add(1)
+		go s.run(ctx, t)
+	}
+}
+
+// Wait blocks until all jobs have returned after the Start context was cancelled.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+// runOnce runs the job in a root span of its own, with its queries as children.
+func (s *Scheduler) runOnce(ctx context.Context, t task) {
+	ctx, span := tracing.Tracer().Start(ctx, "job "+t.name, trace.WithNewRoot())
+	defer span.End()
+
+	if err := t.job(ctx); err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		slog.ErrorContext(ctx, "job failed", "job", t.name, "err", err)
+	}
+}
+
+func (s *Scheduler) run(ctx context.Context, t task) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.runOnce(ctx, t)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestScheduler_RunsJobUntilCancelled(t *testing.T) {
+	var runs int32
+	s := New()
+	s.Every("counter", time.Millisecond, func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return errors.New("job errors must not stop the scheduler")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Start(ctx)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	s.Wait()
+
+	got := atomic.LoadInt32(&runs)
+	if got < 2 {
+		t.Fatalf("expected job to run repeatedly, got %d runs", got)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if atomic.LoadInt32(&runs) != got {
+		t.Error("job kept running after cancellation")
+	}
+}
@@ -0,0 +1,161 @@
+package slo
+
+import (
+	"sync"
+	"time"
+)
+
+// Targets are the objectives requests are measured against: the share of requests that
+// must not fail with 5xx, and the share that must finish within Latency.
+type Targets struct {
+	Availability float64       `json:"availability"`
+	Latency      time.Duration `json:"-"`
+	LatencyRatio float64       `json:"latencyRatio"`
+}
+
+type counts struct {
+	requests uint64
+	errors   uint64
+	slow     uint64
+}
+
+func (c *counts) add(o counts) {
+	c.requests += o.requests
+	c.errors += o.errors
+	c.slow += o.slow
+}
+
+// minute holds the requests of one minute per route.
+type minute struct {
+	start  int64
+	routes map[string]*counts
+}
+
+// Tracker keeps per-minute request counts for the last Window, so the SLO report covers a
+// sliding window rather than the lifetime of the process like the Prometheus histograms.
+type Tracker struct {
+	Targets Targets
+	Window  time.Duration
+
+	mu      sync.Mutex
+	minutes []minute
+	now     func() time.Time
+}
+
+func New(window time.Duration, targets Targets) *Tracker {
+	if window < time.Minute {
+		window = time.Minute
+	}
+	return &Tracker{
+		Targets: targets,
+		Window:  window,
+		minutes: make([]minute, int(window/time.Minute)),
+		now:     time.Now,
+	}
+}
+
+// Observe records a finished request. Only 5xx answers count against availability.
+func (t *Tracker) Observe(route string, status int, took time.Duration) {
+	c := counts{requests: 1}
+	if status >= 500 {
+		c.errors = 1
+	}
+	if took > t.Targets.Latency {
+		c.slow = 1
+	}
+
+	start := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	m := &t.minutes[start%int64(len(t.minutes))]
+	if m.start != start {
+		*m = minute{start: start, routes: map[string]*counts{}}
+	}
+	rc, ok := m.routes[route]
+	if !ok {
+		rc = &counts{}
+		m.routes[route] = rc
+	}
+	rc.add(c)
+}
+
+// SLI is what was measured over the window and whether it meets the targets.
+// ErrorBudgetLeft is the share of allowed failures not yet used, negative when overspent.
+type SLI struct {
+	Requests        uint64  `json:"requests"`
+	Errors          uint64  `json:"errors"`
+	Slow            uint64  `json:"slow"`
+	Availability    float64 `json:"availability"`
+	LatencyRatio    float64 `json:"latencyRatio"`
+	AvailabilityMet bool    `json:"availabilityMet"`
+	LatencyMet      bool    `json:"latencyMet"`
+	ErrorBudgetLeft float64 `json:"errorBudgetLeft"`
+}
+
+type Report struct {
+	From    time.Time      `json:"from"`
+	To      time.Time      `json:"to"`
+	Window  string         `json:"window"`
+	Latency string         `json:"latencyTarget"`
+	Targets Targets        `json:"targets"`
+	Overall SLI            `json:"overall"`
+	Routes  map[string]SLI `json:"routes"`
+}
+
+// Report summarizes the requests of the window, overall and per route.
+func (t *Tracker) Report() Report {
+	now := t.now()
+	oldest := now.Unix()/60 - int64(len(t.minutes)) + 1
+
+	overall := counts{}
+	routes := map[string]*counts{}
+	t.mu.Lock()
+	for _, m := range t.minutes {
+		if m.routes == nil || m.start < oldest {
+			continue
+		}
+		for route, c := range m.routes {
+			rc, ok := routes[route]
+			if !ok {
+				rc = &counts{}
+				routes[route] = rc
+			}
+			rc.add(*c)
+			overall.add(*c)
+		}
+	}
+	t.mu.Unlock()
+
+	report := Report{
+		From:    now.Add(-t.Window),
+		To:      now,
+		Window:  t.Window.String(),
+		Latency: t.Targets.Latency.String(),
+		Targets: t.Targets,
+		Overall: t.sli(overall),
+		Routes:  make(map[string]SLI, len(routes)),
+	}
+	for route, c := range routes {
+		report.Routes[route] = t.sli(*c)
+	}
+
+	return report
+}
+
+func (t *Tracker) sli(c counts) SLI {
+	s := SLI{Requests: c.requests, Errors: c.errors, Slow: c.slow, Availability: 1, LatencyRatio: 1, ErrorBudgetLeft: 1}
+	if c.requests > 0 {
+		s.Availability = 1 - float64(c.errors)/float64(c.requests)
+		s.LatencyRatio = 1 - float64(c.slow)/float64(c.requests)
+		if budget := (1 - t.Targets.Availability) * float64(c.requests); budget > 0 {
+			s.ErrorBudgetLeft = 1 - float64(c.errors)/budget
+		} else if c.errors > 0 {
+			s.ErrorBudgetLeft = 0
+		}
+	}
+	s.AvailabilityMet = s.Availability >= t.Targets.Availability
+	s.LatencyMet = s.LatencyRatio >= t.Targets.LatencyRatio
+
+	return s
+}
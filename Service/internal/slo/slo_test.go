@@ -0,0 +1,52 @@
+package slo
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTracker_ReportAgainstTargets(t *testing.T) {
+	now := time.Date(2025, 4, 20, 12, 0, 0, 0, time.UTC)
+	tr := New(10*time.Minute, Targets{Availability: 0.99, Latency: 100 * time.Millisecond, LatencyRatio: 0.9})
+	tr.now = func() time.Time { return now }
+
+	for i := 0; i < 98; i++ {
+		tr.Observe("/products", 201, 20*time.Millisecond)
+	}
+	tr.Observe("/products", 500, 20*time.Millisecond)
+	tr.Observe("/pvz", 200, 300*time.Millisecond)
+
+	r := tr.Report()
+	if r.Overall.Requests != 100 || r.Overall.Errors != 1 || r.Overall.Slow != 1 {
+		t.Fatalf("unexpected counts: %+v", r.Overall)
+	}
+	if !r.Overall.AvailabilityMet || !r.Overall.LatencyMet {
+		t.Errorf("targets must be met: %+v", r.Overall)
+	}
+	if math.Abs(r.Overall.ErrorBudgetLeft) > 1e-9 {
+		t.Errorf("one error of a budget of one must use it up, got %v", r.Overall.ErrorBudgetLeft)
+	}
+	if r.Routes["/pvz"].LatencyMet {
+		t.Errorf("the only /pvz request was slow: %+v", r.Routes["/pvz"])
+	}
+}
+
+func TestTracker_ForgetsRequestsOutsideWindow(t *testing.T) {
+	now := time.Date(2025, 4, 20, 12, 0, 0, 0, time.UTC)
+	tr := New(5*time.Minute, Targets{Availability: 0.99, Latency: 100 * time.Millisecond, LatencyRatio: 0.9})
+	tr.now = func() time.Time { return now }
+	tr.Observe("/products", 500, time.Millisecond)
+
+	now = now.Add(5 * time.Minute)
+	tr.Observe("/products", 201, time.Millisecond)
+	r := tr.Report()
+	if r.Overall.Requests != 1 || r.Overall.Errors != 0 {
+		t.Errorf("old minute must have left the window: %+v", r.Overall)
+	}
+
+	now = now.Add(time.Hour)
+	if r := tr.Report(); r.Overall.Requests != 0 || !r.Overall.AvailabilityMet {
+		t.Errorf("an idle window meets its targets: %+v", r.Overall)
+	}
+}
@@ -0,0 +1,98 @@
+package tokens
+
+import (
+	"AvitoPVZService/Service/internal/domain"
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiKeyPrefix = "pvz_"
+	apiKeyScheme = "ApiKey "
+	// RoleService is the role reported for requests authenticated by an API key.
+	RoleService = "service"
+)
+
+// APIKeyLookup finds an active key by its hash and records its use; it returns a nil key
+// for unknown, expired or revoked keys. API keys are rejected while it is not set.
+var APIKeyLookup func(keyHash string, at time.Time) (error, *domain.APIKey)
+
+// NewAPIKey generates a key to hand to the client and the hash to store.
+func NewAPIKey() (key, hash string, err error) {
+	token, _, err := NewOpaqueToken()
+	if err != nil {
+		return "", "", err
+	}
+	key = apiKeyPrefix + token
+
+	return key, HashOpaqueToken(key), nil
+}
+
+func authenticateAPIKey(key string) (*Claims, int, string) {
+	if APIKeyLookup == nil {
+		return nil, http.StatusUnauthorized, "invalid api key"
+	}
+
+	err, k := APIKeyLookup(HashOpaqueToken(key), time.Now())
+	if err != nil {
+		return nil, http.StatusInternalServerError, "cannot check api key"
+	}
+	if k == nil {
+		return nil, http.StatusUnauthorized, "invalid api key"
+	}
+
+	permissions := k.Permissions
+	if permissions == nil {
+		// nil would fall back to the defaults of the role in Claims.Can
+		permissions = []string{}
+	}
+
+	return &Claims{
+		UserID:      "apikey:" + k.ID,
+		Role:        RoleService,
+		Permissions: permissions,
+		APIKeyID:    k.ID,
+		PVZIDs:      k.PVZIDs,
+	}, 0, ""
+}
+
+// Identify resolves the caller without failing the request, for rate limiting: the claims
+// of a JWT with a valid signature or of an active API key. Returns nil for anonymous
+// requests and invalid credentials. Deactivation and purposes are checked later by the
+// middleware.
+func Identify(authorization, apiKey string) *Claims {
+	if apiKey == "" && strings.HasPrefix(authorization, apiKeyScheme) {
+		apiKey = strings.TrimPrefix(authorization, apiKeyScheme)
+	}
+	if apiKey != "" {
+		c, _, _ := authenticateAPIKey(apiKey)
+		return c
+	}
+	if authorization == "" {
+		return nil
+	}
+
+	c, err := parseBearer(authorization)
+	if err != nil {
+		return nil
+	}
+	return c
+}
+
+// WithResolvedAPIKey stores API key claims found by Identify, so that the middleware does
+// not look the key up a second time.
+func WithResolvedAPIKey(ctx context.Context, c *Claims) context.Context {
+	if c == nil || c.APIKeyID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, claimsKey, c)
+}
+
+func resolvedAPIKey(ctx context.Context) *Claims {
+	if c := ClaimsFromContext(ctx); c != nil && c.APIKeyID != "" {
+		return c
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package tokens
+
+import (
+	"AvitoPVZService/Service/internal/logging"
+	"AvitoPVZService/Service/internal/tracing"
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"net/http"
+)
+
+// UnaryServerInterceptor authenticates gRPC calls with the same credentials as the HTTP API
+// ("authorization" or "x-api-key" metadata) and checks the permission required by the
+// method. Methods missing from methodPermissions are denied; an empty permission marks a
+// public method such as the health check.
+func UnaryServerInterceptor(methodPermissions map[string]string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if perm, ok := methodPermissions[info.FullMethod]; ok && perm == "" {
+			return handler(ctx, req)
+		}
+
+		md, _ := metadata.FromIncomingContext(ctx)
+		c, code, msg := resolvedAPIKey(ctx), 0, ""
+		if c == nil {
+			c, code, msg = resolveCredentials(First(md.Get("authorization")), First(md.Get("x-api-key")), []string{PurposeAccess})
+		}
+		if c == nil {
+			if code == http.StatusInternalServerError {
+				return nil, status.Error(codes.Internal, msg)
+			}
+			return nil, status.Error(codes.Unauthenticated, msg)
+		}
+		tracing.SetUser(ctx, c.UserID, c.Role, c.APIKeyID)
+		logging.SetUser(ctx, c.UserID)
+
+		perm, ok := methodPermissions[info.FullMethod]
+		if !ok || !c.Can(perm) {
+			return nil, status.Error(codes.PermissionDenied, "forbidden")
+		}
+
+		return handler(context.WithValue(ctx, claimsKey, c), req)
+	}
+}
+
+// First returns the first of the metadata values, or "" if there is none.
+func First(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
@@ -0,0 +1,37 @@
+package tokens
+
+import "time"
+
+// LockoutPolicy describes how failed logins slow down and lock a key (account or IP).
+// The zero value disables the protection.
+type LockoutPolicy struct {
+	MaxFailures int           // failures within Window that lock the key for Lockout
+	Window      time.Duration // failures older than this are forgotten
+	BaseDelay   time.Duration // delay after the second failure, doubled on every next one
+	Lockout     time.Duration
+}
+
+func (p LockoutPolicy) Enabled() bool {
+	return p.MaxFailures > 0
+}
+
+// Delay returns how long the key must wait before the next attempt after the given
+// number of consecutive failures.
+func (p LockoutPolicy) Delay(failures int) time.Duration {
+	if !p.Enabled() {
+		return 0
+	}
+	if failures >= p.MaxFailures {
+		return p.Lockout
+	}
+	if failures < 2 || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	d := p.BaseDelay << (failures - 2)
+	if d > p.Lockout || d <= 0 {
+		d = p.Lockout
+	}
+
+	return d
+}
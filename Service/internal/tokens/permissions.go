@@ -0,0 +1,110 @@
+package tokens
+
+const (
+	RoleEmployee   = "employee"
+	RoleModerator  = "moderator"
+	RoleAdmin      = "admin"
+	RoleAuditor    = "auditor"
+	RoleSupervisor = "supervisor"
+)
+
+const (
+	PermPVZCreate           = "pvz.create"
+	PermPVZRead             = "pvz.read"
+	PermPVZConfigure        = "pvz.configure"
+	PermPVZAny              = "pvz.any" // act on any PVZ regardless of assignments
+	PermReceptionCreate     = "reception.create"
+	PermReceptionClose      = "reception.close"
+	PermReceptionForceClose = "reception.force_close"
+	PermReceptionReopen     = "reception.reopen"
+	PermProductAdd          = "product.add"
+	PermProductDelete       = "product.delete"
+	PermManifestUpload      = "manifest.upload"
+	PermManifestRead        = "manifest.read"
+	PermAssignmentManage    = "assignment.manage"
+	PermRoleManage          = "role.manage"
+	PermUserManage          = "user.manage"
+	PermAuditRead           = "audit.read"
+	PermAPIKeyManage        = "apikey.manage"
+)
+
+// AllPermissions lists every permission known to the service.
+var AllPermissions = []string{
+	PermPVZCreate, PermPVZRead, PermPVZConfigure, PermPVZAny,
+	PermReceptionCreate, PermReceptionClose, PermReceptionForceClose, PermReceptionReopen,
+	PermProductAdd, PermProductDelete,
+	PermManifestUpload, PermManifestRead,
+	PermAssignmentManage, PermRoleManage, PermUserManage, PermAuditRead, PermAPIKeyManage,
+}
+
+// DefaultRolePermissions mirrors the roles seeded by the migrations. It is used for
+// tokens issued without the database (dummyLogin) and for tokens without permissions.
+var DefaultRolePermissions = map[string][]string{
+	RoleEmployee: {
+		PermPVZRead, PermReceptionCreate, PermReceptionClose,
+		PermProductAdd, PermProductDelete, PermManifestRead,
+	},
+	RoleModerator: {
+		PermPVZCreate, PermPVZRead, PermPVZConfigure, PermPVZAny,
+		PermReceptionForceClose, PermReceptionReopen,
+		PermManifestUpload, PermManifestRead, PermAssignmentManage, PermUserManage, PermAuditRead,
+		PermAPIKeyManage,
+	},
+	RoleAdmin: AllPermissions,
+	RoleAuditor: {
+		PermPVZRead, PermPVZAny, PermManifestRead, PermAuditRead,
+	},
+	RoleSupervisor: {
+		PermPVZRead, PermReceptionForceClose, PermReceptionReopen, PermManifestRead, PermAuditRead,
+	},
+}
+
+// Covers reports whether the claims grant every permission in perms. Used to stop users
+// from handing out roles more powerful than their own.
+func (c *Claims) Covers(perms []string) bool {
+	for _, p := range perms {
+		if !c.Can(p) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsKnownPermission reports whether perm is one of AllPermissions.
+func IsKnownPermission(perm string) bool {
+	for _, p := range AllPermissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Can reports whether the claims grant perm. Tokens issued before permissions were
+// introduced fall back to the default permission set of their role.
+func (c *Claims) Can(perm string) bool {
+	perms := c.Permissions
+	if perms == nil {
+		perms = DefaultRolePermissions[c.Role]
+	}
+	for _, p := range perms {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// AllowsPVZ reports whether the token may act on the PVZ. Only API keys can be limited to
+// a set of PVZs; an empty set means any PVZ.
+func (c *Claims) AllowsPVZ(pvzID string) bool {
+	if len(c.PVZIDs) == 0 {
+		return true
+	}
+	for _, id := range c.PVZIDs {
+		if id == pvzID {
+			return true
+		}
+	}
+	return false
+}
@@ -1,55 +1,245 @@
 package tokens
 
 import (
+	"AvitoPVZService/Service/internal/logging"
+	"AvitoPVZService/Service/internal/tracing"
 	"context"
+	"fmt"
 	"github.com/golang-jwt/jwt/v4"
 	"net/http"
 	"strings"
 	"time"
 )
 
-var jwtSecret = []byte("your_jwt_secret")
+// JWTSecret signs and verifies tokens; main sets it from JWT_SECRET.
+var JWTSecret = []byte("your_jwt_secret")
+
+// Token purposes for intermediate tokens of the login flow. Regular access tokens have
+// an empty purpose, and only they are accepted by AuthMiddleware and PermissionMiddleware.
+const (
+	PurposeAccess        = ""
+	PurposeMFA           = "mfa"            // password checked, second factor pending
+	PurposeMFAEnrollment = "mfa_enrollment" // second factor required but not enrolled yet
+)
 
 type Claims struct {
-	UserID string `json:"user_id"`
-	Role   string `json:"role"`
+	UserID      string   `json:"user_id"`
+	Role        string   `json:"role"`
+	Permissions []string `json:"permissions,omitempty"`
+	Purpose     string   `json:"purpose,omitempty"`
+	// APIKeyID and PVZIDs are set only for requests authenticated by an API key.
+	APIKeyID string   `json:"api_key_id,omitempty"`
+	PVZIDs   []string `json:"pvz_ids,omitempty"`
+	// Dummy marks tokens minted by /dummyLogin without any credentials.
+	Dummy bool `json:"dummy,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// CreateToken issues a token carrying the default permission set of the role.
 func CreateToken(userID, role string) (string, error) {
+	return CreateTokenWithPermissions(userID, role, DefaultRolePermissions[role])
+}
+
+func CreateTokenWithPermissions(userID, role string, permissions []string) (string, error) {
 	claims := Claims{
-		UserID: userID,
-		Role:   role,
+		UserID:      userID,
+		Role:        role,
+		Permissions: permissions,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	
-	return t.SignedString(jwtSecret)
+
+	return t.SignedString(JWTSecret)
 }
 
+// CreateDummyToken issues a tagged token for /dummyLogin, see RejectDummyTokens.
+func CreateDummyToken(userID, role string) (string, error) {
+	claims := Claims{
+		UserID:      userID,
+		Role:        role,
+		Permissions: DefaultRolePermissions[role],
+		Dummy:       true,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return t.SignedString(JWTSecret)
+}
+
+// CreatePurposeToken issues a short-lived token usable only on endpoints accepting the purpose.
+func CreatePurposeToken(userID, role, purpose string, ttl time.Duration) (string, error) {
+	claims := Claims{
+		UserID:  userID,
+		Role:    role,
+		Purpose: purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	}
+	t := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+
+	return t.SignedString(JWTSecret)
+}
+
+// ParsePurposeToken validates a token passed in a request body rather than a header.
+func ParsePurposeToken(tok, purpose string) (*Claims, error) {
+	parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(t *jwt.Token) (interface{}, error) {
+		return JWTSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	c := parsed.Claims.(*Claims)
+	if !parsed.Valid || c.Purpose != purpose {
+		return nil, fmt.Errorf("token is not valid for %q", purpose)
+	}
+
+	return c, nil
+}
+
+// UserDeactivated, when set, is consulted for every authenticated request so that tokens
+// of deactivated users stop working before they expire.
+var UserDeactivated func(userID string) (error, bool)
+
+// RejectDummyTokens makes every endpoint refuse tokens minted by /dummyLogin. Set in
+// production, so a dummy token obtained from another environment is worthless.
+var RejectDummyTokens bool
+
 type contextKey string
 
 const claimsKey = contextKey("claims")
 
-func AuthMiddleware(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+// ClaimsFromContext returns the claims stored by AuthMiddleware, or nil for anonymous requests.
+func ClaimsFromContext(ctx context.Context) *Claims {
+	c, _ := ctx.Value(claimsKey).(*Claims)
+	return c
+}
+
+// authenticate resolves the credentials of the request and checks that the token purpose
+// is one of purposes. On failure it writes the error and returns nil.
+func authenticate(w http.ResponseWriter, r *http.Request, purposes ...string) *Claims {
+	c := resolvedAPIKey(r.Context())
+	if c == nil {
+		var status int
+		var msg string
+		c, status, msg = resolveCredentials(r.Header.Get("Authorization"), r.Header.Get("X-API-Key"), purposes)
+		if c == nil {
+			http.Error(w, fmt.Sprintf(`{"message":%q}`, msg), status)
+			return nil
+		}
+	}
+	tracing.SetUser(r.Context(), c.UserID, c.Role, c.APIKeyID)
+	logging.SetUser(r.Context(), c.UserID)
+
+	return c
+}
+
+// resolveCredentials accepts either a bearer JWT or an API key (in X-API-Key or as
+// "Authorization: ApiKey <key>"). On failure it returns nil with the HTTP status and message.
+func resolveCredentials(authorization, apiKey string, purposes []string) (*Claims, int, string) {
+	if apiKey == "" && strings.HasPrefix(authorization, apiKeyScheme) {
+		apiKey = strings.TrimPrefix(authorization, apiKeyScheme)
+	}
+	if apiKey != "" {
+		return authenticateAPIKey(apiKey)
+	}
+
+	if authorization == "" {
+		return nil, http.StatusUnauthorized, "missing auth"
+	}
+	c, err := parseBearer(authorization)
+	if err != nil {
+		return nil, http.StatusUnauthorized, "invalid token"
+	}
+	// API key claims are never issued as JWTs
+	if !hasPurpose(c, purposes) || c.APIKeyID != "" {
+		return nil, http.StatusUnauthorized, "invalid token"
+	}
+	if c.Dummy && RejectDummyTokens {
+		return nil, http.StatusUnauthorized, "dummy tokens are not accepted"
+	}
+
+	if UserDeactivated != nil {
+		err, deactivated := UserDeactivated(c.UserID)
+		if err != nil {
+			return nil, http.StatusInternalServerError, "cannot check user"
+		}
+		if deactivated {
+			return nil, http.StatusUnauthorized, "user is deactivated"
+		}
+	}
+
+	return c, 0, ""
+}
+
+func parseBearer(authorization string) (*Claims, error) {
+	tok := strings.TrimPrefix(authorization, "Bearer ")
+	parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(t *jwt.Token) (interface{}, error) {
+		return JWTSecret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.Valid {
+		return nil, fmt.Errorf("invalid token")
+	}
+
+	return parsed.Claims.(*Claims), nil
+}
+
+func hasPurpose(c *Claims, purposes []string) bool {
+	for _, p := range purposes {
+		if c.Purpose == p {
+			return true
+		}
+	}
+	return false
+}
+
+// PurposeMiddleware accepts tokens of the listed purposes; include PurposeAccess to also
+// accept regular access tokens.
+func PurposeMiddleware(h http.HandlerFunc, purposes ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := authenticate(w, r, purposes...)
+		if c == nil {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey, c))
+		h(w, r)
+	}
+}
+
+// PermissionMiddleware lets the request through only if the token grants every permission.
+func PermissionMiddleware(h http.HandlerFunc, perms ...string) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		hdr := r.Header.Get("Authorization")
-		if hdr == "" {
-			http.Error(w, `{"message":"missing auth"}`, http.StatusUnauthorized)
+		c := authenticate(w, r, PurposeAccess)
+		if c == nil {
 			return
 		}
-		tok := strings.TrimPrefix(hdr, "Bearer ")
-		parsed, err := jwt.ParseWithClaims(tok, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
-		if err != nil || !parsed.Valid {
-			http.Error(w, `{"message":"invalid token"}`, http.StatusUnauthorized)
+		for _, perm := range perms {
+			if !c.Can(perm) {
+				http.Error(w, `{"message":"forbidden"}`, http.StatusForbidden)
+				return
+			}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey, c))
+		h(w, r)
+	}
+}
+
+func AuthMiddleware(h http.HandlerFunc, roles ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c := authenticate(w, r, PurposeAccess)
+		if c == nil {
 			return
 		}
-		c := parsed.Claims.(*Claims)
 		if len(roles) > 0 {
 			ok := false
 			for _, role := range roles {
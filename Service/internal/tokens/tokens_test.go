@@ -1,10 +1,17 @@
 package tokens
 
 import (
+	"AvitoPVZService/Service/internal/domain"
+	"context"
 	"github.com/golang-jwt/jwt/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestCreateToken_And_ParseClaims(t *testing.T) {
@@ -14,7 +21,7 @@ func TestCreateToken_And_ParseClaims(t *testing.T) {
 	}
 
 	parsed, err := jwt.ParseWithClaims(tokenStr, &Claims{}, func(t *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
+		return JWTSecret, nil
 	})
 	if err != nil {
 		t.Fatalf("Failed to parse token: %v", err)
@@ -83,3 +90,211 @@ func TestAuthMiddleware_Success(t *testing.T) {
 		t.Error("handler was not called but should have been")
 	}
 }
+
+func TestPermissionMiddleware_MissingPermission(t *testing.T) {
+	tokenStr, _ := CreateTokenWithPermissions("u1", "custom", []string{PermPVZRead})
+	h := PermissionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called without permission")
+	}, PermPVZCreate)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	h(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("expected 403, got %d", rec.Code)
+	}
+}
+
+func TestPermissionMiddleware_Success(t *testing.T) {
+	tokenStr, _ := CreateTokenWithPermissions("u1", "custom", []string{PermAuditRead})
+	called := false
+	h := PermissionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		if c := ClaimsFromContext(r.Context()); c == nil || c.UserID != "u1" {
+			t.Errorf("unexpected claims in context: %+v", c)
+		}
+	}, PermAuditRead)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	h(rec, req)
+	if !called {
+		t.Error("handler was not called but should have been")
+	}
+}
+
+func TestClaimsCan_FallsBackToRoleDefaults(t *testing.T) {
+	c := &Claims{UserID: "u1", Role: RoleModerator}
+	if !c.Can(PermPVZCreate) {
+		t.Error("moderator without explicit permissions should be able to create pvz")
+	}
+	if c.Can(PermRoleManage) {
+		t.Error("moderator should not manage roles")
+	}
+}
+
+func TestAuthMiddleware_DeactivatedUser(t *testing.T) {
+	UserDeactivated = func(userID string) (error, bool) { return nil, userID == "gone" }
+	defer func() { UserDeactivated = nil }()
+
+	tokenStr, _ := CreateToken("gone", "moderator")
+	h := AuthMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called for deactivated user")
+	}, "moderator")
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tokenStr)
+	h(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rec.Code)
+	}
+}
+
+func TestLockoutPolicy_Delay(t *testing.T) {
+	p := LockoutPolicy{MaxFailures: 5, Window: time.Minute, BaseDelay: time.Second, Lockout: 15 * time.Minute}
+	cases := map[int]time.Duration{
+		1: 0,
+		2: time.Second,
+		3: 2 * time.Second,
+		4: 4 * time.Second,
+		5: 15 * time.Minute,
+		9: 15 * time.Minute,
+	}
+	for failures, want := range cases {
+		if got := p.Delay(failures); got != want {
+			t.Errorf("Delay(%d) = %v, want %v", failures, got, want)
+		}
+	}
+	if (LockoutPolicy{}).Delay(100) != 0 {
+		t.Error("zero policy must not delay")
+	}
+}
+
+func TestTOTPCode_RFC6238(t *testing.T) {
+	// Secret "12345678901234567890" from RFC 6238, truncated to 6 digits.
+	code, err := TOTPCode("GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ", TOTPStep(time.Unix(59, 0)))
+	if err != nil {
+		t.Fatalf("TOTPCode error: %v", err)
+	}
+	if code != "287082" {
+		t.Errorf("expected 287082, got %s", code)
+	}
+}
+
+func TestValidateTOTP_AllowsClockSkew(t *testing.T) {
+	secret, _ := NewTOTPSecret()
+	now := time.Now()
+	prev, _ := TOTPCode(secret, TOTPStep(now)-1)
+	if step, ok := ValidateTOTP(secret, prev, now); !ok || step != TOTPStep(now)-1 {
+		t.Errorf("expected previous step to be accepted, got %d %v", step, ok)
+	}
+	old, _ := TOTPCode(secret, TOTPStep(now)-3)
+	if _, ok := ValidateTOTP(secret, old, now); ok {
+		t.Error("expected old code to be rejected")
+	}
+}
+
+func TestPermissionMiddleware_RejectsMFAToken(t *testing.T) {
+	tok, _ := CreatePurposeToken("user1", RoleModerator, PurposeMFA, time.Minute)
+	h := PermissionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("handler should not be called with mfa token")
+	}, PermPVZCreate)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+tok)
+	rr := httptest.NewRecorder()
+	h(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected 401, got %d", rr.Code)
+	}
+}
+
+func withAPIKey(t *testing.T, key *domain.APIKey) {
+	APIKeyLookup = func(keyHash string, at time.Time) (error, *domain.APIKey) {
+		if keyHash != HashOpaqueToken("pvz_good") {
+			return nil, nil
+		}
+		return nil, key
+	}
+	t.Cleanup(func() { APIKeyLookup = nil })
+}
+
+func TestPermissionMiddleware_APIKey(t *testing.T) {
+	withAPIKey(t, &domain.APIKey{ID: "k1", Permissions: []string{PermPVZRead}})
+
+	cases := []struct {
+		header, value string
+		perm          string
+		want          int
+	}{
+		{"X-API-Key", "pvz_good", PermPVZRead, http.StatusOK},
+		{"Authorization", "ApiKey pvz_good", PermPVZRead, http.StatusOK},
+		{"X-API-Key", "pvz_good", PermPVZCreate, http.StatusForbidden},
+		{"X-API-Key", "pvz_revoked", PermPVZRead, http.StatusUnauthorized},
+	}
+	for _, tc := range cases {
+		h := PermissionMiddleware(func(w http.ResponseWriter, r *http.Request) {
+			if c := ClaimsFromContext(r.Context()); c.APIKeyID != "k1" || c.Role != RoleService {
+				t.Errorf("unexpected claims %+v", c)
+			}
+		}, tc.perm)
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(tc.header, tc.value)
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		if rr.Code != tc.want {
+			t.Errorf("%s %s %s: expected %d, got %d", tc.header, tc.value, tc.perm, tc.want, rr.Code)
+		}
+	}
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	withAPIKey(t, &domain.APIKey{ID: "k1", Permissions: []string{PermPVZRead}})
+	interceptor := UnaryServerInterceptor(map[string]string{
+		"/pvz.v1.PVZService/GetPVZList": PermPVZRead,
+		"/grpc.health.v1.Health/Check":  "",
+	})
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return "ok", nil }
+
+	call := func(method string, md metadata.MD) codes.Code {
+		ctx := metadata.NewIncomingContext(context.Background(), md)
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return status.Code(err)
+	}
+
+	if code := call("/pvz.v1.PVZService/GetPVZList", metadata.Pairs("x-api-key", "pvz_good")); code != codes.OK {
+		t.Errorf("expected OK, got %v", code)
+	}
+	if code := call("/pvz.v1.PVZService/GetPVZList", metadata.MD{}); code != codes.Unauthenticated {
+		t.Errorf("expected Unauthenticated, got %v", code)
+	}
+	if code := call("/pvz.v1.PVZService/Unknown", metadata.Pairs("x-api-key", "pvz_good")); code != codes.PermissionDenied {
+		t.Errorf("expected PermissionDenied, got %v", code)
+	}
+	if code := call("/grpc.health.v1.Health/Check", metadata.MD{}); code != codes.OK {
+		t.Errorf("expected public health check, got %v", code)
+	}
+	tok, _ := CreateToken("user1", RoleEmployee)
+	if code := call("/pvz.v1.PVZService/GetPVZList", metadata.Pairs("authorization", "Bearer "+tok)); code != codes.OK {
+		t.Errorf("expected OK for jwt, got %v", code)
+	}
+}
+
+func TestPermissionMiddleware_RejectsDummyTokens(t *testing.T) {
+	tok, _ := CreateDummyToken("user1", RoleModerator)
+	h := PermissionMiddleware(func(w http.ResponseWriter, r *http.Request) {}, PermPVZCreate)
+
+	for reject, want := range map[bool]int{false: http.StatusOK, true: http.StatusUnauthorized} {
+		RejectDummyTokens = reject
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		rr := httptest.NewRecorder()
+		h(rr, req)
+		if rr.Code != want {
+			t.Errorf("reject=%v: expected %d, got %d", reject, want, rr.Code)
+		}
+	}
+	RejectDummyTokens = false
+}
@@ -0,0 +1,129 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+	"os"
+)
+
+// Exporters accepted by Setup.
+const (
+	ExporterNone   = "none"
+	ExporterOTLP   = "otlp"
+	ExporterStdout = "stdout"
+)
+
+const instrumentationName = "AvitoPVZService"
+
+// Attributes every span of a request carries once they are known.
+const (
+	AttrPVZID    = attribute.Key("pvz.id")
+	AttrUserID   = attribute.Key("enduser.id")
+	AttrUserRole = attribute.Key("enduser.role")
+	AttrAPIKeyID = attribute.Key("apikey.id")
+)
+
+type Config struct {
+	ServiceName string
+	// Exporter is "otlp" (gRPC to OTLPEndpoint), "stdout" (to File or standard output) or "none".
+	Exporter     string
+	OTLPEndpoint string
+	OTLPInsecure bool
+	File         string
+	// SampleRatio is the share of new traces recorded; a sampled parent is always followed.
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and the W3C trace context propagator. The
+// returned function flushes the spans still buffered and must run on shutdown.
+func Setup(ctx context.Context, config Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var (
+		exporter sdktrace.SpanExporter
+		closeOut = func() error { return nil }
+		err      error
+	)
+	switch config.Exporter {
+	case ExporterNone, "":
+		return func(context.Context) error { return nil }, nil
+	case ExporterOTLP:
+		opts := []otlptracegrpc.Option{}
+		if config.OTLPEndpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(config.OTLPEndpoint))
+		}
+		if config.OTLPInsecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		}
+		exporter, err = otlptracegrpc.New(ctx, opts...)
+	case ExporterStdout:
+		out := os.Stdout
+		if config.File != "" {
+			out, err = os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+			if err != nil {
+				return nil, fmt.Errorf("tracing: %w", err)
+			}
+			closeOut = out.Close
+		}
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(out))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", config.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(config.ServiceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(config.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := closeOut(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// Tracer is the tracer of the service, taken from the global provider on every call so that
+// spans started before Setup, e.g. in tests, do not pin a stale provider.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// SetPVZ tags the current span with the PVZ the request works on.
+func SetPVZ(ctx context.Context, pvzID string) {
+	if pvzID != "" {
+		trace.SpanFromContext(ctx).SetAttributes(AttrPVZID.String(pvzID))
+	}
+}
+
+// SetUser tags the current span with the authenticated caller.
+func SetUser(ctx context.Context, userID, role, apiKeyID string) {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(AttrUserID.String(userID), AttrUserRole.String(role))
+	if apiKeyID != "" {
+		span.SetAttributes(AttrAPIKeyID.String(apiKeyID))
+	}
+}
@@ -0,0 +1,150 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+func record(t *testing.T) *tracetest.SpanRecorder {
+	t.Helper()
+	recorder := tracetest.NewSpanRecorder()
+	prevProvider, prevPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	if _, err := Setup(context.Background(), Config{Exporter: ExporterNone}); err != nil {
+		t.Fatal(err)
+	}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() {
+		otel.SetTracerProvider(prevProvider)
+		otel.SetTextMapPropagator(prevPropagator)
+	})
+
+	return recorder
+}
+
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) string {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value.Emit()
+		}
+	}
+	return ""
+}
+
+func TestHTTP_ContinuesIncomingTrace(t *testing.T) {
+	recorder := record(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/pvz/pvz1", nil)
+	req.Header.Set("traceparent", parent)
+	req, span := StartHTTP(req)
+	SetPVZ(req.Context(), "pvz1")
+	SetUser(req.Context(), "emp1", "employee", "")
+	EndHTTP(span, http.MethodGet, "/pvz/{id}", http.StatusInternalServerError)
+
+	spans := recorder.Ended()
+	if len(spans) != 1 {
+		t.Fatalf("expected 1 span, got %d", len(spans))
+	}
+	s := spans[0]
+	if s.Name() != "GET /pvz/{id}" || s.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected span %q with parent %s", s.Name(), s.Parent().TraceID())
+	}
+	if attr(s, AttrPVZID) != "pvz1" || attr(s, AttrUserID) != "emp1" || attr(s, AttrUserRole) != "employee" {
+		t.Errorf("unexpected attributes %v", s.Attributes())
+	}
+	if s.Status().Code != codes.Error {
+		t.Errorf("a 500 must fail the span, got %v", s.Status())
+	}
+}
+
+func TestTransport_InjectsTraceContext(t *testing.T) {
+	recorder := record(t)
+
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	ctx, span := Tracer().Start(context.Background(), "caller")
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/keys", nil)
+	resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	span.End()
+
+	client := recorder.Ended()[0]
+	if client.Parent().SpanID() != span.SpanContext().SpanID() {
+		t.Errorf("client span is not a child of the caller")
+	}
+	if got == "" || got[36:52] != client.SpanContext().SpanID().String() {
+		t.Errorf("expected traceparent naming the client span, got %q", got)
+	}
+}
+
+func TestUnaryServerInterceptor_ContinuesIncomingTrace(t *testing.T) {
+	recorder := record(t)
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("traceparent", parent))
+	info := &grpc.UnaryServerInfo{FullMethod: "/pvz.v1.PVZService/GetPVZList"}
+	_, _ = UnaryServerInterceptor()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		SetUser(ctx, "mod1", "moderator", "key1")
+		return nil, nil
+	})
+
+	s := recorder.Ended()[0]
+	if s.Name() != "pvz.v1.PVZService/GetPVZList" || s.Parent().TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("unexpected span %q with parent %s", s.Name(), s.Parent().TraceID())
+	}
+	if attr(s, AttrUserID) != "mod1" || attr(s, AttrAPIKeyID) != "key1" {
+		t.Errorf("unexpected attributes %v", s.Attributes())
+	}
+}
+
+func TestSetup_StdoutToFile(t *testing.T) {
+	prevProvider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(prevProvider) })
+
+	file := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := Setup(context.Background(), Config{
+		ServiceName: "test", Exporter: ExporterStdout, File: file, SampleRatio: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, span := Tracer().Start(context.Background(), "job close_stale_receptions")
+	span.End()
+	if err := shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var exported struct{ Name string }
+	if err := json.Unmarshal(data, &exported); err != nil || exported.Name != "job close_stale_receptions" {
+		t.Errorf("unexpected export %q: %v", data, err)
+	}
+}
+
+func TestSetup_UnknownExporter(t *testing.T) {
+	if _, err := Setup(context.Background(), Config{Exporter: "zipkin"}); err == nil {
+		t.Error("expected an error for an unknown exporter")
+	}
+}
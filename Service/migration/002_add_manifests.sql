@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- ожидаемые манифесты поставок: список штрихкодов, которые должны прийти в ПВЗ
+CREATE TABLE avito_schema.manifests (
+    id UUID PRIMARY KEY,
+    pvz_id UUID NOT NULL REFERENCES avito_schema.pvz(id) ON DELETE CASCADE,
+    reception_id UUID,
+    uploaded_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    items JSONB NOT NULL DEFAULT '[]',
+    report JSONB
+);
+
+-- индекс для поиска ещё не сверенного манифеста ПВЗ
+CREATE INDEX IF NOT EXISTS idx_manifests_pending ON avito_schema.manifests(pvz_id, uploaded_at) WHERE reception_id IS NULL;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.manifests;
+-- +goose StatementEnd
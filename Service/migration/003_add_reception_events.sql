@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- индивидуальный порог простоя приёма для ПВЗ (NULL — глобальное значение из конфига)
+ALTER TABLE avito_schema.pvz ADD COLUMN reception_idle_timeout INTERVAL;
+
+-- журнал событий по приёмам (автозакрытие, ручные вмешательства)
+CREATE TABLE avito_schema.reception_events (
+    id UUID PRIMARY KEY,
+    pvz_id UUID NOT NULL REFERENCES avito_schema.pvz(id) ON DELETE CASCADE,
+    reception_id UUID NOT NULL,
+    type TEXT NOT NULL,
+    reason TEXT NOT NULL DEFAULT '',
+    actor TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_reception_events_pvz ON avito_schema.reception_events(pvz_id, created_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.reception_events;
+ALTER TABLE avito_schema.pvz DROP COLUMN IF EXISTS reception_idle_timeout;
+-- +goose StatementEnd
@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- закрепление сотрудников за ПВЗ с периодом действия
+CREATE TABLE avito_schema.assignments (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES avito_schema.users(id) ON DELETE CASCADE,
+    pvz_id UUID NOT NULL REFERENCES avito_schema.pvz(id) ON DELETE CASCADE,
+    valid_from TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    valid_to TIMESTAMP WITH TIME ZONE,
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    CHECK (valid_to IS NULL OR valid_to > valid_from)
+);
+
+-- индекс для проверки доступа сотрудника к ПВЗ на каждом запросе
+CREATE INDEX IF NOT EXISTS idx_assignments_user_pvz ON avito_schema.assignments(user_id, pvz_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.assignments;
+-- +goose StatementEnd
@@ -0,0 +1,36 @@
+-- +goose Up
+-- +goose StatementBegin
+-- роли как наборы разрешений
+CREATE TABLE avito_schema.roles (
+    name TEXT PRIMARY KEY,
+    permissions TEXT[] NOT NULL DEFAULT '{}',
+    description TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO avito_schema.roles(name, permissions, description) VALUES
+    ('employee',
+     '{pvz.read,reception.create,reception.close,product.add,product.delete,manifest.read}',
+     'сотрудник ПВЗ'),
+    ('moderator',
+     '{pvz.create,pvz.read,pvz.configure,pvz.any,reception.force_close,reception.reopen,manifest.upload,manifest.read,assignment.manage,audit.read}',
+     'модератор'),
+    ('admin',
+     '{pvz.create,pvz.read,pvz.configure,pvz.any,reception.create,reception.close,reception.force_close,reception.reopen,product.add,product.delete,manifest.upload,manifest.read,assignment.manage,role.manage,audit.read}',
+     'администратор'),
+    ('auditor',
+     '{pvz.read,pvz.any,manifest.read,audit.read}',
+     'аудитор, только чтение'),
+    ('supervisor',
+     '{pvz.read,reception.force_close,reception.reopen,manifest.read,audit.read}',
+     'региональный супервайзер, действует в закреплённых ПВЗ')
+ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE avito_schema.users
+    ADD CONSTRAINT fk_users_role FOREIGN KEY (role) REFERENCES avito_schema.roles(name);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE avito_schema.users DROP CONSTRAINT IF EXISTS fk_users_role;
+DROP TABLE IF EXISTS avito_schema.roles;
+-- +goose StatementEnd
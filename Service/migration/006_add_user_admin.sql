@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- деактивация пользователей без удаления
+ALTER TABLE avito_schema.users ADD COLUMN deactivated_at TIMESTAMP WITH TIME ZONE;
+
+-- приглашения для регистрации с привилегированными ролями
+CREATE TABLE avito_schema.invites (
+    token_hash TEXT PRIMARY KEY,
+    email TEXT NOT NULL DEFAULT '',
+    role TEXT NOT NULL REFERENCES avito_schema.roles(name),
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+UPDATE avito_schema.roles
+SET permissions = array_append(permissions, 'user.manage')
+WHERE name IN ('moderator', 'admin')
+  AND NOT 'user.manage' = ANY(permissions);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE avito_schema.roles SET permissions = array_remove(permissions, 'user.manage');
+DROP TABLE IF EXISTS avito_schema.invites;
+ALTER TABLE avito_schema.users DROP COLUMN IF EXISTS deactivated_at;
+-- +goose StatementEnd
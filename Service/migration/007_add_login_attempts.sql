@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- неудачные попытки входа по аккаунту (email:<email>) и по IP (ip:<addr>)
+CREATE TABLE avito_schema.login_attempts (
+    key TEXT PRIMARY KEY,
+    failures INTEGER NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.login_attempts;
+-- +goose StatementEnd
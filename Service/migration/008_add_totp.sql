@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- второй фактор (TOTP); секрет сохраняется при регистрации устройства, включается после подтверждения кодом
+ALTER TABLE avito_schema.users
+    ADD COLUMN totp_secret TEXT,
+    ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE,
+    ADD COLUMN totp_last_step BIGINT;
+
+-- одноразовые коды восстановления (хранится только хеш)
+CREATE TABLE avito_schema.recovery_codes (
+    user_id UUID NOT NULL REFERENCES avito_schema.users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (user_id, code_hash)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.recovery_codes;
+ALTER TABLE avito_schema.users
+    DROP COLUMN IF EXISTS totp_secret,
+    DROP COLUMN IF EXISTS totp_enabled,
+    DROP COLUMN IF EXISTS totp_last_step;
+-- +goose StatementEnd
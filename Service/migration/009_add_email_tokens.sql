@@ -0,0 +1,24 @@
+-- +goose Up
+-- +goose StatementBegin
+-- подтверждение email; существующие пользователи считаются подтверждёнными
+ALTER TABLE avito_schema.users ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE;
+UPDATE avito_schema.users SET email_verified_at = registration_date;
+
+-- одноразовые токены из писем (хранится только хеш)
+CREATE TABLE avito_schema.email_tokens (
+    token_hash TEXT PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES avito_schema.users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL CHECK (purpose IN ('verify_email', 'reset_password')),
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX email_tokens_user_idx ON avito_schema.email_tokens(user_id, purpose);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.email_tokens;
+ALTER TABLE avito_schema.users DROP COLUMN IF EXISTS email_verified_at;
+-- +goose StatementEnd
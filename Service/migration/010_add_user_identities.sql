@@ -0,0 +1,17 @@
+-- +goose Up
+-- +goose StatementBegin
+-- внешние учётные записи (OIDC); пользователи без пароля входят только через SSO
+CREATE TABLE avito_schema.user_identities (
+    issuer TEXT NOT NULL,
+    subject TEXT NOT NULL,
+    user_id UUID NOT NULL REFERENCES avito_schema.users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_login_at TIMESTAMP WITH TIME ZONE,
+    PRIMARY KEY (issuer, subject)
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.user_identities;
+-- +goose StatementEnd
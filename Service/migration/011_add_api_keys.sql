@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- ключи доступа для сервисов (хранится только хеш ключа)
+CREATE TABLE avito_schema.api_keys (
+    id UUID PRIMARY KEY,
+    name TEXT NOT NULL,
+    key_hash TEXT NOT NULL UNIQUE,
+    permissions TEXT[] NOT NULL,
+    pvz_ids TEXT[] NOT NULL DEFAULT '{}',
+    created_by TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    last_used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+UPDATE avito_schema.roles
+SET permissions = array_append(permissions, 'apikey.manage')
+WHERE name IN ('moderator', 'admin')
+  AND NOT 'apikey.manage' = ANY(permissions);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+UPDATE avito_schema.roles SET permissions = array_remove(permissions, 'apikey.manage');
+DROP TABLE IF EXISTS avito_schema.api_keys;
+-- +goose StatementEnd
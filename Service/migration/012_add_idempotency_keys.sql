@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+-- первые ответы на запросы с Idempotency-Key; status_code NULL — запрос ещё выполняется
+CREATE TABLE avito_schema.idempotency_keys (
+    subject TEXT NOT NULL,
+    key TEXT NOT NULL,
+    request_hash TEXT NOT NULL,
+    status_code INT,
+    content_type TEXT NOT NULL DEFAULT '',
+    response BYTEA,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    PRIMARY KEY (subject, key)
+);
+
+CREATE INDEX idempotency_keys_expires_idx ON avito_schema.idempotency_keys(expires_at);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS avito_schema.idempotency_keys;
+-- +goose StatementEnd
@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- версия ПВЗ для оптимистичной блокировки: увеличивается при каждом изменении приёмок
+ALTER TABLE avito_schema.pvz ADD COLUMN version BIGINT NOT NULL DEFAULT 1;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE avito_schema.pvz DROP COLUMN IF EXISTS version;
+-- +goose StatementEnd
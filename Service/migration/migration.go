@@ -0,0 +1,175 @@
+// Package migration embeds the SQL migrations of the service and applies them. The files
+// keep the goose format and the goose_db_version table, so a database migrated with the goose
+// CLI and one migrated by the service are interchangeable.
+package migration
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed *.sql
+var files embed.FS
+
+// Migration is one numbered file: the statements that apply it and the ones that revert it.
+type Migration struct {
+	Version int64
+	Name    string
+	Up      []string
+	Down    []string
+}
+
+// Embedded returns the migrations built into the binary, ordered by version.
+func Embedded() ([]Migration, error) {
+	return Load(files)
+}
+
+// Latest is the version of the last embedded migration, the schema this build expects.
+func Latest() int64 {
+	names, _ := fs.Glob(files, "*.sql")
+	var latest int64
+	for _, name := range names {
+		if version, err := parseVersion(name); err == nil && version > latest {
+			latest = version
+		}
+	}
+
+	return latest
+}
+
+// Load reads every NNN_name.sql file at the root of fsys.
+func Load(fsys fs.FS) ([]Migration, error) {
+	names, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(names))
+	seen := make(map[int64]string, len(names))
+	for _, name := range names {
+		version, err := parseVersion(name)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, name, version)
+		}
+		seen[version] = name
+
+		body, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return nil, err
+		}
+		up, down, err := parse(string(body))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, Up: up, Down: down})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+func parseVersion(name string) (int64, error) {
+	prefix, _, ok := strings.Cut(path.Base(name), "_")
+	version, err := strconv.ParseInt(prefix, 10, 64)
+	if !ok || err != nil || version <= 0 {
+		return 0, fmt.Errorf("migration %s must be named NNN_description.sql", name)
+	}
+
+	return version, nil
+}
+
+const annotation = "-- +goose "
+
+// parse splits a goose file into its Up and Down statements. Statements end with a semicolon
+// at the end of a line unless they are wrapped in StatementBegin/StatementEnd, as functions
+// and multi-statement blocks are.
+func parse(body string) (up, down []string, err error) {
+	var (
+		section *[]string
+		inBlock bool
+		buf     strings.Builder
+	)
+	flush := func() {
+		if hasSQL(buf.String()) {
+			*section = append(*section, strings.TrimSpace(buf.String()))
+		}
+		buf.Reset()
+	}
+
+	for n, line := range strings.Split(body, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, annotation) {
+			switch cmd := strings.TrimSpace(strings.TrimPrefix(trimmed, annotation)); cmd {
+			case "Up", "Down":
+				if inBlock {
+					return nil, nil, fmt.Errorf("line %d: %s inside a statement block", n+1, cmd)
+				}
+				if section != nil && hasSQL(buf.String()) {
+					return nil, nil, fmt.Errorf("line %d: statement is not terminated with ;", n+1)
+				}
+				buf.Reset()
+				section = &up
+				if cmd == "Down" {
+					section = &down
+				}
+			case "StatementBegin":
+				if section == nil || inBlock {
+					return nil, nil, fmt.Errorf("line %d: unexpected StatementBegin", n+1)
+				}
+				flush()
+				inBlock = true
+			case "StatementEnd":
+				if !inBlock {
+					return nil, nil, fmt.Errorf("line %d: StatementEnd without StatementBegin", n+1)
+				}
+				flush()
+				inBlock = false
+			default:
+				return nil, nil, fmt.Errorf("line %d: unsupported annotation %q", n+1, cmd)
+			}
+			continue
+		}
+		if section == nil {
+			if hasSQL(line) {
+				return nil, nil, fmt.Errorf("line %d: SQL before -- +goose Up", n+1)
+			}
+			continue
+		}
+
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+		if !inBlock && strings.HasSuffix(trimmed, ";") && !strings.HasPrefix(trimmed, "--") {
+			flush()
+		}
+	}
+	if inBlock {
+		return nil, nil, fmt.Errorf("StatementBegin without StatementEnd")
+	}
+	if hasSQL(buf.String()) {
+		return nil, nil, fmt.Errorf("statement is not terminated with ;")
+	}
+	if len(up) == 0 {
+		return nil, nil, fmt.Errorf("no -- +goose Up statements")
+	}
+
+	return up, down, nil
+}
+
+// hasSQL reports whether text holds anything besides blank lines and comments.
+func hasSQL(text string) bool {
+	for _, line := range strings.Split(text, "\n") {
+		if trimmed := strings.TrimSpace(line); trimmed != "" && !strings.HasPrefix(trimmed, "--") {
+			return true
+		}
+	}
+
+	return false
+}
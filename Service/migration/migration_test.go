@@ -0,0 +1,104 @@
+package migration
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestEmbedded_AreContiguous(t *testing.T) {
+	migrations, err := Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range migrations {
+		if m.Version != int64(i+1) {
+			t.Fatalf("migration %s has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if len(m.Down) == 0 {
+			t.Errorf("migration %s cannot be reverted", m.Name)
+		}
+	}
+	if Latest() != int64(len(migrations)) {
+		t.Errorf("Latest() = %d, want %d", Latest(), len(migrations))
+	}
+}
+
+func TestParse(t *testing.T) {
+	body := `-- leading comment
+-- +goose Up
+CREATE TABLE a (id INT);
+-- comment between statements
+CREATE INDEX a_id
+    ON a (id);
+-- +goose StatementBegin
+CREATE FUNCTION f() RETURNS INT AS $$
+BEGIN
+    RETURN 1;
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+DROP FUNCTION f;
+DROP TABLE a;
+`
+	up, down, err := parse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantUp := []string{
+		"CREATE TABLE a (id INT);",
+		"-- comment between statements\nCREATE INDEX a_id\n    ON a (id);",
+		"CREATE FUNCTION f() RETURNS INT AS $$\nBEGIN\n    RETURN 1;\nEND;\n$$ LANGUAGE plpgsql;",
+	}
+	if !reflect.DeepEqual(up, wantUp) {
+		t.Errorf("up = %q", up)
+	}
+	if !reflect.DeepEqual(down, []string{"DROP FUNCTION f;", "DROP TABLE a;"}) {
+		t.Errorf("down = %q", down)
+	}
+}
+
+func TestParse_Errors(t *testing.T) {
+	tests := map[string]string{
+		"no up":             "-- +goose Down\nDROP TABLE a;\n",
+		"sql before up":     "CREATE TABLE a (id INT);\n-- +goose Up\n",
+		"unterminated":      "-- +goose Up\nCREATE TABLE a (id INT)\n",
+		"open block":        "-- +goose Up\n-- +goose StatementBegin\nSELECT 1;\n",
+		"unknown":           "-- +goose Up\n-- +goose NO TRANSACTION\nSELECT 1;\n",
+		"down inside block": "-- +goose Up\n-- +goose StatementBegin\nSELECT 1;\n-- +goose Down\n",
+	}
+	for name, body := range tests {
+		if _, _, err := parse(body); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestLoad_RejectsBadNames(t *testing.T) {
+	up := &fstest.MapFile{Data: []byte("-- +goose Up\nSELECT 1;\n")}
+	if _, err := Load(fstest.MapFS{"schema.sql": up}); err == nil {
+		t.Error("expected an error for a file without a version")
+	}
+	if _, err := Load(fstest.MapFS{"001_a.sql": up, "1_b.sql": up}); err == nil {
+		t.Error("expected an error for a duplicate version")
+	}
+}
+
+func TestPending(t *testing.T) {
+	migrations := []Migration{{Version: 1, Name: "001"}, {Version: 2, Name: "002"}, {Version: 3, Name: "003"}}
+	now := time.Now()
+
+	todo, err := pending(migrations, map[int64]time.Time{1: now})
+	if err != nil || len(todo) != 2 || todo[0].Version != 2 || todo[1].Version != 3 {
+		t.Errorf("pending = %v, %v", todo, err)
+	}
+	if todo, err := pending(migrations, map[int64]time.Time{1: now, 2: now, 3: now}); err != nil || len(todo) != 0 {
+		t.Errorf("pending on an up-to-date schema = %v, %v", todo, err)
+	}
+	if _, err := pending(migrations, map[int64]time.Time{1: now, 3: now}); err == nil {
+		t.Error("expected an error for a migration older than the applied version")
+	}
+}
@@ -0,0 +1,210 @@
+package migration
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
+	"log/slog"
+	"time"
+)
+
+// lockKey is the advisory lock held while migrating, so replicas starting together apply
+// each migration once and the others wait for the schema to be ready.
+const lockKey = 7_271_002
+
+// Status is a migration and, if it is applied, when.
+type Status struct {
+	Migration
+	AppliedAt *time.Time
+}
+
+type Runner struct {
+	pool       *pgxpool.Pool
+	migrations []Migration
+}
+
+// NewRunner migrates the database behind pool with the embedded migrations.
+func NewRunner(pool *pgxpool.Pool) (*Runner, error) {
+	migrations, err := Embedded()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Runner{pool: pool, migrations: migrations}, nil
+}
+
+// Up applies every pending migration, each in its own transaction, and returns how many it applied.
+func (r *Runner) Up(ctx context.Context) (int, error) {
+	var applied int
+	err := r.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		todo, err := pending(r.migrations, versions)
+		if err != nil {
+			return err
+		}
+		for _, m := range todo {
+			if err := apply(ctx, conn, m.Name, m.Up, `INSERT INTO goose_db_version(version_id, is_applied) VALUES($1, TRUE)`, m.Version); err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "migration applied", "version", m.Version, "name", m.Name)
+			applied++
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down reverts the last applied migration. It does nothing on an empty schema.
+func (r *Runner) Down(ctx context.Context) error {
+	return r.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(r.migrations) - 1; i >= 0; i-- {
+			m := r.migrations[i]
+			if _, ok := versions[m.Version]; !ok {
+				continue
+			}
+			if err := apply(ctx, conn, m.Name, m.Down, `DELETE FROM goose_db_version WHERE version_id = $1`, m.Version); err != nil {
+				return err
+			}
+			slog.InfoContext(ctx, "migration reverted", "version", m.Version, "name", m.Name)
+
+			return nil
+		}
+		slog.InfoContext(ctx, "no migration to revert")
+
+		return nil
+	})
+}
+
+// Status lists every embedded migration with the time it was applied, if it was.
+func (r *Runner) Status(ctx context.Context) ([]Status, error) {
+	var statuses []Status
+	err := r.locked(ctx, func(conn *pgxpool.Conn) error {
+		versions, err := appliedVersions(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, m := range r.migrations {
+			status := Status{Migration: m}
+			if at, ok := versions[m.Version]; ok {
+				status.AppliedAt = &at
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// locked runs fn on one connection holding the migration lock, with the version table in place.
+func (r *Runner) locked(ctx context.Context, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Release()
+
+	if _, err := conn.Exec(ctx, `SELECT pg_advisory_lock($1)`, lockKey); err != nil {
+		return fmt.Errorf("take migration lock: %w", err)
+	}
+	defer func() {
+		// the session keeps the lock if the unlock fails, so drop the connection instead
+		if _, err := conn.Exec(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, lockKey); err != nil {
+			_ = conn.Conn().Close(context.WithoutCancel(ctx))
+		}
+	}()
+
+	const createTable = `
+	CREATE TABLE IF NOT EXISTS goose_db_version (
+		id SERIAL PRIMARY KEY,
+		version_id BIGINT NOT NULL,
+		is_applied BOOLEAN NOT NULL,
+		tstamp TIMESTAMP NULL DEFAULT NOW()
+	)`
+	if _, err := conn.Exec(ctx, createTable); err != nil {
+		return fmt.Errorf("create goose_db_version: %w", err)
+	}
+	const initTable = `INSERT INTO goose_db_version(version_id, is_applied) SELECT 0, TRUE WHERE NOT EXISTS (SELECT 1 FROM goose_db_version)`
+	if _, err := conn.Exec(ctx, initTable); err != nil {
+		return fmt.Errorf("init goose_db_version: %w", err)
+	}
+
+	return fn(conn)
+}
+
+// appliedVersions replays the version table, where older goose releases recorded a rollback
+// as a row with is_applied = false rather than deleting the row.
+func appliedVersions(ctx context.Context, conn *pgxpool.Conn) (map[int64]time.Time, error) {
+	rows, err := conn.Query(ctx, `SELECT version_id, is_applied, COALESCE(tstamp, NOW()) FROM goose_db_version WHERE version_id > 0 ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make(map[int64]time.Time)
+	for rows.Next() {
+		var (
+			version   int64
+			isApplied bool
+			at        time.Time
+		)
+		if err := rows.Scan(&version, &isApplied, &at); err != nil {
+			return nil, err
+		}
+		if isApplied {
+			versions[version] = at
+		} else {
+			delete(versions, version)
+		}
+	}
+
+	return versions, rows.Err()
+}
+
+// pending returns the migrations to apply in order. Like goose, it refuses to apply a
+// migration older than the current version: that file was added out of order.
+func pending(migrations []Migration, applied map[int64]time.Time) ([]Migration, error) {
+	var current int64
+	for version := range applied {
+		if version > current {
+			current = version
+		}
+	}
+
+	var todo []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		if m.Version < current {
+			return nil, fmt.Errorf("migration %s is older than the applied version %d", m.Name, current)
+		}
+		todo = append(todo, m)
+	}
+
+	return todo, nil
+}
+
+func apply(ctx context.Context, conn *pgxpool.Conn, name string, statements []string, record string, version int64) error {
+	return conn.BeginFunc(ctx, func(tx pgx.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(ctx, stmt); err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+		}
+		_, err := tx.Exec(ctx, record, version)
+
+		return err
+	})
+}
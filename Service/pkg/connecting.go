@@ -4,52 +4,98 @@ import (
 	"context"
 	"fmt"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"log/slog"
+	"strconv"
 	"time"
 )
 
 type Postgres struct {
-	maxAttempts int
-
 	Pool *pgxpool.Pool
 }
 
-func New(connectionString string) *Postgres {
-	return &Postgres{
-		Pool: newPool(context.Background(), 10, connectionString),
-	}
+// Config tunes the pool on top of the DSN. Zero values keep the pgx defaults, except for
+// the connection attempts, which default to a single one.
+type Config struct {
+	DSN string
+	// MaxConnLifetime recycles connections, so the pool moves to a new primary after a failover.
+	MaxConnLifetime time.Duration
+	// HealthCheckPeriod is how often idle connections are checked and dead ones dropped.
+	HealthCheckPeriod time.Duration
+	// StatementTimeout makes the server cancel statements running longer.
+	StatementTimeout time.Duration
+	// ConnectTimeout bounds each connection attempt, also of connections opened later.
+	ConnectTimeout  time.Duration
+	ConnectAttempts int
+	// Backoff spaces the connection attempts.
+	Backoff Backoff
+	// Lazy opens connections on first use instead of waiting for the server in New, for
+	// optional servers such as replicas that may be down at startup.
+	Lazy bool
 }
 
-func newPool(ctx context.Context, maxAttempts int, connectionString string) (connectionPool *pgxpool.Pool) {
-	var err error
-
-	err = doWithTries(func() error {
-		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
-		defer cancel()
-
-		connectionPool, err = pgxpool.Connect(ctx, connectionString)
+// New connects to Postgres, retrying with backoff while the database is not reachable yet.
+func New(ctx context.Context, config Config) (*Postgres, error) {
+	poolConfig, err := pgxpool.ParseConfig(config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("parse postgres DSN: %w", err)
+	}
+	if config.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = config.MaxConnLifetime
+	}
+	if config.HealthCheckPeriod > 0 {
+		poolConfig.HealthCheckPeriod = config.HealthCheckPeriod
+	}
+	if config.StatementTimeout > 0 {
+		poolConfig.ConnConfig.RuntimeParams["statement_timeout"] = strconv.FormatInt(config.StatementTimeout.Milliseconds(), 10)
+	}
+	// pgxpool dials with a context detached from the caller's, so only the ConnConfig timeout
+	// bounds a dial, including the ones of connections the pool opens later
+	if config.ConnectTimeout > 0 {
+		poolConfig.ConnConfig.ConnectTimeout = config.ConnectTimeout
+	}
+	if config.Lazy {
+		poolConfig.LazyConnect = true
+		pool, err := pgxpool.ConnectConfig(ctx, poolConfig)
 		if err != nil {
-			return err
+			return nil, err
 		}
+		return &Postgres{Pool: pool}, nil
+	}
+
+	var pool *pgxpool.Pool
+	err = doWithTries(ctx, func() error {
+		ctx := ctx
+		if config.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.ConnectTimeout)
+			defer cancel()
+		}
+
+		// unless the pool is lazy, ConnectConfig opens a first connection, so the server is up
+		// once it returns
+		pool, err = pgxpool.ConnectConfig(ctx, poolConfig.Copy())
 
-		return nil
-	}, maxAttempts, 5*time.Second)
+		return err
+	}, config.ConnectAttempts, config.Backoff)
 	if err != nil {
-		(fmt.Println(err.Error()))
-		return nil
+		return nil, fmt.Errorf("connect to postgres: %w", err)
 	}
 
-	return connectionPool
+	return &Postgres{Pool: pool}, nil
 }
 
-func doWithTries(fn func() error, attempts int, delay time.Duration) (err error) {
-	for attempts > 0 {
-		if err = fn(); err != nil {
-			time.Sleep(delay)
-			attempts--
-
-			continue
+// doWithTries calls fn until it succeeds, at most attempts times, sleeping per backoff in between.
+func doWithTries(ctx context.Context, fn func() error, attempts int, backoff Backoff) (err error) {
+	for attempt := 0; ; attempt++ {
+		if err = fn(); err == nil {
+			return nil
+		}
+		if attempt+1 >= attempts {
+			return err
+		}
+		slog.WarnContext(ctx, "postgres connect failed, retrying", "attempt", attempt+1, "err", err)
+		if sleepErr := backoff.Sleep(ctx, attempt); sleepErr != nil {
+			return err
 		}
-		return nil
 	}
-	return err
 }
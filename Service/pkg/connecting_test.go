@@ -1,20 +1,27 @@
 package postgres
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"io"
+	"net"
 	"testing"
 	"time"
 )
 
+var fastBackoff = Backoff{Base: time.Millisecond, Max: time.Millisecond}
+
 func TestDoWithTries_SucceedsAfterRetries(t *testing.T) {
 	attempts := 0
-	err := doWithTries(func() error {
+	err := doWithTries(context.Background(), func() error {
 		attempts++
 		if attempts < 3 {
 			return errors.New("fail")
 		}
 		return nil
-	}, 5, 1*time.Millisecond)
+	}, 5, fastBackoff)
 	if err != nil {
 		t.Fatalf("expected success, got error: %v", err)
 	}
@@ -25,10 +32,10 @@ func TestDoWithTries_SucceedsAfterRetries(t *testing.T) {
 
 func TestDoWithTries_FailsWhenExhausted(t *testing.T) {
 	count := 0
-	err := doWithTries(func() error {
+	err := doWithTries(context.Background(), func() error {
 		count++
 		return errors.New("always fail")
-	}, 2, 1*time.Millisecond)
+	}, 2, fastBackoff)
 	if err == nil {
 		t.Fatal("expected error, got nil")
 	}
@@ -36,3 +43,117 @@ func TestDoWithTries_FailsWhenExhausted(t *testing.T) {
 		t.Errorf("expected 2 attempts, got %d", count)
 	}
 }
+
+func TestDoWithTries_StopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err := doWithTries(ctx, func() error {
+		count++
+		cancel()
+		return errors.New("down")
+	}, 10, Backoff{Base: time.Hour, Max: time.Hour})
+	if err == nil || count != 1 {
+		t.Errorf("expected to give up after the first attempt, got %d attempts, err %v", count, err)
+	}
+}
+
+// silentServer accepts connections and never answers, like a server hanging during a failover.
+func silentServer(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		var conns []net.Conn
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	return "postgres://user@" + ln.Addr().String() + "/db?sslmode=disable"
+}
+
+func TestNew_FailsWhenServerDoesNotAnswer(t *testing.T) {
+	start := time.Now()
+	_, err := New(context.Background(), Config{
+		DSN:             silentServer(t),
+		ConnectTimeout:  100 * time.Millisecond,
+		ConnectAttempts: 2,
+		Backoff:         fastBackoff,
+	})
+	if err == nil {
+		t.Fatal("expected an error from a server that does not answer")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("connect must give up after the attempts time out, took %s", elapsed)
+	}
+}
+
+func TestNew_ConnectTimeoutBoundsLaterDials(t *testing.T) {
+	p, err := New(context.Background(), Config{DSN: silentServer(t), ConnectTimeout: 100 * time.Millisecond, Lazy: true})
+	if err != nil {
+		t.Fatalf("New error: %v", err)
+	}
+	defer p.Pool.Close()
+	if got := p.Pool.Config().ConnConfig.ConnectTimeout; got != 100*time.Millisecond {
+		t.Fatalf("ConnectTimeout = %s, pool dials would fall back to the pgxpool default", got)
+	}
+
+	// the pool dials with a detached context, so the caller's deadline alone would not stop it
+	start := time.Now()
+	conn, err := p.Pool.Acquire(context.Background())
+	if err == nil {
+		conn.Release()
+		t.Fatal("expected the dial to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("dial must give up after ConnectTimeout, took %s", elapsed)
+	}
+}
+
+func TestBackoff_Delay(t *testing.T) {
+	b := Backoff{Base: 100 * time.Millisecond, Max: time.Second}
+	for retry, max := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		max *= time.Millisecond
+		for i := 0; i < 50; i++ {
+			if d := b.Delay(retry); d < max/2 || d > max {
+				t.Fatalf("Delay(%d) = %s, want within [%s, %s]", retry, d, max/2, max)
+			}
+		}
+	}
+	if d := b.Delay(100); d < 500*time.Millisecond || d > time.Second {
+		t.Errorf("Delay must stay capped for large retries, got %s", d)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		idempotent bool
+		want       bool
+	}{
+		{"serialization failure", &pgconn.PgError{Code: "40001"}, false, true},
+		{"admin shutdown", fmt.Errorf("query: %w", &pgconn.PgError{Code: "57P01"}), false, true},
+		{"read only after failover", &pgconn.PgError{Code: "25006"}, false, true},
+		{"unique violation", &pgconn.PgError{Code: "23505"}, true, false},
+		{"statement timeout", &pgconn.PgError{Code: "57014"}, true, false},
+		{"reset read", io.ErrUnexpectedEOF, true, true},
+		{"reset write", io.ErrUnexpectedEOF, false, false},
+		{"cancelled", context.Canceled, true, false},
+		{"plain", errors.New("boom"), true, false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err, tt.idempotent); got != tt.want {
+			t.Errorf("%s: Retryable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package postgres
+
+import (
+	"context"
+	"errors"
+	"github.com/jackc/pgconn"
+	"io"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"time"
+)
+
+// Backoff is an exponential backoff with jitter: the n-th retry waits between half and all
+// of Base*2^n, capped at Max, so clients failing together do not retry together.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay is the wait before retry n, counting from 0.
+func (b Backoff) Delay(retry int) time.Duration {
+	if b.Base <= 0 {
+		return 0
+	}
+	d := b.Max
+	if retry < 32 && (b.Max <= 0 || b.Base<<retry < b.Max) {
+		d = b.Base << retry
+	}
+	half := d / 2
+
+	return half + rand.N(d-half+1)
+}
+
+// Sleep waits for retry n unless ctx is done first.
+func (b Backoff) Sleep(ctx context.Context, retry int) error {
+	timer := time.NewTimer(b.Delay(retry))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Retryable reports whether a statement that failed with err can be sent again.
+//
+// Errors the server answered with mean the statement did not take effect; of those, the ones
+// that go away by themselves are retryable: serialization failures and deadlocks, and the
+// shutdown, connection and read-only errors of a failover. Errors raised before anything was
+// sent are always retryable. A connection lost mid-statement leaves its outcome unknown, so
+// it is retryable only for idempotent statements.
+func Retryable(err error, idempotent bool) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		switch pgErr.Code {
+		case "40001", // serialization_failure
+			"40P01", // deadlock_detected
+			"57P01", // admin_shutdown
+			"57P02", // crash_shutdown
+			"57P03", // cannot_connect_now
+			"25006": // read_only_sql_transaction: still connected to the demoted primary
+			return true
+		}
+		// class 08: connection exception
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+	if pgconn.SafeToRetry(err) {
+		return true
+	}
+	if !idempotent {
+		return false
+	}
+
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF)
+}